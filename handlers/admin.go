@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
 
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/process"
 	. "github.com/eburlingame/fstop/resources"
 
 	"github.com/gin-gonic/gin"
@@ -10,9 +13,30 @@ import (
 
 func AdminGetHandler(r *Resources) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		var heartbeats []WorkerHeartbeat
+		if err := r.Db.ListWorkerHeartbeats(&heartbeats); err != nil {
+			log.Printf("Error listing worker heartbeats: %s\n", err)
+		}
 
 		c.HTML(http.StatusOK, "admin.html", gin.H{
-			"title": "Dashboard",
+			"title":   "Dashboard",
+			"workers": heartbeats,
+		})
+	}
+}
+
+// Reports the processing memory of this process. Separate worker processes
+// report their peaks in their heartbeats.
+func ProcessingMetricsApiGetHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var heartbeats []WorkerHeartbeat
+		if err := r.Db.ListWorkerHeartbeats(&heartbeats); err != nil {
+			log.Printf("Error listing worker heartbeats: %s\n", err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"processing": GetProcessingMetrics(),
+			"workers":    heartbeats,
 		})
 	}
 }
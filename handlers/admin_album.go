@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"log"
 	"net/http"
 
@@ -70,8 +71,12 @@ func EditAlbumPage(r *Resources, c *gin.Context) {
 	}
 
 	c.HTML(http.StatusOK, "edit_album.html", gin.H{
-		"album": album,
-		"files": albumImages,
+		"album":           album,
+		"files":           albumImages,
+		"sizeProfileSets": r.Config.SizeProfiles.Names(),
+		"hasWatermark":    r.Config.Watermark != nil,
+		"privacyPolicies": PrivacyPolicies(),
+		"defaultPrivacy":  r.Config.DefaultPrivacyPolicy,
 	})
 }
 
@@ -132,10 +137,22 @@ func AdminAddPhotosPostHandler(r *Resources) gin.HandlerFunc {
 
 		imageIds := c.PostFormArray("images")
 
+		previousPolicies, err := getImagePrivacyPolicies(r, imageIds)
+		if err != nil {
+			log.Printf("Error reading image privacy policies: %s\n", err)
+			c.Status(500)
+			return
+		}
+
 		for _, imageId := range imageIds {
 			r.Db.AddImageToAlbum(album.AlbumId, imageId)
 		}
 
+		if err := rescrubAlbumImages(c.Request.Context(), r, previousPolicies); err != nil {
+			c.Status(500)
+			return
+		}
+
 		c.Redirect(http.StatusFound, "/admin/albums/"+album.Slug)
 	}
 }
@@ -151,10 +168,13 @@ func AdminEditAlbumPostHandler(r *Resources) gin.HandlerFunc {
 		}
 
 		type FormData struct {
-			Name        string `form:"name"`
-			Slug        string `form:"slug"`
-			Description string `form:"description"`
-			IsPublished string `form:"is_published"`
+			Name           string `form:"name"`
+			Slug           string `form:"slug"`
+			Description    string `form:"description"`
+			IsPublished    string `form:"is_published"`
+			SizeProfileSet string `form:"size_profile_set"`
+			Watermark      string `form:"watermark_enabled"`
+			PrivacyPolicy  string `form:"privacy_policy"`
 		}
 
 		var form FormData
@@ -163,15 +183,42 @@ func AdminEditAlbumPostHandler(r *Resources) gin.HandlerFunc {
 		var album Album
 		r.Db.GetAlbumBySlug(&album, params.AlbumSlug)
 
+		albumImages, _ := r.Db.ListAlbumFiles(params.AlbumSlug, true)
+		imageIds := []string{}
+		for _, image := range albumImages {
+			imageIds = append(imageIds, image.ImageId)
+		}
+
+		previousPolicies, err := getImagePrivacyPolicies(r, imageIds)
+		if err != nil {
+			log.Printf("Error reading image privacy policies: %s\n", err)
+			c.Status(500)
+			return
+		}
+
 		slugChanged := album.Slug != form.Slug
 
 		album.Name = form.Name
 		album.Slug = form.Slug
 		album.Description = form.Description
 		album.IsPublished = form.IsPublished == "on"
+		album.WatermarkEnabled = form.Watermark == "on"
+
+		if form.PrivacyPolicy == "" || IsValidPrivacyPolicy(form.PrivacyPolicy) {
+			album.PrivacyPolicy = form.PrivacyPolicy
+		}
+
+		if _, err := r.Config.SizeProfiles.Get(form.SizeProfileSet); err == nil {
+			album.SizeProfileSet = form.SizeProfileSet
+		}
 
 		r.Db.UpdateAlbum(album.AlbumId, &album)
 
+		if err := rescrubAlbumImages(c.Request.Context(), r, previousPolicies); err != nil {
+			c.Status(500)
+			return
+		}
+
 		if slugChanged {
 			c.Redirect(http.StatusFound, "/admin/albums/"+album.Slug)
 		} else {
@@ -180,6 +227,21 @@ func AdminEditAlbumPostHandler(r *Resources) gin.HandlerFunc {
 	}
 }
 
+// Queues the images of an album whose privacy policy became stricter, as
+// policies are otherwise only applied on import
+func rescrubAlbumImages(ctx context.Context, r *Resources, previousPolicies map[string]string) error {
+	queued, err := queuePrivacyRenders(ctx, r, previousPolicies)
+	if err != nil {
+		log.Printf("Error queueing privacy re-renders: %s\n", err)
+		return err
+	}
+
+	if queued > 0 {
+		log.Printf("Queued %d images to apply a stricter privacy policy\n", queued)
+	}
+	return nil
+}
+
 func AdminRemoveImageFromAlbumPostHandler(r *Resources) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		type DeleteAlbumImageUriParams struct {
@@ -198,13 +260,13 @@ func AdminRemoveImageFromAlbumPostHandler(r *Resources) gin.HandlerFunc {
 	}
 }
 
-func deleteAndRemoveImage(r *Resources, imageId string) {
+func deleteAndRemoveImage(ctx context.Context, r *Resources, imageId string) {
 	// Remove images from storage
 	var files []File
 	r.Db.ListImageFiles(&files, imageId)
 
 	for _, file := range files {
-		err := r.Storage.DeleteFile(file.StoragePath)
+		err := r.Storage.DeleteFile(ctx, file.StoragePath)
 		if err != nil {
 			log.Printf("Error deleting file: %s\n", err)
 		}
@@ -223,14 +285,14 @@ func AdminDeleteAlbumPostHandler(r *Resources) gin.HandlerFunc {
 		var params DeleteAlbumUriParams
 		c.BindUri(&params)
 
-		images, _ := r.Db.ListAlbumFiles(params.AlbumSlug)
+		images, _ := r.Db.ListAlbumFiles(params.AlbumSlug, true)
 
 		var album Album
 		r.Db.GetAlbumBySlug(&album, params.AlbumSlug)
 
 		for _, file := range images {
 			log.Println("Deleting image: ", file.ImageId)
-			deleteAndRemoveImage(r, file.ImageId)
+			deleteAndRemoveImage(c.Request.Context(), r, file.ImageId)
 		}
 
 		log.Println(len(images), " images deleted from album")
@@ -249,8 +311,34 @@ func AdminDeleteImagePostHandler(r *Resources) gin.HandlerFunc {
 		var params DeleteImageUriParams
 		c.BindUri(&params)
 
-		deleteAndRemoveImage(r, params.ImageId)
+		deleteAndRemoveImage(c.Request.Context(), r, params.ImageId)
 
 		c.Redirect(http.StatusFound, "/")
 	}
 }
+
+func AdminImageVisibilityPostHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		type ImageVisibilityUriParams struct {
+			ImageId string `uri:"imageId" binding:"required"`
+		}
+
+		var params ImageVisibilityUriParams
+		c.BindUri(&params)
+
+		visibility := c.PostForm("visibility")
+		if !IsValidVisibility(visibility) {
+			c.String(http.StatusBadRequest, "Unknown visibility: %s", visibility)
+			return
+		}
+
+		err := r.Db.UpdateImageVisibility(params.ImageId, visibility)
+		if err != nil {
+			log.Printf("Error updating image visibility: %s\n", err)
+			c.Status(500)
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/image/"+params.ImageId)
+	}
+}
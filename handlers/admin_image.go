@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/process"
+	. "github.com/eburlingame/fstop/resources"
+	. "github.com/eburlingame/fstop/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ImageUriParams struct {
+	ImageId string `uri:"imageId" binding:"required"`
+}
+
+// The crop is entered as percentages of the rotated image
+type ImageEditForm struct {
+	Rotation   int     `form:"rotation"`
+	Straighten float64 `form:"straighten"`
+	CropLeft   float64 `form:"crop_left"`
+	CropTop    float64 `form:"crop_top"`
+	CropWidth  float64 `form:"crop_width"`
+	CropHeight float64 `form:"crop_height"`
+	Exposure   float64 `form:"exposure"`
+	Contrast   float64 `form:"contrast"`
+}
+
+func (f *ImageEditForm) toImageEdit(imageId string) *ImageEdit {
+	return &ImageEdit{
+		ImageId:    imageId,
+		Rotation:   f.Rotation,
+		Straighten: f.Straighten,
+		CropLeft:   f.CropLeft / 100,
+		CropTop:    f.CropTop / 100,
+		CropWidth:  f.CropWidth / 100,
+		CropHeight: f.CropHeight / 100,
+		Exposure:   f.Exposure,
+		Contrast:   f.Contrast,
+	}
+}
+
+func getImageOriginal(r *Resources, imageId string) *File {
+	var files []File
+	r.Db.ListImageFiles(&files, imageId)
+
+	return FindOriginalFile(files)
+}
+
+// Regenerates every derivative of an image from its original
+func queueImageRender(ctx context.Context, r *Resources, original *File) error {
+	_, _, err := queueResizes(ctx, r, []File{*original}, "", false)
+	return err
+}
+
+func AdminImageEditGetHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params ImageUriParams
+
+		err := c.BindUri(&params)
+		if err != nil {
+			c.Status(404)
+			return
+		}
+
+		if getImageOriginal(r, params.ImageId) == nil {
+			c.Status(404)
+			return
+		}
+
+		var edit ImageEdit
+		r.Db.GetImageEdit(&edit, params.ImageId)
+
+		// Shown uncropped when the image has never been cropped
+		if !edit.HasCrop() {
+			edit.CropLeft, edit.CropTop, edit.CropWidth, edit.CropHeight = 0, 0, 1, 1
+		}
+
+		c.HTML(http.StatusOK, "edit_image.html", gin.H{
+			"imageId": params.ImageId,
+			"form": ImageEditForm{
+				Rotation:   edit.Rotation,
+				Straighten: edit.Straighten,
+				CropLeft:   edit.CropLeft * 100,
+				CropTop:    edit.CropTop * 100,
+				CropWidth:  edit.CropWidth * 100,
+				CropHeight: edit.CropHeight * 100,
+				Exposure:   edit.Exposure,
+				Contrast:   edit.Contrast,
+			},
+			"rotations":     []int{0, 90, 180, 270},
+			"maxStraighten": MAX_STRAIGHTEN_DEGREES,
+			"maxExposure":   MAX_EXPOSURE_STOPS,
+			"maxContrast":   MAX_CONTRAST,
+		})
+	}
+}
+
+// Renders the edit described by the query string from the original
+func AdminImageEditPreviewGetHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params ImageUriParams
+
+		err := c.BindUri(&params)
+		if err != nil {
+			c.Status(404)
+			return
+		}
+
+		var form ImageEditForm
+		err = c.ShouldBindQuery(&form)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid edit: %s", err)
+			return
+		}
+
+		edit := form.toImageEdit(params.ImageId)
+		if err := edit.Validate(); err != nil {
+			c.String(http.StatusBadRequest, "Invalid edit: %s", err)
+			return
+		}
+
+		original := getImageOriginal(r, params.ImageId)
+		if original == nil {
+			c.Status(404)
+			return
+		}
+
+		preview, err := RenderEditPreview(c.Request.Context(), r, original, edit)
+		if err != nil {
+			log.Printf("Error rendering edit preview: %s\n", err)
+			c.Status(500)
+			return
+		}
+
+		c.Data(http.StatusOK, "image/jpeg", preview)
+	}
+}
+
+func AdminImageEditPostHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params ImageUriParams
+
+		err := c.BindUri(&params)
+		if err != nil {
+			c.Status(404)
+			return
+		}
+
+		var form ImageEditForm
+		err = c.ShouldBind(&form)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid edit: %s", err)
+			return
+		}
+
+		edit := form.toImageEdit(params.ImageId)
+		if err := edit.Validate(); err != nil {
+			c.String(http.StatusBadRequest, "Invalid edit: %s", err)
+			return
+		}
+
+		original := getImageOriginal(r, params.ImageId)
+		if original == nil {
+			c.Status(404)
+			return
+		}
+
+		if edit.IsIdentity() {
+			err = r.Db.DeleteImageEdit(params.ImageId)
+		} else {
+			err = r.Db.SaveImageEdit(edit)
+		}
+		if err != nil {
+			log.Printf("Error saving image edit: %s\n", err)
+			c.Status(500)
+			return
+		}
+
+		err = queueImageRender(c.Request.Context(), r, original)
+		if err != nil {
+			log.Printf("Error queueing image render: %s\n", err)
+			c.Status(500)
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/image/"+params.ImageId)
+	}
+}
+
+// Removes the edit, rendering the derivatives from the original as imported
+func AdminImageEditResetPostHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params ImageUriParams
+
+		err := c.BindUri(&params)
+		if err != nil {
+			c.Status(404)
+			return
+		}
+
+		original := getImageOriginal(r, params.ImageId)
+		if original == nil {
+			c.Status(404)
+			return
+		}
+
+		err = r.Db.DeleteImageEdit(params.ImageId)
+		if err != nil {
+			log.Printf("Error deleting image edit: %s\n", err)
+			c.Status(500)
+			return
+		}
+
+		err = queueImageRender(c.Request.Context(), r, original)
+		if err != nil {
+			log.Printf("Error queueing image render: %s\n", err)
+			c.Status(500)
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/image/"+params.ImageId)
+	}
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/resources"
+
+	"github.com/gin-gonic/gin"
+)
+
+type QueueTaskUriParams struct {
+	TaskId string `uri:"taskId" binding:"required"`
+}
+
+// Marks the import tasks of removed messages as failed, so their batches
+// stop waiting for them
+func markQueuedTasksRemoved(r *Resources, tasks []QueuedTask) {
+	for _, task := range tasks {
+		if task.Task == nil {
+			continue
+		}
+
+		r.Db.UpdateImportTaskState(
+			task.Task.ImportBatchId, task.Task.ImageId, TASK_FAILED,
+			"Removed from the queue", task.Task.Attempt,
+		)
+	}
+}
+
+func requeueQueuedTask(ctx context.Context, r *Resources, taskId string) error {
+	task, err := r.Queue.GetTask(ctx, taskId)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		return fmt.Errorf("no task %s in the queue", taskId)
+	}
+	if task.State == QUEUE_STATE_IN_FLIGHT {
+		return fmt.Errorf("task %s is being processed", taskId)
+	}
+
+	err = r.Queue.RequeueTask(ctx, taskId)
+	if err != nil {
+		return err
+	}
+
+	if task.Task != nil {
+		r.Db.UpdateImportTaskState(task.Task.ImportBatchId, task.Task.ImageId, TASK_QUEUED, "", task.Task.Attempt)
+	}
+
+	return nil
+}
+
+func deleteQueuedTask(ctx context.Context, r *Resources, taskId string) error {
+	task, err := r.Queue.GetTask(ctx, taskId)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		return fmt.Errorf("no task %s in the queue", taskId)
+	}
+	if task.State == QUEUE_STATE_IN_FLIGHT {
+		return fmt.Errorf("task %s is being processed", taskId)
+	}
+
+	// A worker may still have received it since
+	err = r.Queue.DeleteTask(ctx, taskId)
+	if err != nil {
+		return err
+	}
+
+	markQueuedTasksRemoved(r, []QueuedTask{*task})
+
+	return nil
+}
+
+// In-flight tasks can't be purged, as their workers would still finish them
+func purgeQueuedTasks(ctx context.Context, r *Resources, state string) (int, error) {
+	if state != QUEUE_STATE_PENDING && state != QUEUE_STATE_DEAD {
+		return 0, fmt.Errorf("only pending or dead tasks can be purged")
+	}
+
+	tasks, err := r.Queue.PurgeTasks(ctx, state)
+	if err != nil {
+		return 0, err
+	}
+
+	markQueuedTasksRemoved(r, tasks)
+
+	return len(tasks), nil
+}
+
+func AdminQueueGetHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sections := []gin.H{}
+
+		for _, state := range []string{QUEUE_STATE_IN_FLIGHT, QUEUE_STATE_PENDING, QUEUE_STATE_DEAD} {
+			tasks, err := r.Queue.ListTasks(c.Request.Context(), state)
+			if err != nil {
+				log.Printf("Error listing %s tasks: %s\n", state, err)
+				c.Status(500)
+				return
+			}
+
+			sections = append(sections, gin.H{
+				"state":     state,
+				"tasks":     tasks,
+				"canPurge":  state != QUEUE_STATE_IN_FLIGHT && len(tasks) > 0,
+				"canModify": state != QUEUE_STATE_IN_FLIGHT,
+			})
+		}
+
+		c.HTML(http.StatusOK, "admin_queue.html", gin.H{
+			"sections": sections,
+		})
+	}
+}
+
+func AdminQueueRequeuePostHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params QueueTaskUriParams
+		c.BindUri(&params)
+
+		if err := requeueQueuedTask(c.Request.Context(), r, params.TaskId); err != nil {
+			log.Printf("Error requeueing task: %s\n", err)
+		}
+
+		c.Redirect(http.StatusFound, "/admin/queue")
+	}
+}
+
+func AdminQueueDeletePostHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params QueueTaskUriParams
+		c.BindUri(&params)
+
+		if err := deleteQueuedTask(c.Request.Context(), r, params.TaskId); err != nil {
+			log.Printf("Error deleting task: %s\n", err)
+		}
+
+		c.Redirect(http.StatusFound, "/admin/queue")
+	}
+}
+
+func AdminQueuePurgePostHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := purgeQueuedTasks(c.Request.Context(), r, c.PostForm("state")); err != nil {
+			log.Printf("Error purging tasks: %s\n", err)
+		}
+
+		c.Redirect(http.StatusFound, "/admin/queue")
+	}
+}
+
+func QueueApiGetHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := c.DefaultQuery("state", QUEUE_STATE_PENDING)
+		if !IsValidQueueState(state) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown state: %s", state)})
+			return
+		}
+
+		tasks, err := r.Queue.ListTasks(c.Request.Context(), state)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("Error listing tasks: %s", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"state": state,
+			"tasks": tasks,
+		})
+	}
+}
+
+func QueueRequeueApiPostHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params QueueTaskUriParams
+		c.BindUri(&params)
+
+		if err := requeueQueuedTask(c.Request.Context(), r, params.TaskId); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"requeued": params.TaskId})
+	}
+}
+
+func QueueDeleteApiHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params QueueTaskUriParams
+		c.BindUri(&params)
+
+		if err := deleteQueuedTask(c.Request.Context(), r, params.TaskId); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"deleted": params.TaskId})
+	}
+}
+
+func QueuePurgeApiPostHandler(r *Resources) gin.HandlerFunc {
+	type PurgeRequest struct {
+		State string `json:"state"`
+	}
+
+	return func(c *gin.Context) {
+		var purgeRequest PurgeRequest
+
+		err := c.Bind(&purgeRequest)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unrecognized payload: %s", err)})
+			return
+		}
+
+		purged, err := purgeQueuedTasks(c.Request.Context(), r, purgeRequest.State)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"state":  purgeRequest.State,
+			"purged": purged,
+		})
+	}
+}
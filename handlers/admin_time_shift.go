@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/resources"
+	. "github.com/eburlingame/fstop/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Finds how far to shift the capture times, from the offset or from the
+// reference image and its known time
+func getTimeShiftDelta(r *Resources, request *TimeShiftRequest) (time.Duration, error) {
+	if request.ReferenceImageId == "" {
+		if request.Offset == "" {
+			return 0, fmt.Errorf("an offset or a reference image is required")
+		}
+		return time.ParseDuration(request.Offset)
+	}
+
+	var reference Image
+	r.Db.GetImage(&reference, request.ReferenceImageId)
+	if reference.ImageId == "" {
+		return 0, fmt.Errorf("reference image %s doesn't exist", request.ReferenceImageId)
+	}
+	if reference.DateUnknown {
+		return 0, fmt.Errorf("reference image %s has no capture time", request.ReferenceImageId)
+	}
+
+	knownTime, err := ParseReferenceTime(request.ReferenceTime)
+	if err != nil {
+		return 0, err
+	}
+
+	return knownTime.Sub(reference.DateTimeLocal), nil
+}
+
+// Finds the shift and the images it applies to, with their capture times
+// before and after. Images without a capture time are left out.
+func planTimeShift(r *Resources, request *TimeShiftRequest) (time.Duration, []Image, []TimeShiftResult, error) {
+	if request.IsEmpty() {
+		return 0, nil, nil, fmt.Errorf("select images by album, import batch or camera serial number")
+	}
+
+	delta, err := getTimeShiftDelta(r, request)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	selected, err := r.Db.ListSelectedImages(request.ImageSelection)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	images := []Image{}
+	results := []TimeShiftResult{}
+	for _, image := range selected {
+		if image.DateUnknown {
+			continue
+		}
+
+		images = append(images, image)
+		results = append(results, TimeShiftResult{
+			ImageId:          image.ImageId,
+			OriginalFilename: image.OriginalFilename,
+			Before:           image.DateTimeLocal.Format(LOCAL_TIME_FORMAT),
+			After:            image.DateTimeLocal.Add(delta).Format(LOCAL_TIME_FORMAT),
+		})
+	}
+
+	return delta, images, results, nil
+}
+
+// Queues writing the corrected times into the originals. Originals whose
+// metadata is stripped are skipped, as the dates were removed from them.
+func queueCaptureTimeWrites(ctx context.Context, r *Resources, images []Image) (string, int, error) {
+	originals := []File{}
+	if err := r.Db.ListOriginalImageFiles(&originals); err != nil {
+		return "", 0, err
+	}
+
+	originalFiles := map[string]File{}
+	for _, file := range originals {
+		originalFiles[file.ImageId] = file
+	}
+
+	importBatchId := Uuid()
+	queued := 0
+
+	for _, image := range images {
+		file, ok := originalFiles[image.ImageId]
+		if !ok {
+			continue
+		}
+
+		privacyPolicy, err := getImagePrivacyPolicy(r, image.ImageId)
+		if err != nil {
+			return "", 0, err
+		}
+		if privacyPolicy == PRIVACY_STRIP_ALL {
+			continue
+		}
+
+		task := ImageImport{
+			Type:            TASK_TYPE_CAPTURE_TIME,
+			ImageId:         image.ImageId,
+			ImportBatchId:   importBatchId,
+			OriginalFileKey: file.StoragePath,
+			PrivacyPolicy:   privacyPolicy,
+		}
+
+		if err := enqueueTask(ctx, r, &task, file.Filename); err != nil {
+			return importBatchId, queued, err
+		}
+		queued++
+	}
+
+	return importBatchId, queued, nil
+}
+
+// Shifts the capture times in the database, and queues writing them into the
+// originals if requested. Returns the batch of those writes, if any.
+func applyTimeShift(ctx context.Context, r *Resources, delta time.Duration, images []Image, writeOriginals bool) (string, int, error) {
+	for i := range images {
+		images[i].ShiftCaptureTime(delta)
+		images[i].CaptureTimeShift += delta
+	}
+
+	// Shifting only some of the images would leave them apart, and shifting
+	// again would move the others twice
+	err := r.Db.UpdateImagesFields(images, []string{"DateTimeOriginal", "DateTimeLocal", "CaptureTimeShift"})
+	if err != nil {
+		return "", 0, err
+	}
+
+	log.Printf("Shifted the capture times of %d images by %s\n", len(images), delta)
+
+	if !writeOriginals {
+		return "", 0, nil
+	}
+
+	return queueCaptureTimeWrites(ctx, r, images)
+}
+
+func renderTimeShiftPage(r *Resources, c *gin.Context, request *TimeShiftRequest, message string) {
+	var albums []Album
+	r.Db.ListAlbums(&albums)
+
+	c.HTML(http.StatusOK, "admin_time_shift.html", gin.H{
+		"albums":  albums,
+		"request": request,
+		"message": message,
+	})
+}
+
+func AdminTimeShiftGetHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request TimeShiftRequest
+		c.ShouldBindQuery(&request)
+
+		renderTimeShiftPage(r, c, &request, "")
+	}
+}
+
+func AdminTimeShiftPreviewPostHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request TimeShiftRequest
+		if err := c.ShouldBind(&request); err != nil {
+			c.HTML(http.StatusOK, "time_shift_preview.html", gin.H{"error": err.Error()})
+			return
+		}
+
+		delta, _, results, err := planTimeShift(r, &request)
+		if err != nil {
+			c.HTML(http.StatusOK, "time_shift_preview.html", gin.H{"error": err.Error()})
+			return
+		}
+
+		c.HTML(http.StatusOK, "time_shift_preview.html", gin.H{
+			"delta":   delta.String(),
+			"results": results,
+		})
+	}
+}
+
+func AdminTimeShiftPostHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request TimeShiftRequest
+		if err := c.ShouldBind(&request); err != nil {
+			renderTimeShiftPage(r, c, &request, err.Error())
+			return
+		}
+
+		delta, images, _, err := planTimeShift(r, &request)
+		if err != nil {
+			renderTimeShiftPage(r, c, &request, err.Error())
+			return
+		}
+
+		importBatchId, queued, err := applyTimeShift(c.Request.Context(), r, delta, images, request.WriteOriginals)
+		if err != nil {
+			log.Printf("Error shifting capture times: %s\n", err)
+			renderTimeShiftPage(r, c, &request, err.Error())
+			return
+		}
+
+		// Follow the writes to the originals like an import
+		if queued > 0 {
+			c.HTML(http.StatusOK, "import_complete.html", gin.H{
+				"importBatchId": importBatchId,
+			})
+			return
+		}
+
+		renderTimeShiftPage(r, c, &TimeShiftRequest{},
+			fmt.Sprintf("Shifted the capture times of %d images by %s", len(images), delta))
+	}
+}
+
+func TimeShiftApiPostHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request TimeShiftRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unrecognized payload: %s", err)})
+			return
+		}
+
+		delta, images, results, err := planTimeShift(r, &request)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		response := gin.H{
+			"offset":  delta.String(),
+			"images":  results,
+			"applied": false,
+		}
+
+		if request.Apply {
+			importBatchId, queued, err := applyTimeShift(c.Request.Context(), r, delta, images, request.WriteOriginals)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": fmt.Sprintf("Error shifting capture times: %s", err),
+				})
+				return
+			}
+
+			response["applied"] = true
+			if queued > 0 {
+				response["batchId"] = importBatchId
+				response["queued"] = queued
+			}
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"html/template"
 	"log"
 	"net/http"
 
+	. "github.com/eburlingame/fstop/middleware"
 	. "github.com/eburlingame/fstop/models"
 	. "github.com/eburlingame/fstop/resources"
 	. "github.com/eburlingame/fstop/utils"
@@ -52,6 +54,8 @@ func SingleAlbumGetHandler(r *Resources) gin.HandlerFunc {
 	}
 
 	return func(c *gin.Context) {
+		isAdmin := IsAdminLoggedIn(r, c)
+
 		var params UriParams
 
 		err := c.BindUri(&params)
@@ -64,7 +68,14 @@ func SingleAlbumGetHandler(r *Resources) gin.HandlerFunc {
 		var imagesWithSrcSets []ImageWithSrcSet
 
 		r.Db.GetAlbumBySlug(&album, params.AlbumSlug)
-		images, _ := r.Db.ListAlbumFiles(params.AlbumSlug)
+
+		// Unpublished albums are only visible to admins
+		if album.AlbumId == "" || (!album.IsPublished && !isAdmin) {
+			c.Status(404)
+			return
+		}
+
+		images, _ := r.Db.ListAlbumFiles(params.AlbumSlug, isAdmin)
 
 		for _, img := range images {
 
@@ -74,15 +85,22 @@ func SingleAlbumGetHandler(r *Resources) gin.HandlerFunc {
 			}
 
 			smallImage := FindSizedImage(img.Files, 500)
+			fallbackImage := FindFallbackImage(img.Files, 500)
 
 			imagesWithSrcSets = append(imagesWithSrcSets, ImageWithSrcSet{
-				ImageId:       img.ImageId,
-				SrcSet:        ComputeImageSrcSet(r.Config.S3BaseUrl, img.Files),
-				SmallImageUrl: PublicImageURL(r.Config.S3BaseUrl, smallImage.StoragePath),
-				Width:         img.WidthPixels,
-				Height:        img.HeightPixels,
-				Title:         img.DateTimeOriginal.Format("Monday, January _2, 2006"),
-				Description:   GetAlbumImageCameraAndMetaDescription(&img),
+				ImageId:          img.ImageId,
+				SrcSet:           ComputeImageSrcSet(r.Config.S3BaseUrl, img.Files),
+				Sources:          ComputePictureSources(r.Config.S3BaseUrl, img.Files),
+				SmallImageUrl:    PublicImageURL(r.Config.S3BaseUrl, smallImage.StoragePath),
+				FallbackImageUrl: PublicImageURL(r.Config.S3BaseUrl, fallbackImage.StoragePath),
+				Placeholder:      template.URL(img.Placeholder),
+				DominantColor:    img.DominantColor,
+				MediaType:        img.MediaType,
+				VideoUrl:         getVideoUrl(r, img.Files),
+				Width:            img.WidthPixels,
+				Height:           img.HeightPixels,
+				Title:            FormatCaptureDate(img.DateTimeLocal, img.DateUnknown),
+				Description:      GetAlbumImageCameraAndMetaDescription(&img),
 			})
 		}
 
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/resources"
+	. "github.com/eburlingame/fstop/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Queues naming where each image was taken
+func queueGeocodes(ctx context.Context, r *Resources, images []Image) (string, int, error) {
+	importBatchId := Uuid()
+	queued := 0
+
+	for _, image := range images {
+		privacyPolicy, err := getImagePrivacyPolicy(r, image.ImageId)
+		if err != nil {
+			return "", 0, err
+		}
+
+		task := ImageImport{
+			Type:          TASK_TYPE_GEOCODE,
+			ImageId:       image.ImageId,
+			ImportBatchId: importBatchId,
+			PrivacyPolicy: privacyPolicy,
+		}
+
+		if err := enqueueTask(ctx, r, &task, image.OriginalFilename); err != nil {
+			return importBatchId, queued, err
+		}
+		queued++
+	}
+
+	return importBatchId, queued, nil
+}
+
+// Backfills the places of images with a location. Only images without a
+// place are geocoded, unless all of them are requested, e.g. after changing
+// the cities file. They can also be narrowed to some images or an album.
+func GeocodeApiPostHandler(r *Resources) gin.HandlerFunc {
+	type GeocodeRequest struct {
+		ImageIds []string `json:"imageIds,omitempty"`
+		AlbumId  string   `json:"albumId,omitempty"`
+		All      bool     `json:"all,omitempty"`
+	}
+
+	return func(c *gin.Context) {
+		if r.Geocoder == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Reverse geocoding isn't configured, set GEONAMES_CITIES_FILE"})
+			return
+		}
+
+		var geocodeRequest GeocodeRequest
+
+		if !bindOptionalJSON(c, &geocodeRequest) {
+			return
+		}
+
+		located, err := r.Db.ListLocatedImages()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("Error listing images: %s", err),
+			})
+			return
+		}
+
+		selected := map[string]bool{}
+		for _, id := range geocodeRequest.ImageIds {
+			selected[id] = true
+		}
+		if geocodeRequest.AlbumId != "" {
+			albumImageIds, err := r.Db.ListAlbumImageIds(geocodeRequest.AlbumId)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": fmt.Sprintf("Error listing album images: %s", err),
+				})
+				return
+			}
+			for _, id := range albumImageIds {
+				selected[id] = true
+			}
+		}
+		isNarrowed := len(geocodeRequest.ImageIds) > 0 || geocodeRequest.AlbumId != ""
+
+		images := []Image{}
+		for _, image := range located {
+			if isNarrowed && !selected[image.ImageId] {
+				continue
+			}
+			if !geocodeRequest.All && image.CountryCode != "" {
+				continue
+			}
+			images = append(images, image)
+		}
+
+		log.Printf("Geocoding %d images\n", len(images))
+
+		importBatchId, queued, err := queueGeocodes(c.Request.Context(), r, images)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("Error queueing images: %s", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"batchId": importBatchId,
+			"queued":  queued,
+		})
+	}
+}
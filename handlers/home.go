@@ -1,8 +1,9 @@
 package handlers
 
 import (
+	"html/template"
 	"net/http"
-	"strings"
+	"net/url"
 
 	. "github.com/eburlingame/fstop/middleware"
 	. "github.com/eburlingame/fstop/models"
@@ -12,35 +13,117 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+func getVideoUrl(r *Resources, files []File) string {
+	videoFile := FindVideoFile(files)
+	if videoFile == nil {
+		return ""
+	}
+
+	return PublicImageURL(r.Config.S3BaseUrl, videoFile.StoragePath)
+}
+
 func HomeGetHandler(r *Resources) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		images, _ := r.Db.ListLatestImages(40, 0)
+		var placeFilter PlaceFilter
+		c.ShouldBindQuery(&placeFilter)
+		placeFilter.DefaultPrivacyPolicy = r.Config.DefaultPrivacyPolicy
+		placeFilter.Geofences = r.Config.Geofences
+
+		images, _ := r.Db.ListLatestImages(true, placeFilter, 40, 0)
 
 		var imagesWithSrcSets []ImageWithSrcSet
 
 		for _, img := range images {
 			smallImageFile := FindSizedImage(img.Files, 500)
+			fallbackImageFile := FindFallbackImage(img.Files, 500)
 
 			if smallImageFile != nil {
 				imagesWithSrcSets = append(imagesWithSrcSets, ImageWithSrcSet{
-					ImageId:       img.ImageId,
-					SrcSet:        ComputeImageSrcSet(r.Config.S3BaseUrl, (img.Files)),
-					SmallImageUrl: PublicImageURL(r.Config.S3BaseUrl, smallImageFile.StoragePath),
-					Width:         img.WidthPixels,
-					Height:        img.HeightPixels,
-					Title:         img.DateTimeOriginal.Format("Monday, January _2, 2006"),
-					Description:   GetImageCameraAndMetaDescription(&img),
+					ImageId:          img.ImageId,
+					SrcSet:           ComputeImageSrcSet(r.Config.S3BaseUrl, (img.Files)),
+					Sources:          ComputePictureSources(r.Config.S3BaseUrl, img.Files),
+					SmallImageUrl:    PublicImageURL(r.Config.S3BaseUrl, smallImageFile.StoragePath),
+					FallbackImageUrl: PublicImageURL(r.Config.S3BaseUrl, fallbackImageFile.StoragePath),
+					Placeholder:      template.URL(img.Placeholder),
+					DominantColor:    img.DominantColor,
+					MediaType:        img.MediaType,
+					VideoUrl:         getVideoUrl(r, img.Files),
+					Width:            img.WidthPixels,
+					Height:           img.HeightPixels,
+					Title:            FormatCaptureDate(img.DateTimeLocal, img.DateUnknown),
+					Description:      GetImageCameraAndMetaDescription(&img),
 				})
 			}
 		}
 
+		title := "All Photos"
+		if !placeFilter.IsEmpty() {
+			title = "Photos in " + placeFilter.String()
+		}
+
 		c.HTML(http.StatusOK, "home.html", gin.H{
-			"title":  "Main website",
-			"images": imagesWithSrcSets,
+			"title":       title,
+			"images":      imagesWithSrcSets,
+			"placeFilter": &placeFilter,
 		})
 	}
 }
 
+// Opens the capture time tool for the image's batch, with the image as the
+// reference
+func getTimeShiftUrl(image *Image) string {
+	if image.DateUnknown {
+		return ""
+	}
+
+	query := url.Values{}
+	query.Set("importBatchId", image.ImportBatchId)
+	query.Set("referenceImageId", image.ImageId)
+	query.Set("referenceTime", image.DateTimeLocal.Format(LOCAL_TIME_FORMAT))
+
+	return "/admin/time-shift?" + query.Encode()
+}
+
+type PlaceLink struct {
+	Name string
+	Url  string
+}
+
+func getPlaceFilterUrl(filter PlaceFilter) string {
+	query := url.Values{}
+	if filter.Country != "" {
+		query.Set("country", filter.Country)
+	}
+	if filter.Region != "" {
+		query.Set("region", filter.Region)
+	}
+	if filter.City != "" {
+		query.Set("city", filter.City)
+	}
+
+	return "/?" + query.Encode()
+}
+
+// Links each name of the place, from the most specific, to the images taken
+// there
+func getPlaceLinks(place Place) []PlaceLink {
+	links := []PlaceLink{}
+
+	if place.City != "" {
+		links = append(links, PlaceLink{Name: place.City, Url: getPlaceFilterUrl(place.Filter())})
+	}
+	if place.Region != "" {
+		filter := PlaceFilter{Country: place.CountryCode, Region: place.Region}
+		links = append(links, PlaceLink{Name: place.Region, Url: getPlaceFilterUrl(filter)})
+	}
+	if place.CountryCode != "" {
+		filter := PlaceFilter{Country: place.CountryCode}
+		links = append(links, PlaceLink{Name: place.Country, Url: getPlaceFilterUrl(filter)})
+	}
+
+	return links
+}
+
 func ImageGetHandler(r *Resources) gin.HandlerFunc {
 	type UriParams struct {
 		ImageId string `uri:"imageId" binding:"required"`
@@ -66,6 +149,16 @@ func ImageGetHandler(r *Resources) gin.HandlerFunc {
 			Width      uint64
 			Height     uint64
 			IsOriginal bool
+			IsRaw      bool
+			Format     string
+		}
+
+		if !isAdmin {
+			visible, err := r.Db.IsImageVisible(params.ImageId)
+			if err != nil || !visible {
+				c.Status(404)
+				return
+			}
 		}
 
 		r.Db.ListImageFiles(&files, params.ImageId)
@@ -78,25 +171,55 @@ func ImageGetHandler(r *Resources) gin.HandlerFunc {
 
 		renderedFiles := []ImageFile{}
 		for _, file := range files {
-			if strings.HasSuffix(file.StoragePath, ".webp") || file.IsOriginal {
-				renderedFiles = append(renderedFiles, ImageFile{
-					ImageId:    file.ImageId,
-					Width:      file.Width,
-					Height:     file.Height,
-					IsOriginal: file.IsOriginal,
-					PublicURL:  PublicImageURL(r.Config.S3BaseUrl, file.StoragePath),
-				})
-			}
+			format := GetFileFormat(&file)
+
+			renderedFiles = append(renderedFiles, ImageFile{
+				ImageId:    file.ImageId,
+				Width:      file.Width,
+				Height:     file.Height,
+				IsOriginal: file.IsOriginal,
+				IsRaw:      IsRawFormat(format),
+				Format:     format,
+				PublicURL:  PublicImageURL(r.Config.S3BaseUrl, file.StoragePath),
+			})
+		}
+
+		fallbackFile := FindLargestFallbackImage(files)
+
+		placeLinks := []PlaceLink{}
+		if isLocationPublished(r, &image) {
+			placeLinks = getPlaceLinks(image.Place())
+		}
+
+		// Every tag read from the original is only shown to admins
+		metadataTags := []MetadataTag{}
+		if isAdmin {
+			var metadata ImageMetadata
+			r.Db.GetImageMetadata(&metadata, params.ImageId)
+			metadataTags = metadata.List()
 		}
 
 		c.HTML(http.StatusOK, "image.html", gin.H{
 			"files":        renderedFiles,
 			"smallestFile": renderedFiles[0],
-			"srcSet":       ComputeImageSrcSet(r.Config.S3BaseUrl, files),
+			"fallbackUrl":  PublicImageURL(r.Config.S3BaseUrl, fallbackFile.StoragePath),
+			"srcSet":       ComputeFallbackSrcSet(r.Config.S3BaseUrl, files),
+			"sources":      ComputePictureSources(r.Config.S3BaseUrl, files),
+			"videoUrl":     getVideoUrl(r, files),
 			"isAdmin":      isAdmin,
-			"date":         image.DateTimeOriginal.Format("Monday, January _2, 2006"),
+			"visibility":   image.Visibility,
+			"isVideo":      image.MediaType == MEDIA_TYPE_VIDEO,
+			"visibilities": []string{VISIBILITY_PUBLIC, VISIBILITY_ALBUM, VISIBILITY_HIDDEN},
+			"date":         FormatCaptureDate(image.DateTimeLocal, image.DateUnknown),
 			"camera":       GetImageCameraDescription(&image),
 			"meta":         GetImageMetaDescription(&image),
+			"metadataTags": metadataTags,
+			"timeShiftUrl": getTimeShiftUrl(&image),
+			"placeLinks":   placeLinks,
+			"title":        image.Title,
+			"caption":      image.Caption,
+			"keywords":     image.KeywordList(),
+			"rating":       GetRatingDescription(image.Rating, image.Label),
 		})
 	}
 }
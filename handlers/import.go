@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"path/filepath"
@@ -16,7 +19,7 @@ import (
 )
 
 func ImportSelectionPage(r *Resources, c *gin.Context, formError error) {
-	files, err := r.Storage.ListFiles(r.Config.S3UploadFolder)
+	files, err := r.Storage.ListFiles(c.Request.Context(), r.Config.S3UploadFolder)
 	if err != nil {
 		c.String(500, "Error listing files: %s\n", err)
 		return
@@ -30,11 +33,12 @@ func ImportSelectionPage(r *Resources, c *gin.Context, formError error) {
 	}
 
 	c.HTML(http.StatusOK, "import.html", gin.H{
-		"files":     files,
-		"albums":    albums,
-		"hasAlbums": len(albums) > 0,
-		"hasError":  formError != nil,
-		"error":     fmt.Sprintf("Error: %s", formError),
+		"files":           files,
+		"albums":          albums,
+		"hasAlbums":       len(albums) > 0,
+		"sizeProfileSets": r.Config.SizeProfiles.Names(),
+		"hasError":        formError != nil,
+		"error":           fmt.Sprintf("Error: %s", formError),
 	})
 }
 
@@ -49,6 +53,7 @@ func getFormAlbumId(r *Resources, c *gin.Context) (string, error) {
 	albumSelection, _ := c.GetPostForm("albumSelection")
 	newAlbumName, _ := c.GetPostForm("newAlbumName")
 	existingAlbumId, _ := c.GetPostForm("existingAlbumId")
+	sizeProfileSet, _ := c.GetPostForm("sizeProfileSet")
 
 	var album Album
 	albumId := ""
@@ -67,14 +72,20 @@ func getFormAlbumId(r *Resources, c *gin.Context) (string, error) {
 				return "", fmt.Errorf("Name cannot be empty")
 			}
 
+			// An album with an unknown set would fail every later import into it
+			if _, err := r.Config.SizeProfiles.Get(sizeProfileSet); err != nil {
+				return "", err
+			}
+
 			albumId = Uuid()
 			r.Db.AddAlbum(Album{
-				AlbumId:      albumId,
-				Name:         newAlbumName,
-				Slug:         slug.Make(newAlbumName),
-				Description:  "",
-				CoverImageId: "",
-				IsPublished:  true,
+				AlbumId:        albumId,
+				Name:           newAlbumName,
+				Slug:           slug.Make(newAlbumName),
+				Description:    "",
+				CoverImageId:   "",
+				IsPublished:    true,
+				SizeProfileSet: sizeProfileSet,
 			})
 		} else {
 			return "", fmt.Errorf("Unexpected type %s", albumSelection)
@@ -84,110 +95,291 @@ func getFormAlbumId(r *Resources, c *gin.Context) (string, error) {
 	return albumId, nil
 }
 
-func getImportSizes() []OutputImageSize {
-	return []OutputImageSize{
-		{
-			LongEdge:    200,
-			Quality:     80,
-			Suffix:      "_thumb",
-			Format:      "webp",
-			Extension:   ".webp",
-			ContentType: "image/webp",
-		},
-		{
-			LongEdge:    600,
-			Quality:     80,
-			Suffix:      "_small",
-			Format:      "webp",
-			Extension:   ".webp",
-			ContentType: "image/webp",
-		},
-		{
-			LongEdge:    1080,
-			Quality:     80,
-			Suffix:      "_medium",
-			Format:      "webp",
-			Extension:   ".webp",
-			ContentType: "image/webp",
-		},
-		{
-			LongEdge:    1920,
-			Quality:     65,
-			Suffix:      "_large",
-			Format:      "webp",
-			Extension:   ".webp",
-			ContentType: "image/webp",
-		},
-		{
-			LongEdge:    2560,
-			Quality:     50,
-			Suffix:      "_xlarge",
-			Format:      "webp",
-			Extension:   ".webp",
-			ContentType: "image/webp",
-		},
-	}
-}
-
-func performImport(r *Resources, names []string, albumId string) string {
+// Resolves the sizes to generate for an import, preferring an explicitly
+// requested profile set, then the set chosen for the album, then the default
+func getImportSizes(r *Resources, sizeProfileSet string, albumId string) ([]OutputImageSize, error) {
+	var album Album
+	if albumId != "" {
+		r.Db.GetAlbum(&album, albumId)
+	}
+
+	if sizeProfileSet == "" {
+		sizeProfileSet = album.SizeProfileSet
+	}
+
+	sizes, err := r.Config.SizeProfiles.Get(sizeProfileSet)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyWatermarkSetting(r, sizes, album.WatermarkEnabled), nil
+}
+
+// Only watermarks sizes which ask for it when the album enables watermarks
+// and one is configured. Applied before fingerprinting, so toggling it on an
+// album marks those sizes as changed.
+func applyWatermarkSetting(r *Resources, sizes []OutputImageSize, enabled bool) []OutputImageSize {
+	for i := range sizes {
+		sizes[i].Watermark = sizes[i].Watermark && enabled && r.Config.Watermark != nil
+	}
+
+	return sizes
+}
+
+// Resolves the sizes to regenerate for an existing image, using the set of
+// the first album it belongs to which has one chosen
+func getImageSizes(r *Resources, sizeProfileSet string, imageId string) ([]OutputImageSize, error) {
+	albums, err := r.Db.ListImageAlbums(imageId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Watermarked if any of its albums enables it
+	watermark := false
+
+	for _, album := range albums {
+		if sizeProfileSet == "" && album.SizeProfileSet != "" {
+			sizeProfileSet = album.SizeProfileSet
+		}
+		watermark = watermark || album.WatermarkEnabled
+	}
+
+	sizes, err := r.Config.SizeProfiles.Get(sizeProfileSet)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyWatermarkSetting(r, sizes, watermark), nil
+}
+
+func getAlbumPrivacyPolicy(r *Resources, album *Album) string {
+	if album.PrivacyPolicy == "" {
+		return r.Config.DefaultPrivacyPolicy
+	}
+	return album.PrivacyPolicy
+}
+
+// Uses the strictest policy of the albums an image belongs to
+func getImagePrivacyPolicy(r *Resources, imageId string) (string, error) {
+	albums, err := r.Db.ListImageAlbums(imageId)
+	if err != nil {
+		return "", err
+	}
+
+	policy := r.Config.DefaultPrivacyPolicy
+	for i := range albums {
+		policy = StricterPrivacyPolicy(policy, getAlbumPrivacyPolicy(r, &albums[i]))
+	}
+
+	return policy, nil
+}
+
+// Filters out the sizes which already have a derivative generated with the
+// same settings
+func getChangedSizes(r *Resources, imageId string, sizes []OutputImageSize) []OutputImageSize {
+	var files []File
+	r.Db.ListImageFiles(&files, imageId)
+
+	existing := map[string]bool{}
+	for _, file := range files {
+		if !file.IsOriginal {
+			existing[file.SizeName+"|"+file.SizeHash] = true
+		}
+	}
+
+	changed := []OutputImageSize{}
+	for _, size := range sizes {
+		if !existing[size.Name+"|"+size.Fingerprint()] {
+			changed = append(changed, size)
+		}
+	}
+
+	return changed
+}
+
+// Whether the image has derivatives which aren't in the list to keep
+func hasStaleDerivatives(r *Resources, imageId string, keepFiles []string) bool {
+	var files []File
+	r.Db.ListImageFiles(&files, imageId)
+
+	keep := map[string]bool{}
+	for _, filename := range keepFiles {
+		keep[filename] = true
+	}
+
+	for _, file := range files {
+		if file.IsSizedDerivative() && !keep[file.Filename] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tracks a task in its batch, so its status can be followed, and queues it.
+// Tasks which can't be queued are marked failed, so they can be retried.
+func enqueueTask(ctx context.Context, r *Resources, task *ImageImport, filename string) error {
+	if err := r.Db.AddImageImport(task, filename); err != nil {
+		return fmt.Errorf("tracking %s: %s", filename, err)
+	}
+
+	if err := r.Queue.AddTask(ctx, *task); err != nil {
+		r.Db.UpdateImportTaskState(task.ImportBatchId, task.ImageId, TASK_FAILED, err.Error(), 0)
+		return fmt.Errorf("queueing %s: %s", filename, err)
+	}
+
+	return nil
+}
+
+// Binds the JSON body of a request which may have none, responding with an
+// error when it can't be parsed
+func bindOptionalJSON(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindJSON(obj)
+	if err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unrecognized payload: %s", err)})
+		return false
+	}
+	return true
+}
+
+func performImport(ctx context.Context, r *Resources, names []string, albumId string, sizeProfileSet string) (string, error) {
 	importBatchId := Uuid()
 	images := []ImageImport{}
 
+	sizes, err := getImportSizes(r, sizeProfileSet, albumId)
+	if err != nil {
+		return "", err
+	}
+
+	var album Album
+	if albumId != "" {
+		r.Db.GetAlbum(&album, albumId)
+	}
+	privacyPolicy := getAlbumPrivacyPolicy(r, &album)
+
+	uploaded, err := r.Storage.ListFiles(ctx, r.Config.S3UploadFolder)
+	if err != nil {
+		return "", err
+	}
+	for i := range uploaded {
+		uploaded[i] = strings.TrimPrefix(uploaded[i], r.Config.S3UploadFolder+"/")
+	}
+
+	// Motion clips are paired first, so they aren't given a sidecar
+	names, pairedVideos := PairLivePhotos(names)
+	names, sidecars := PairSidecars(names, uploaded)
+
 	for _, value := range names {
+		pairedVideoKey := ""
+		if pairedVideos[value] != "" {
+			pairedVideoKey = r.Config.S3UploadFolder + "/" + pairedVideos[value]
+		}
+
+		sidecarKey := ""
+		if sidecars[value] != "" {
+			sidecarKey = r.Config.S3UploadFolder + "/" + sidecars[value]
+		}
+
 		images = append(images, ImageImport{
 			InitialImport:   true,
 			ImageId:         Uuid(),
 			ImportBatchId:   importBatchId,
 			AlbumId:         albumId,
 			OriginalFileKey: r.Config.S3UploadFolder + "/" + value,
-			Sizes:           getImportSizes(),
+			Sizes:           sizes,
+			PairedVideoKey:  pairedVideoKey,
+			SidecarKey:      sidecarKey,
+			PrivacyPolicy:   privacyPolicy,
 		})
 	}
 
-	for _, image := range images {
-		r.Db.AddImageImport(image.ImportBatchId, image.ImageId, filepath.Base(image.OriginalFileKey))
-	}
-
 	for i := range images {
-		r.Queue.AddTask(images[i])
+		if err := enqueueTask(ctx, r, &images[i], filepath.Base(images[i].OriginalFileKey)); err != nil {
+			return "", err
+		}
 	}
 
-	return importBatchId
+	return importBatchId, nil
 }
 
 type ImportStatus struct {
-	IsProcessed bool   `json:"isProcessed"`
-	Filename    string `json:"filename"`
-	URL         string `json:"url"`
+	IsProcessed bool     `json:"isProcessed"`
+	Filename    string   `json:"filename"`
+	URL         string   `json:"url"`
+	State       string   `json:"state"`
+	Error       string   `json:"error,omitempty"`
+	Attempts    int      `json:"attempts"`
+	Changes     []string `json:"changes,omitempty"` // Fields changed by a metadata refresh, or set from XMP on import
 }
 
-func getImportStatuses(r *Resources, importBatchId string) (bool, []ImportStatus) {
+// Returns whether every task in the batch has finished, successfully or not,
+// and the number which failed
+func getImportStatuses(r *Resources, importBatchId string) (bool, int, []ImportStatus) {
 	var images []ImageImportTask
 	r.Db.GetImagesInImportBatch(&images, importBatchId)
 
 	statuses := make([]ImportStatus, len(images))
-	allProcessed := true
+	allFinished := true
+	failed := 0
 
 	for i, img := range images {
 		statuses[i].IsProcessed = img.IsProcessed
 		statuses[i].Filename = img.Filename
+		statuses[i].State = img.State
+		statuses[i].Error = img.Error
+		statuses[i].Attempts = img.Attempts
+		if img.Changes != "" {
+			statuses[i].Changes = strings.Split(img.Changes, ",")
+		}
 
 		if img.IsProcessed {
 			var file File
 			r.Db.GetFile(&file, img.ImageId, 100)
 
 			statuses[i].URL = PublicImageURL(r.Config.S3BaseUrl, file.StoragePath)
-		} else {
-			allProcessed = false
+		}
+		if img.State == TASK_FAILED {
+			failed++
+		}
+		if !img.IsFinished() {
+			allFinished = false
 		}
 	}
 
-	return allProcessed, statuses
+	return allFinished, failed, statuses
+}
+
+// Queues the failed tasks of a batch again, with their attempts reset
+func retryFailedImports(ctx context.Context, r *Resources, importBatchId string) (int, error) {
+	tasks, err := r.Db.ListFailedImportTasks(importBatchId)
+	if err != nil {
+		return 0, err
+	}
+
+	retried := 0
+	for _, task := range tasks {
+		var image ImageImport
+		if err := json.Unmarshal([]byte(task.Payload), &image); err != nil {
+			log.Printf("Unable to retry image %s: %s\n", task.ImageId, err)
+			continue
+		}
+
+		image.Attempt = 0
+		if err := r.Queue.AddTask(ctx, image); err != nil {
+			return retried, err
+		}
+
+		r.Db.UpdateImportTaskState(task.ImportBatchId, task.ImageId, TASK_QUEUED, task.Error, 0)
+		retried++
+	}
+
+	return retried, nil
 }
 
 func AdminImportPostHandler(r *Resources) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		names, _ := c.GetPostFormArray("names")
+		sizeProfileSet, _ := c.GetPostForm("sizeProfileSet")
 
 		albumId, err := getFormAlbumId(r, c)
 		if err != nil {
@@ -195,7 +387,11 @@ func AdminImportPostHandler(r *Resources) gin.HandlerFunc {
 			return
 		}
 
-		importBatchId := performImport(r, names, albumId)
+		importBatchId, err := performImport(c.Request.Context(), r, names, albumId, sizeProfileSet)
+		if err != nil {
+			ImportSelectionPage(r, c, err)
+			return
+		}
 
 		c.HTML(200, "import_complete.html", gin.H{
 			"importBatchId": importBatchId,
@@ -217,11 +413,43 @@ func AdminImportStatusGetHandler(r *Resources) gin.HandlerFunc {
 			return
 		}
 
-		allProcessed, statuses := getImportStatuses(r, params.BatchId)
+		allFinished, failed, statuses := getImportStatuses(r, params.BatchId)
 
 		c.HTML(http.StatusOK, "import_status_table.html", gin.H{
-			"poll":          !allProcessed || len(statuses) == 0,
+			"poll":          !allFinished || len(statuses) == 0,
 			"statuses":      statuses,
+			"failed":        failed,
+			"importBatchId": params.BatchId,
+		})
+	}
+}
+
+func AdminImportRetryPostHandler(r *Resources) gin.HandlerFunc {
+	type UriParams struct {
+		BatchId string `uri:"batchId" binding:"required"`
+	}
+
+	return func(c *gin.Context) {
+		var params UriParams
+
+		err := c.BindUri(&params)
+		if err != nil {
+			c.Status(404)
+			return
+		}
+
+		_, err = retryFailedImports(c.Request.Context(), r, params.BatchId)
+		if err != nil {
+			log.Printf("Error retrying failed imports: %s\n", err)
+		}
+
+		// Render the table, which polls again now the tasks are queued
+		allFinished, failed, statuses := getImportStatuses(r, params.BatchId)
+
+		c.HTML(http.StatusOK, "import_status_table.html", gin.H{
+			"poll":          !allFinished,
+			"statuses":      statuses,
+			"failed":        failed,
 			"importBatchId": params.BatchId,
 		})
 	}
@@ -231,6 +459,7 @@ type ImportApiRequest struct {
 	Names           []string `json:"names"`
 	NewAlbumName    string   `json:"newAlbumName,omitempty"`
 	ExistingAlbumId string   `json:"existingAlbumId,omitempty"`
+	SizeProfileSet  string   `json:"sizeProfileSet,omitempty"`
 }
 
 func ImportApiPostHandler(r *Resources) gin.HandlerFunc {
@@ -245,16 +474,22 @@ func ImportApiPostHandler(r *Resources) gin.HandlerFunc {
 
 		albumId := ""
 
+		if _, err := r.Config.SizeProfiles.Get(importRequest.SizeProfileSet); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		if strings.Trim(importRequest.NewAlbumName, " ") != "" {
 			albumId = Uuid()
 
 			r.Db.AddAlbum(Album{
-				AlbumId:      albumId,
-				Name:         importRequest.NewAlbumName,
-				Slug:         slug.Make(importRequest.NewAlbumName),
-				Description:  "",
-				CoverImageId: "",
-				IsPublished:  true,
+				AlbumId:        albumId,
+				Name:           importRequest.NewAlbumName,
+				Slug:           slug.Make(importRequest.NewAlbumName),
+				Description:    "",
+				CoverImageId:   "",
+				IsPublished:    true,
+				SizeProfileSet: importRequest.SizeProfileSet,
 			})
 		}
 
@@ -272,7 +507,11 @@ func ImportApiPostHandler(r *Resources) gin.HandlerFunc {
 			albumId = importRequest.ExistingAlbumId
 		}
 
-		batchId := performImport(r, importRequest.Names, albumId)
+		batchId, err := performImport(c.Request.Context(), r, importRequest.Names, albumId, importRequest.SizeProfileSet)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
 		c.JSON(200, gin.H{
 			"importBatchId": batchId,
@@ -294,19 +533,186 @@ func ImportStateApiGetHandler(r *Resources) gin.HandlerFunc {
 			return
 		}
 
-		allProcessed, statuses := getImportStatuses(r, params.BatchId)
+		allFinished, failed, statuses := getImportStatuses(r, params.BatchId)
 
 		c.JSON(http.StatusOK, gin.H{
 			"batchId":      params.BatchId,
-			"allProcessed": allProcessed,
+			"allProcessed": allFinished,
+			"failed":       failed,
 			"statuses":     statuses,
 		})
 	}
 }
 
+func ImportRetryApiPostHandler(r *Resources) gin.HandlerFunc {
+	type UriParams struct {
+		BatchId string `uri:"batchId" binding:"required"`
+	}
+
+	return func(c *gin.Context) {
+		var params UriParams
+
+		err := c.BindUri(&params)
+		if err != nil {
+			c.Status(404)
+			return
+		}
+
+		retried, err := retryFailedImports(c.Request.Context(), r, params.BatchId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("Error retrying failed imports: %s", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"batchId": params.BatchId,
+			"retried": retried,
+		})
+	}
+}
+
+// Builds the task re-rendering an original file, and whether anything needs
+// to be regenerated. When onlyChanged is set, only sizes which are new or whose
+// settings changed are included.
+func newResizeTask(r *Resources, file File, sizeProfileSet string, onlyChanged bool, importBatchId string) (ImageImport, bool, error) {
+	sizes, err := getImageSizes(r, sizeProfileSet, file.ImageId)
+	if err != nil {
+		return ImageImport{}, false, err
+	}
+
+	keepFiles := []string{}
+	for _, size := range sizes {
+		keepFiles = append(keepFiles, size.Filename(file.ImageId))
+	}
+
+	if onlyChanged {
+		sizes = getChangedSizes(r, file.ImageId, sizes)
+	}
+
+	// Backfill placeholders for images imported before they existed, and
+	// refresh them whenever everything is regenerated
+	var image Image
+	r.Db.GetImage(&image, file.ImageId)
+	generatePlaceholder := image.Placeholder == "" || !onlyChanged
+
+	needed := len(sizes) > 0 || generatePlaceholder || hasStaleDerivatives(r, file.ImageId, keepFiles)
+
+	privacyPolicy, err := getImagePrivacyPolicy(r, file.ImageId)
+	if err != nil {
+		return ImageImport{}, false, err
+	}
+
+	var edit *ImageEdit
+	var imageEdit ImageEdit
+	r.Db.GetImageEdit(&imageEdit, file.ImageId)
+	if imageEdit.ImageId != "" {
+		edit = &imageEdit
+	}
+
+	task := ImageImport{
+		InitialImport:       false,
+		ImageId:             file.ImageId,
+		ImportBatchId:       importBatchId,
+		AlbumId:             "",
+		OriginalFileKey:     file.StoragePath,
+		Sizes:               sizes,
+		GeneratePlaceholder: generatePlaceholder,
+		PrivacyPolicy:       privacyPolicy,
+		Edit:                edit,
+		KeepFiles:           keepFiles,
+	}
+
+	return task, needed, nil
+}
+
+// Queues resize tasks for the given original files. When onlyChanged is set,
+// only sizes which are new or whose settings changed are regenerated.
+func queueResizes(ctx context.Context, r *Resources, files []File, sizeProfileSet string, onlyChanged bool) (string, int, error) {
+	importBatchId := Uuid()
+	queued := 0
+
+	for _, file := range files {
+		task, needed, err := newResizeTask(r, file, sizeProfileSet, onlyChanged, importBatchId)
+		if err != nil {
+			return "", 0, err
+		}
+		if !needed {
+			continue
+		}
+
+		// Tracked like imports, so the batch status can be followed
+		if err := enqueueTask(ctx, r, &task, file.Filename); err != nil {
+			return importBatchId, queued, err
+		}
+		queued++
+	}
+
+	return importBatchId, queued, nil
+}
+
+// Returns the privacy policy each of the images is published with
+func getImagePrivacyPolicies(r *Resources, imageIds []string) (map[string]string, error) {
+	policies := map[string]string{}
+	for _, imageId := range imageIds {
+		policy, err := getImagePrivacyPolicy(r, imageId)
+		if err != nil {
+			return nil, err
+		}
+		policies[imageId] = policy
+	}
+
+	return policies, nil
+}
+
+// Re-renders the images whose policy became stricter than the one they were
+// published with, so their stored originals are scrubbed and their location
+// is removed
+func queuePrivacyRenders(ctx context.Context, r *Resources, previousPolicies map[string]string) (int, error) {
+	files := []File{}
+	err := r.Db.ListOriginalImageFiles(&files)
+	if err != nil {
+		return 0, err
+	}
+
+	importBatchId := Uuid()
+	queued := 0
+
+	for _, file := range files {
+		previous, ok := previousPolicies[file.ImageId]
+		if !ok {
+			continue
+		}
+
+		policy, err := getImagePrivacyPolicy(r, file.ImageId)
+		if err != nil {
+			return queued, err
+		}
+		if policy == previous || StricterPrivacyPolicy(previous, policy) != policy {
+			continue
+		}
+
+		// The policy changed, so the task is needed even when no size did
+		task, _, err := newResizeTask(r, file, "", true, importBatchId)
+		if err != nil {
+			return queued, err
+		}
+
+		if err := enqueueTask(ctx, r, &task, file.Filename); err != nil {
+			return queued, err
+		}
+		queued++
+	}
+
+	return queued, nil
+}
+
 func SingleResizeApiPostHandler(r *Resources) gin.HandlerFunc {
 	type ResizeRequest struct {
-		ImageIds []string `json:"imageIds"`
+		ImageIds       []string `json:"imageIds"`
+		SizeProfileSet string   `json:"sizeProfileSet,omitempty"`
+		OnlyChanged    bool     `json:"onlyChanged,omitempty"`
 	}
 
 	return func(c *gin.Context) {
@@ -320,8 +726,6 @@ func SingleResizeApiPostHandler(r *Resources) gin.HandlerFunc {
 
 		log.Printf("Resizing %d images\n", len(resizeRequest.ImageIds))
 
-		importBatchId := Uuid()
-
 		allFiles := []File{}
 		err = r.Db.ListOriginalImageFiles(&allFiles)
 		if err != nil {
@@ -340,27 +744,31 @@ func SingleResizeApiPostHandler(r *Resources) gin.HandlerFunc {
 			}
 		}
 
-		for _, file := range files {
-			r.Queue.AddTask(ImageImport{
-				InitialImport:   false,
-				ImageId:         file.ImageId,
-				ImportBatchId:   importBatchId,
-				AlbumId:         "",
-				OriginalFileKey: file.StoragePath,
-				Sizes:           getImportSizes(),
-			})
+		importBatchId, queued, err := queueResizes(c.Request.Context(), r, files, resizeRequest.SizeProfileSet, resizeRequest.OnlyChanged)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"batchId": importBatchId,
+			"queued":  queued,
 		})
 	}
 }
 
 func BulkResizeApiPostHandler(r *Resources) gin.HandlerFunc {
+	type BulkResizeRequest struct {
+		SizeProfileSet string `json:"sizeProfileSet,omitempty"`
+		OnlyChanged    bool   `json:"onlyChanged,omitempty"`
+	}
+
 	return func(c *gin.Context) {
-		importBatchId := Uuid()
-		imports := []ImageImport{}
+		var resizeRequest BulkResizeRequest
+
+		if !bindOptionalJSON(c, &resizeRequest) {
+			return
+		}
 
 		files := []File{}
 		err := r.Db.ListOriginalImageFiles(&files)
@@ -371,23 +779,109 @@ func BulkResizeApiPostHandler(r *Resources) gin.HandlerFunc {
 			return
 		}
 
-		for _, file := range files {
-			imports = append(imports, ImageImport{
-				InitialImport:   false,
-				ImageId:         file.ImageId,
-				ImportBatchId:   importBatchId,
-				AlbumId:         "",
-				OriginalFileKey: file.StoragePath,
-				Sizes:           getImportSizes(),
+		importBatchId, queued, err := queueResizes(c.Request.Context(), r, files, resizeRequest.SizeProfileSet, resizeRequest.OnlyChanged)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"batchId": importBatchId,
+			"queued":  queued,
+		})
+	}
+}
+
+// Queues a metadata refresh of each original file
+func queueMetadataRefreshes(ctx context.Context, r *Resources, files []File) (string, int, error) {
+	importBatchId := Uuid()
+	queued := 0
+
+	for _, file := range files {
+		privacyPolicy, err := getImagePrivacyPolicy(r, file.ImageId)
+		if err != nil {
+			return "", 0, err
+		}
+
+		task := ImageImport{
+			Type:            TASK_TYPE_METADATA,
+			ImageId:         file.ImageId,
+			ImportBatchId:   importBatchId,
+			OriginalFileKey: file.StoragePath,
+			PrivacyPolicy:   privacyPolicy,
+		}
+
+		if err := enqueueTask(ctx, r, &task, file.Filename); err != nil {
+			return importBatchId, queued, err
+		}
+		queued++
+	}
+
+	return importBatchId, queued, nil
+}
+
+// Re-reads the metadata of the given images, those in an album, or every
+// image when neither is set
+func RefreshMetadataApiPostHandler(r *Resources) gin.HandlerFunc {
+	type RefreshRequest struct {
+		ImageIds []string `json:"imageIds,omitempty"`
+		AlbumId  string   `json:"albumId,omitempty"`
+	}
+
+	return func(c *gin.Context) {
+		var refreshRequest RefreshRequest
+
+		if !bindOptionalJSON(c, &refreshRequest) {
+			return
+		}
+
+		allFiles := []File{}
+		err := r.Db.ListOriginalImageFiles(&allFiles)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("Error listing images: %s", err),
 			})
+			return
+		}
+
+		imageIds := refreshRequest.ImageIds
+		if refreshRequest.AlbumId != "" {
+			albumImageIds, err := r.Db.ListAlbumImageIds(refreshRequest.AlbumId)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": fmt.Sprintf("Error listing album images: %s", err),
+				})
+				return
+			}
+			imageIds = append(imageIds, albumImageIds...)
+		}
+
+		files := allFiles
+		if len(refreshRequest.ImageIds) > 0 || refreshRequest.AlbumId != "" {
+			selected := map[string]bool{}
+			for _, id := range imageIds {
+				selected[id] = true
+			}
+
+			files = []File{}
+			for _, file := range allFiles {
+				if selected[file.ImageId] {
+					files = append(files, file)
+				}
+			}
 		}
 
-		for i := range imports {
-			r.Queue.AddTask(imports[i])
+		log.Printf("Refreshing the metadata of %d images\n", len(files))
+
+		importBatchId, queued, err := queueMetadataRefreshes(c.Request.Context(), r, files)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"batchId": importBatchId,
+			"queued":  queued,
 		})
 	}
 }
@@ -409,7 +903,7 @@ func PurgeOrphanImagesApiPostHandler(r *Resources) gin.HandlerFunc {
 			fileKeys[file.StoragePath] = true
 		}
 
-		storage_files, err := r.Storage.ListFiles(r.Config.S3MediaFolder)
+		storage_files, err := r.Storage.ListFiles(c.Request.Context(), r.Config.S3MediaFolder)
 		if err != nil {
 			log.Printf("Error listing files: %s\n", err)
 			return
@@ -421,7 +915,7 @@ func PurgeOrphanImagesApiPostHandler(r *Resources) gin.HandlerFunc {
 				log.Printf("Purging orphaned file: %s\n", stored_file)
 				orphan_keys = append(orphan_keys, stored_file)
 
-				err := r.Storage.DeleteFile(stored_file)
+				err := r.Storage.DeleteFile(c.Request.Context(), stored_file)
 				if err != nil {
 					log.Printf("Error deleting file: %s\n", err)
 				}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	. "github.com/eburlingame/fstop/middleware"
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/resources"
+	. "github.com/eburlingame/fstop/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The most images returned for one view of the map
+const MAP_MAX_IMAGES = 2000
+
+// The minimum width of the thumbnails shown on the map
+const MAP_THUMBNAIL_WIDTH = 200
+
+func isInAnyGeofence(r *Resources, latitude float64, longitude float64) bool {
+	return IsInAnyGeofence(r.Config.Geofences, latitude, longitude)
+}
+
+// Whether the location of an image, and the place named from it, may be shown
+func isLocationPublished(r *Resources, image *Image) bool {
+	policy, err := getImagePrivacyPolicy(r, image.ImageId)
+	if err != nil {
+		log.Printf("Error reading image privacy policy: %s\n", err)
+		return false
+	}
+	if policy == PRIVACY_STRIP_GPS || policy == PRIVACY_STRIP_ALL {
+		return false
+	}
+
+	latitude, longitude, ok := image.Coordinates()
+	return !ok || !isInAnyGeofence(r, latitude, longitude)
+}
+
+// Finds the album of a map, which only admins can see unpublished
+func getMapAlbum(r *Resources, c *gin.Context, albumSlug string) (*Album, bool) {
+	var album Album
+	r.Db.GetAlbumBySlug(&album, albumSlug)
+
+	if album.AlbumId == "" || (!album.IsPublished && !IsAdminLoggedIn(r, c)) {
+		return nil, false
+	}
+
+	return &album, true
+}
+
+func renderMapPage(r *Resources, c *gin.Context, title string, albumSlug string) {
+	c.HTML(http.StatusOK, "map.html", gin.H{
+		"title":             title,
+		"albumSlug":         albumSlug,
+		"tileUrl":           r.Config.MapTileUrl,
+		"tileAttribution":   r.Config.MapTileAttribution,
+		"maxImages":         MAP_MAX_IMAGES,
+		"thumbnailMinWidth": MAP_THUMBNAIL_WIDTH,
+	})
+}
+
+func MapGetHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderMapPage(r, c, "Map", "")
+	}
+}
+
+func AlbumMapGetHandler(r *Resources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params AlbumUriParams
+
+		err := c.BindUri(&params)
+		if err != nil {
+			c.Status(404)
+			return
+		}
+
+		album, ok := getMapAlbum(r, c, params.AlbumSlug)
+		if !ok {
+			c.Status(404)
+			return
+		}
+
+		renderMapPage(r, c, album.Name, album.Slug)
+	}
+}
+
+// Lists the images within a bounding box, from the stream or an album. Only
+// locations which are published are included.
+func MapImagesApiGetHandler(r *Resources) gin.HandlerFunc {
+	type MapImagesQuery struct {
+		BBox  string `form:"bbox"`
+		Album string `form:"album"`
+	}
+
+	return func(c *gin.Context) {
+		var params MapImagesQuery
+		c.ShouldBindQuery(&params)
+
+		bounds, err := ParseMapBounds(params.BBox)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		mapQuery := MapQuery{
+			Bounds:               bounds,
+			Limit:                MAP_MAX_IMAGES,
+			DefaultPrivacyPolicy: r.Config.DefaultPrivacyPolicy,
+		}
+
+		if params.Album != "" {
+			if _, ok := getMapAlbum(r, c, params.Album); !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Album %s not found", params.Album)})
+				return
+			}
+
+			mapQuery.AlbumSlug = params.Album
+			mapQuery.IncludeHidden = IsAdminLoggedIn(r, c)
+		}
+
+		images, err := r.Db.ListMapImages(mapQuery)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("Error listing images: %s", err),
+			})
+			return
+		}
+
+		mapImages := []MapImage{}
+		for _, image := range images {
+			thumbnail := FindSizedImage(image.Files, MAP_THUMBNAIL_WIDTH)
+			if thumbnail == nil || isInAnyGeofence(r, *image.Latitude, *image.Longitude) {
+				continue
+			}
+
+			mapImages = append(mapImages, MapImage{
+				ImageId:      image.ImageId,
+				Latitude:     *image.Latitude,
+				Longitude:    *image.Longitude,
+				ThumbnailUrl: PublicImageURL(r.Config.S3BaseUrl, thumbnail.StoragePath),
+				Url:          "/image/" + image.ImageId,
+				Title:        FormatCaptureDate(image.DateTimeLocal, image.DateUnknown),
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"images":    mapImages,
+			"truncated": len(images) == MAP_MAX_IMAGES,
+		})
+	}
+}
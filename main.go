@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	. "github.com/eburlingame/fstop/handlers"
 	. "github.com/eburlingame/fstop/middleware"
+	. "github.com/eburlingame/fstop/models"
 
 	. "github.com/eburlingame/fstop/process"
 	. "github.com/eburlingame/fstop/resources"
@@ -16,7 +25,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func setupRouter() *gin.Engine {
+func setupResources() *Resources {
 	config := GetConfig()
 
 	storage, err := InitS3Storage(config)
@@ -34,19 +43,33 @@ func setupRouter() *gin.Engine {
 		log.Fatal(err)
 	}
 
-	r := &Resources{
-		Config:  config,
-		Storage: storage,
-		Db:      db,
-		Queue:   &queue,
+	geocoder, err := LoadGeocoder(config.GeonamesCitiesFile)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	go InitWorkers(r)
+	ConfigureProcessing(config)
+
+	return &Resources{
+		Config:   config,
+		Storage:  storage,
+		Db:       db,
+		Queue:    &queue,
+		Geocoder: geocoder,
+	}
+}
 
+func setupLogging() {
 	gin.DisableConsoleColor()
 	f, _ := os.OpenFile("fstop.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	gin.DefaultWriter = io.MultiWriter(f, os.Stdout)
 	log.SetOutput(gin.DefaultWriter)
+}
+
+func setupRouter(r *Resources) *gin.Engine {
+	config := r.Config
+
+	setupLogging()
 
 	log.Println("Starting server")
 	router := gin.Default()
@@ -56,10 +79,6 @@ func setupRouter() *gin.Engine {
 
 	router.LoadHTMLGlob("./templates/*")
 
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	router.Static("/static/", "./static/")
 	router.StaticFile("/favicon.ico", "./static/favicon.ico")
 	router.StaticFile("/robots.txt", "./static/robots.txt")
@@ -69,6 +88,10 @@ func setupRouter() *gin.Engine {
 
 	router.GET("/albums", EnsureLoggedIn(r), AlbumsListGetHandler(r))
 	router.GET("/album/:albumSlug", EnsureLoggedIn(r), SingleAlbumGetHandler(r))
+	router.GET("/album/:albumSlug/map", EnsureLoggedIn(r), AlbumMapGetHandler(r))
+
+	router.GET("/map", EnsureLoggedIn(r), MapGetHandler(r))
+	router.GET("/api/v1/map/images", EnsureLoggedIn(r), MapImagesApiGetHandler(r))
 
 	router.GET("/login", EnsureNotLoggedIn(r), ViewerLoginGetHandler(r))
 	router.POST("/login", EnsureNotLoggedIn(r), ViewerLoginPostHandler(r))
@@ -84,6 +107,11 @@ func setupRouter() *gin.Engine {
 	router.POST("/admin/albums/:albumSlug", EnsureAdminLoggedIn(r), AdminEditAlbumPostHandler(r))
 	router.POST("/admin/albums/:albumSlug/delete", EnsureAdminLoggedIn(r), AdminDeleteAlbumPostHandler(r))
 	router.POST("/admin/images/:imageId/delete", EnsureAdminLoggedIn(r), AdminDeleteImagePostHandler(r))
+	router.POST("/admin/images/:imageId/visibility", EnsureAdminLoggedIn(r), AdminImageVisibilityPostHandler(r))
+	router.GET("/admin/images/:imageId/edit", EnsureAdminLoggedIn(r), AdminImageEditGetHandler(r))
+	router.GET("/admin/images/:imageId/edit/preview", EnsureAdminLoggedIn(r), AdminImageEditPreviewGetHandler(r))
+	router.POST("/admin/images/:imageId/edit", EnsureAdminLoggedIn(r), AdminImageEditPostHandler(r))
+	router.POST("/admin/images/:imageId/edit/reset", EnsureAdminLoggedIn(r), AdminImageEditResetPostHandler(r))
 	router.DELETE("/admin/albums/:albumSlug/:imageId", EnsureAdminLoggedIn(r), AdminRemoveImageFromAlbumPostHandler(r))
 
 	router.GET("/admin/login", EnsureNotLoggedIn(r), AdminLoginGetHandler(r))
@@ -95,18 +123,132 @@ func setupRouter() *gin.Engine {
 	router.GET("/admin/import", EnsureAdminLoggedIn(r), AdminImportGet(r))
 	router.POST("/admin/import", EnsureAdminLoggedIn(r), AdminImportPostHandler(r))
 	router.GET("/admin/import/status/:batchId", EnsureAdminLoggedIn(r), AdminImportStatusGetHandler(r))
+	router.POST("/admin/import/status/:batchId/retry", EnsureAdminLoggedIn(r), AdminImportRetryPostHandler(r))
+
+	router.GET("/admin/time-shift", EnsureAdminLoggedIn(r), AdminTimeShiftGetHandler(r))
+	router.POST("/admin/time-shift", EnsureAdminLoggedIn(r), AdminTimeShiftPostHandler(r))
+	router.POST("/admin/time-shift/preview", EnsureAdminLoggedIn(r), AdminTimeShiftPreviewPostHandler(r))
+	router.GET("/admin/queue", EnsureAdminLoggedIn(r), AdminQueueGetHandler(r))
+	router.POST("/admin/queue/purge", EnsureAdminLoggedIn(r), AdminQueuePurgePostHandler(r))
+	router.POST("/admin/queue/:taskId/requeue", EnsureAdminLoggedIn(r), AdminQueueRequeuePostHandler(r))
+	router.POST("/admin/queue/:taskId/delete", EnsureAdminLoggedIn(r), AdminQueueDeletePostHandler(r))
 
 	router.POST("/api/v1/admin/import", EnsureApiKeyPresent(r), ImportApiPostHandler(r))
 	router.POST("/api/v1/admin/resize/single", EnsureApiKeyPresent(r), SingleResizeApiPostHandler(r))
 	router.POST("/api/v1/admin/resize", EnsureApiKeyPresent(r), BulkResizeApiPostHandler(r))
+	router.POST("/api/v1/admin/metadata/refresh", EnsureApiKeyPresent(r), RefreshMetadataApiPostHandler(r))
+	router.POST("/api/v1/admin/geocode", EnsureApiKeyPresent(r), GeocodeApiPostHandler(r))
+	router.POST("/api/v1/admin/time-shift", EnsureApiKeyPresent(r), TimeShiftApiPostHandler(r))
 	router.POST("/api/v1/admin/purge", EnsureApiKeyPresent(r), PurgeOrphanImagesApiPostHandler(r))
 	router.GET("/api/v1/admin/import/:batchId", EnsureApiKeyPresent(r), ImportStateApiGetHandler(r))
+	router.POST("/api/v1/admin/import/:batchId/retry", EnsureApiKeyPresent(r), ImportRetryApiPostHandler(r))
+	router.GET("/api/v1/admin/queue", EnsureApiKeyPresent(r), QueueApiGetHandler(r))
+	router.GET("/api/v1/admin/metrics", EnsureApiKeyPresent(r), ProcessingMetricsApiGetHandler(r))
+	router.POST("/api/v1/admin/queue/purge", EnsureApiKeyPresent(r), QueuePurgeApiPostHandler(r))
+	router.POST("/api/v1/admin/queue/:taskId/requeue", EnsureApiKeyPresent(r), QueueRequeueApiPostHandler(r))
+	router.DELETE("/api/v1/admin/queue/:taskId", EnsureApiKeyPresent(r), QueueDeleteApiHandler(r))
 
 	return router
 }
 
-func main() {
-	r := setupRouter()
+// Blocks until the process is asked to stop
+func waitForSignal() {
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	<-stop.Done()
+}
+
+func serve(runWorkers bool) {
+	r := setupResources()
+	router := setupRouter(r)
+
+	var workers *WorkerPool
+	if runWorkers {
+		workers = InitWorkers(r, PROCESS_MODE_SERVE)
+	}
+
 	// Listen and serve on 0.0.0.0:8080
-	r.Run(":8080")
+	server := &http.Server{
+		Addr:    ":8080",
+		Handler: router,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	waitForSignal()
+
+	log.Printf("Shutting down, waiting up to %s for requests and tasks to finish\n", r.Config.ShutdownTimeout)
+
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), r.Config.ShutdownTimeout)
+	defer cancelShutdown()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down the server: %s\n", err)
+	}
+
+	if workers != nil {
+		if err := workers.Shutdown(ctx); err != nil {
+			log.Printf("Workers didn't finish before the timeout: %s\n", err)
+		}
+	}
+	ShutdownProcessing()
+
+	log.Println("Shutdown complete")
+}
+
+// Runs only the queue workers, for processing on separate machines sharing
+// the database
+func work() {
+	r := setupResources()
+	setupLogging()
+
+	log.Println("Starting workers")
+	workers := InitWorkers(r, PROCESS_MODE_WORKER)
+
+	waitForSignal()
+
+	log.Printf("Shutting down, waiting up to %s for tasks to finish\n", r.Config.ShutdownTimeout)
+
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), r.Config.ShutdownTimeout)
+	defer cancelShutdown()
+
+	if err := workers.Shutdown(ctx); err != nil {
+		log.Printf("Workers didn't finish before the timeout: %s\n", err)
+	}
+	ShutdownProcessing()
+
+	log.Println("Shutdown complete")
+}
+
+const usage = `Usage:
+  fstop [serve] [--no-workers]  Run the web server, processing images unless --no-workers is given
+  fstop worker                  Only process images from the queue
+`
+
+func main() {
+	command := PROCESS_MODE_SERVE
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+
+	switch command {
+	case PROCESS_MODE_SERVE:
+		noWorkers := flags.Bool("no-workers", false, "Don't process images in the web server")
+		flags.Parse(args)
+		serve(!*noWorkers)
+	case PROCESS_MODE_WORKER:
+		flags.Parse(args)
+		work()
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
 }
@@ -3,12 +3,19 @@ package models
 import "time"
 
 type Album struct {
-	AlbumId      string `gorm:"primarykey"`
-	Slug         string
-	Name         string
-	Description  string
-	CoverImageId string
-	IsPublished  bool
+	AlbumId        string `gorm:"primarykey"`
+	Slug           string
+	Name           string
+	Description    string
+	CoverImageId   string
+	IsPublished    bool
+	SizeProfileSet string // The size profile set used for imports into this album
+
+	// Applies the configured watermark to sizes which have it enabled
+	WatermarkEnabled bool
+
+	// How much metadata is published, empty for the configured default
+	PrivacyPolicy string
 }
 
 type AlbumImage struct {
@@ -19,9 +26,16 @@ type AlbumImage struct {
 // Matches the AlbumWithImage view
 type AlbumWithImage struct {
 	ImageId          string
+	IsPublished      bool
+	Visibility       string
+	MediaType        string
+	Placeholder      string
+	DominantColor    string
 	WidthPixels      uint64
 	HeightPixels     uint64
 	DateTimeOriginal time.Time
+	DateTimeLocal    time.Time
+	DateUnknown      bool
 	CameraModel      string
 	Lens             string
 	ShutterSpeed     string
@@ -0,0 +1,204 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Where the UTC offset of a capture time came from
+const (
+	OFFSET_SOURCE_EXIF    = "exif"    // An offset tag, or a timestamp which includes one
+	OFFSET_SOURCE_GPS     = "gps"     // The difference to the GPS time, which is in UTC
+	OFFSET_SOURCE_DEFAULT = "default" // The configured default timezone
+)
+
+// Offsets between the local and GPS times are rounded to this, as the GPS time
+// is only recorded when the position is fixed
+const GPS_OFFSET_ROUNDING = 15 * time.Minute
+
+// UTC offsets range from -12:00 to +14:00
+const MAX_UTC_OFFSET = 14 * time.Hour
+
+// Parses an EXIF timestamp, returning whether it included a UTC offset
+func parseExifTimestamp(s string) (time.Time, bool, error) {
+	// Exif date with timezone: 2021:12:11 09:17:18-08:00, or Z for GPS times
+	for _, layout := range []string{"2006:01:02 15:04:05Z07:00", "2006:01:02 15:04:05-07:00"} {
+		if value, err := time.Parse(layout, s); err == nil {
+			return value, true, nil
+		}
+	}
+
+	// Exif date format: 2021:12:10 20:29:21
+	value, err := time.Parse("2006:01:02 15:04:05", s)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return value, false, nil
+}
+
+// Parses an offset tag such as +02:00
+func parseUtcOffset(s string) (time.Duration, bool) {
+	if s == "Z" {
+		return 0, true
+	}
+
+	value, err := time.Parse("-07:00", s)
+	if err != nil {
+		return 0, false
+	}
+
+	_, seconds := value.Zone()
+	return time.Duration(seconds) * time.Second, true
+}
+
+func formatUtcOffset(offset time.Duration) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+
+	return fmt.Sprintf("%s%02d:%02d", sign, int(offset.Hours()), int(offset.Minutes())%60)
+}
+
+// Returns the value of the first date tag which can be parsed, and whether
+// it's in UTC rather than local time
+func findCaptureTimestamp(tags map[string]string) (time.Time, bool, bool, bool) {
+	// QuickTime dates are in UTC, except Apple's CreationDate which has an offset
+	isVideo := strings.HasPrefix(tags["MIMEType"], "video/")
+
+	candidates := []struct {
+		tagName string
+		isUTC   bool
+	}{
+		{"DateTimeOriginal", false},
+		{"CreationDate", false},
+		{"MediaCreateDate", isVideo},
+		{"CreateDate", isVideo},
+	}
+
+	for _, candidate := range candidates {
+		value, hasOffset, err := parseExifTimestamp(tags[candidate.tagName])
+		if err == nil {
+			return value, hasOffset, candidate.isUTC, true
+		}
+	}
+
+	return time.Time{}, false, false, false
+}
+
+// Finds the offset of a local capture time from its tags or the GPS time
+func findUtcOffset(local time.Time, tags map[string]string) (time.Duration, string, bool) {
+	for _, tagName := range []string{"OffsetTimeOriginal", "OffsetTime"} {
+		if offset, ok := parseUtcOffset(tags[tagName]); ok {
+			return offset, OFFSET_SOURCE_EXIF, true
+		}
+	}
+
+	gpsTime, _, err := parseExifTimestamp(tags["GPSDateTime"])
+	if err != nil {
+		return 0, "", false
+	}
+
+	offset := local.Sub(gpsTime).Round(GPS_OFFSET_ROUNDING)
+	if offset > MAX_UTC_OFFSET || offset < -MAX_UTC_OFFSET {
+		return 0, "", false
+	}
+
+	return offset, OFFSET_SOURCE_GPS, true
+}
+
+// Sets when the image was captured, both as the wall-clock time where it was
+// taken and as a UTC instant. Times without an offset, GPS time or UTC
+// timestamp are assumed to be in the default location. Images without a
+// readable date are flagged, rather than given one.
+func PopulateImageCaptureTime(img *Image, tags map[string]string, defaultLocation *time.Location) {
+	img.DateTimeOriginal = time.Time{}
+	img.DateTimeLocal = time.Time{}
+	img.UtcOffset = ""
+	img.UtcOffsetSource = ""
+	img.DateUnknown = true
+
+	if defaultLocation == nil {
+		defaultLocation = time.UTC
+	}
+
+	value, hasOffset, isUTC, ok := findCaptureTimestamp(tags)
+	if !ok {
+		return
+	}
+
+	var instant time.Time
+	var source string
+
+	switch {
+	case hasOffset:
+		instant = value
+		source = OFFSET_SOURCE_EXIF
+	case isUTC:
+		instant = value.In(defaultLocation)
+		source = OFFSET_SOURCE_DEFAULT
+	default:
+		if offset, offsetSource, ok := findUtcOffset(value, tags); ok {
+			instant = value.Add(-offset).In(time.FixedZone("", int(offset.Seconds())))
+			source = offsetSource
+		} else {
+			instant = time.Date(value.Year(), value.Month(), value.Day(),
+				value.Hour(), value.Minute(), value.Second(), value.Nanosecond(), defaultLocation)
+			source = OFFSET_SOURCE_DEFAULT
+		}
+	}
+
+	_, offsetSeconds := instant.Zone()
+
+	img.DateTimeOriginal = instant.UTC()
+	img.DateTimeLocal = WallClockTime(instant)
+	img.UtcOffset = formatUtcOffset(time.Duration(offsetSeconds) * time.Second)
+	img.UtcOffsetSource = source
+	img.DateUnknown = false
+}
+
+// The wall-clock time of t, stored in UTC so it's read back unchanged
+func WallClockTime(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// The names of the fields PopulateImageCaptureTime sets
+var captureTimeFields = []string{"DateTimeOriginal", "DateTimeLocal", "UtcOffset", "UtcOffsetSource", "DateUnknown"}
+
+func (img *Image) captureTimeEqual(other *Image) bool {
+	return img.DateTimeOriginal.Equal(other.DateTimeOriginal) &&
+		img.DateTimeLocal.Equal(other.DateTimeLocal) &&
+		img.UtcOffset == other.UtcOffset &&
+		img.UtcOffsetSource == other.UtcOffsetSource &&
+		img.DateUnknown == other.DateUnknown
+}
+
+// Replaces the capture time with that of the source, returning the fields
+// set if it differed
+func (img *Image) CopyCaptureTime(source *Image) []string {
+	if img.captureTimeEqual(source) {
+		return []string{}
+	}
+
+	img.DateTimeOriginal = source.DateTimeOriginal
+	img.DateTimeLocal = source.DateTimeLocal
+	img.UtcOffset = source.UtcOffset
+	img.UtcOffsetSource = source.UtcOffsetSource
+	img.DateUnknown = source.DateUnknown
+
+	return append([]string{}, captureTimeFields...)
+}
+
+const CAPTURE_DATE_FORMAT = "Monday, January _2, 2006"
+
+// The local date the image was captured, for display
+func FormatCaptureDate(local time.Time, unknown bool) string {
+	if unknown {
+		return "Date unknown"
+	}
+	return local.Format(CAPTURE_DATE_FORMAT)
+}
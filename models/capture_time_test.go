@@ -0,0 +1,137 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPopulateImageCaptureTime(t *testing.T) {
+	defaultLocation := time.FixedZone("", -7*60*60)
+
+	tests := []struct {
+		name        string
+		tags        map[string]string
+		utc         string
+		local       string
+		utcOffset   string
+		source      string
+		dateUnknown bool
+	}{
+		{
+			name:      "timestamp with an offset",
+			tags:      map[string]string{"DateTimeOriginal": "2021:12:11 09:17:18+02:00"},
+			utc:       "2021-12-11T07:17:18Z",
+			local:     "2021-12-11T09:17:18Z",
+			utcOffset: "+02:00",
+			source:    OFFSET_SOURCE_EXIF,
+		},
+		{
+			name: "offset tag",
+			tags: map[string]string{
+				"DateTimeOriginal":   "2021:12:11 09:17:18",
+				"OffsetTimeOriginal": "-05:00",
+			},
+			utc:       "2021-12-11T14:17:18Z",
+			local:     "2021-12-11T09:17:18Z",
+			utcOffset: "-05:00",
+			source:    OFFSET_SOURCE_EXIF,
+		},
+		{
+			name: "offset tag takes precedence over the GPS time",
+			tags: map[string]string{
+				"DateTimeOriginal":   "2021:12:11 09:17:18",
+				"OffsetTimeOriginal": "-05:00",
+				"GPSDateTime":        "2021:12:11 08:17:10Z",
+			},
+			utc:       "2021-12-11T14:17:18Z",
+			local:     "2021-12-11T09:17:18Z",
+			utcOffset: "-05:00",
+			source:    OFFSET_SOURCE_EXIF,
+		},
+		{
+			name: "OffsetTime is used without OffsetTimeOriginal",
+			tags: map[string]string{
+				"DateTimeOriginal": "2021:12:11 09:17:18",
+				"OffsetTime":       "+09:00",
+				"GPSDateTime":      "2021:12:11 08:17:10Z",
+			},
+			utc:       "2021-12-11T00:17:18Z",
+			local:     "2021-12-11T09:17:18Z",
+			utcOffset: "+09:00",
+			source:    OFFSET_SOURCE_EXIF,
+		},
+		{
+			name: "GPS time rounded to the nearest quarter hour",
+			tags: map[string]string{
+				"DateTimeOriginal": "2021:12:11 09:17:18",
+				"GPSDateTime":      "2021:12:11 03:46:50Z",
+			},
+			utc:       "2021-12-11T03:47:18Z",
+			local:     "2021-12-11T09:17:18Z",
+			utcOffset: "+05:30",
+			source:    OFFSET_SOURCE_GPS,
+		},
+		{
+			name: "GPS time too far off is ignored",
+			tags: map[string]string{
+				"DateTimeOriginal": "2021:12:11 09:17:18",
+				"GPSDateTime":      "2021:12:10 03:17:18Z",
+			},
+			utc:       "2021-12-11T16:17:18Z",
+			local:     "2021-12-11T09:17:18Z",
+			utcOffset: "-07:00",
+			source:    OFFSET_SOURCE_DEFAULT,
+		},
+		{
+			name:      "no offset uses the default location",
+			tags:      map[string]string{"DateTimeOriginal": "2021:12:11 09:17:18"},
+			utc:       "2021-12-11T16:17:18Z",
+			local:     "2021-12-11T09:17:18Z",
+			utcOffset: "-07:00",
+			source:    OFFSET_SOURCE_DEFAULT,
+		},
+		{
+			name: "video dates are in UTC",
+			tags: map[string]string{
+				"MIMEType":        "video/quicktime",
+				"MediaCreateDate": "2021:12:11 16:17:18",
+			},
+			utc:       "2021-12-11T16:17:18Z",
+			local:     "2021-12-11T09:17:18Z",
+			utcOffset: "-07:00",
+			source:    OFFSET_SOURCE_DEFAULT,
+		},
+		{
+			name:        "no readable date",
+			tags:        map[string]string{"DateTimeOriginal": "0000:00:00 00:00:00"},
+			dateUnknown: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var img Image
+			PopulateImageCaptureTime(&img, test.tags, defaultLocation)
+
+			if img.DateUnknown != test.dateUnknown {
+				t.Fatalf("DateUnknown = %v, want %v", img.DateUnknown, test.dateUnknown)
+			}
+			if test.dateUnknown {
+				return
+			}
+
+			if utc := img.DateTimeOriginal.Format(time.RFC3339); utc != test.utc {
+				t.Errorf("DateTimeOriginal = %s, want %s", utc, test.utc)
+			}
+			if local := img.DateTimeLocal.Format(time.RFC3339); local != test.local {
+				t.Errorf("DateTimeLocal = %s, want %s", local, test.local)
+			}
+			if img.UtcOffset != test.utcOffset {
+				t.Errorf("UtcOffset = %s, want %s", img.UtcOffset, test.utcOffset)
+			}
+			if img.UtcOffsetSource != test.source {
+				t.Errorf("UtcOffsetSource = %s, want %s", img.UtcOffsetSource, test.source)
+			}
+		})
+	}
+}
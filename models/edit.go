@@ -0,0 +1,89 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Limits of the adjustments in an ImageEdit
+const (
+	MAX_STRAIGHTEN_DEGREES = 45
+	MAX_EXPOSURE_STOPS     = 2
+	MAX_CONTRAST           = 1
+)
+
+// A recipe applied to the original whenever derivatives are rendered, so the
+// original itself is never modified. Edits are applied in the order of the
+// fields: rotation, straightening, cropping and then tone adjustments.
+type ImageEdit struct {
+	ImageId string `gorm:"primarykey"`
+
+	Rotation   int     // Clockwise rotation in degrees, one of 0, 90, 180 or 270
+	Straighten float64 // Fine clockwise rotation in degrees, cropped to remove the corners
+
+	// The crop rectangle as fractions of the rotated image, with a zero width
+	// or height leaving the image uncropped
+	CropLeft   float64
+	CropTop    float64
+	CropWidth  float64
+	CropHeight float64
+
+	Exposure float64 // Exposure compensation in stops
+	Contrast float64 // From -1 for flat to 1 for double contrast
+
+	UpdatedAt time.Time
+}
+
+func (e *ImageEdit) HasCrop() bool {
+	return e.CropWidth > 0 && e.CropHeight > 0 &&
+		!(e.CropLeft == 0 && e.CropTop == 0 && e.CropWidth == 1 && e.CropHeight == 1)
+}
+
+// The crop rectangle in pixels of an image of the given size. Rounding never
+// takes the rectangle past the edges of the image.
+func (e *ImageEdit) CropArea(imageWidth int, imageHeight int) (int, int, int, int) {
+	left := int(math.Round(e.CropLeft * float64(imageWidth)))
+	top := int(math.Round(e.CropTop * float64(imageHeight)))
+	width := int(math.Round(e.CropWidth * float64(imageWidth)))
+	height := int(math.Round(e.CropHeight * float64(imageHeight)))
+
+	if left+width > imageWidth {
+		width = imageWidth - left
+	}
+	if top+height > imageHeight {
+		height = imageHeight - top
+	}
+
+	return left, top, width, height
+}
+
+func (e *ImageEdit) HasToneAdjustment() bool {
+	return e.Exposure != 0 || e.Contrast != 0
+}
+
+// Whether applying the edit leaves the image unchanged
+func (e *ImageEdit) IsIdentity() bool {
+	return e.Rotation == 0 && e.Straighten == 0 && !e.HasCrop() && !e.HasToneAdjustment()
+}
+
+func (e *ImageEdit) Validate() error {
+	if e.Rotation != 0 && e.Rotation != 90 && e.Rotation != 180 && e.Rotation != 270 {
+		return fmt.Errorf("rotation must be a multiple of 90 degrees")
+	}
+	if e.Straighten < -MAX_STRAIGHTEN_DEGREES || e.Straighten > MAX_STRAIGHTEN_DEGREES {
+		return fmt.Errorf("straighten must be within %d degrees", MAX_STRAIGHTEN_DEGREES)
+	}
+	if e.CropLeft < 0 || e.CropTop < 0 || e.CropWidth < 0 || e.CropHeight < 0 ||
+		e.CropLeft+e.CropWidth > 1 || e.CropTop+e.CropHeight > 1 {
+		return fmt.Errorf("crop must be within the image")
+	}
+	if e.Exposure < -MAX_EXPOSURE_STOPS || e.Exposure > MAX_EXPOSURE_STOPS {
+		return fmt.Errorf("exposure must be within %d stops", MAX_EXPOSURE_STOPS)
+	}
+	if e.Contrast < -MAX_CONTRAST || e.Contrast > MAX_CONTRAST {
+		return fmt.Errorf("contrast must be between -%d and %d", MAX_CONTRAST, MAX_CONTRAST)
+	}
+
+	return nil
+}
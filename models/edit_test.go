@@ -0,0 +1,69 @@
+package models
+
+import "testing"
+
+func TestImageEditValidate(t *testing.T) {
+	valid := ImageEdit{
+		Rotation:   270,
+		Straighten: -MAX_STRAIGHTEN_DEGREES,
+		CropLeft:   0.25,
+		CropTop:    0.5,
+		CropWidth:  0.75,
+		CropHeight: 0.5,
+		Exposure:   MAX_EXPOSURE_STOPS,
+		Contrast:   -MAX_CONTRAST,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate() of an edit at the limits failed: %s", err)
+	}
+
+	invalid := map[string]func(e *ImageEdit){
+		"rotation which isn't a quarter turn": func(e *ImageEdit) { e.Rotation = 45 },
+		"full turn of rotation":               func(e *ImageEdit) { e.Rotation = 360 },
+		"straightened too far":                func(e *ImageEdit) { e.Straighten = 45.5 },
+		"crop starting outside the image":     func(e *ImageEdit) { e.CropLeft = -0.1 },
+		"crop past the right edge":            func(e *ImageEdit) { e.CropWidth = 0.76 },
+		"crop past the bottom edge":           func(e *ImageEdit) { e.CropTop = 0.6 },
+		"negative crop size":                  func(e *ImageEdit) { e.CropHeight = -0.5 },
+		"exposure too high":                   func(e *ImageEdit) { e.Exposure = 2.1 },
+		"contrast too low":                    func(e *ImageEdit) { e.Contrast = -1.5 },
+	}
+
+	for name, change := range invalid {
+		t.Run(name, func(t *testing.T) {
+			edit := valid
+			change(&edit)
+
+			if err := edit.Validate(); err == nil {
+				t.Errorf("Validate() of %+v didn't fail", edit)
+			}
+		})
+	}
+}
+
+func TestImageEditCropArea(t *testing.T) {
+	tests := []struct {
+		edit                     ImageEdit
+		imageWidth, imageHeight  int
+		left, top, width, height int
+	}{
+		{ImageEdit{CropLeft: 0.25, CropTop: 0.25, CropWidth: 0.5, CropHeight: 0.5}, 400, 300, 100, 75, 200, 150},
+		// Rounding both the offset and the size up would pass the edge
+		{ImageEdit{CropLeft: 0.5, CropTop: 0, CropWidth: 0.5, CropHeight: 1}, 3, 3, 2, 0, 1, 3},
+		{ImageEdit{CropLeft: 1.0 / 3, CropTop: 1.0 / 3, CropWidth: 2.0 / 3, CropHeight: 2.0 / 3}, 1000, 1000, 333, 333, 667, 667},
+		{ImageEdit{CropLeft: 0, CropTop: 0, CropWidth: 1, CropHeight: 1}, 4032, 3024, 0, 0, 4032, 3024},
+	}
+
+	for _, test := range tests {
+		left, top, width, height := test.edit.CropArea(test.imageWidth, test.imageHeight)
+
+		if left != test.left || top != test.top || width != test.width || height != test.height {
+			t.Errorf("CropArea(%d, %d) of %+v = %d, %d, %d x %d, want %d, %d, %d x %d",
+				test.imageWidth, test.imageHeight, test.edit,
+				left, top, width, height, test.left, test.top, test.width, test.height)
+		}
+		if left+width > test.imageWidth || top+height > test.imageHeight {
+			t.Errorf("CropArea(%d, %d) of %+v is outside the image", test.imageWidth, test.imageHeight, test.edit)
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package models
 
+// Media types of a File
+const (
+	FILE_MEDIA_IMAGE = "image"
+	FILE_MEDIA_VIDEO = "video"
+)
+
 type File struct {
 	FileId        string `gorm:"primarykey"`
 	ImageId       string // The uuid for the image
@@ -10,4 +16,15 @@ type File struct {
 	IsOriginal    bool   // True if this is an original file
 	Width         uint64 // Width in pixels of the image file
 	Height        uint64 // Height in pixels of the image file
+	SizeName      string // The name of the size profile used to generate the file
+	SizeHash      string // The fingerprint of the size profile settings
+	IsCropped     bool   // True if the file was cropped to a different aspect ratio
+	Format        string // The format of the file, e.g. webp, avif, jpeg or mp4
+	MediaType     string `gorm:"default:image"` // Whether the file is an image or a video
+}
+
+// Whether the file is an image resized with a size profile, as opposed to an
+// original or a video transcode
+func (f *File) IsSizedDerivative() bool {
+	return !f.IsOriginal && f.SizeName != "" && f.MediaType != FILE_MEDIA_VIDEO
 }
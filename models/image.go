@@ -4,17 +4,50 @@ import (
 	"log"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const exifTag = "exifTag"
 
+// Lists the tags a numeric field is read from, in order of preference
+const exifNumericTag = "exifNumeric"
+
+// Numeric tag values are stored alongside the formatted ones under the tag
+// name with this suffix, as exiftool names them
+const NUMERIC_TAG_SUFFIX = "#"
+
+// Image visibility levels, combined with the publication state of the
+// albums an image belongs to when deciding what viewers can see
+const (
+	VISIBILITY_PUBLIC = "public" // Shown on the home stream and in published albums
+	VISIBILITY_ALBUM  = "album"  // Only shown within published albums
+	VISIBILITY_HIDDEN = "hidden" // Only shown to admins
+)
+
+// Kinds of media an Image can represent
+const (
+	MEDIA_TYPE_PHOTO = "photo" // A still image
+	MEDIA_TYPE_VIDEO = "video" // A video clip, shown with a poster frame
+	MEDIA_TYPE_LIVE  = "live"  // A still image paired with a short motion clip
+)
+
+func IsValidVisibility(visibility string) bool {
+	return visibility == VISIBILITY_PUBLIC ||
+		visibility == VISIBILITY_ALBUM ||
+		visibility == VISIBILITY_HIDDEN
+}
+
 type Image struct {
 	ImageId          string `gorm:"primarykey"`
 	ImportBatchId    string
 	OriginalFilename string
 	WidthPixels      uint64
 	HeightPixels     uint64
+	Visibility       string `gorm:"default:public"`
+	MediaType        string `gorm:"default:photo"`
+	Placeholder      string // A tiny inline preview as a data URI
+	DominantColor    string // The most common color, as a hex string
 
 	Files []File
 
@@ -24,7 +57,6 @@ type Image struct {
 	CameraModel              string    `exifTag:"Model"`
 	ColorSpace               string    `exifTag:"ColorSpace"`
 	DateTimeCreated          time.Time `exifTag:"DateTimeCreated"`
-	DateTimeOriginal         time.Time `exifTag:"DateTimeOriginal"`
 	DeviceManufacturer       string    `exifTag:"DeviceManufacturer"`
 	DeviceModel              string    `exifTag:"DeviceModel"`
 	DigitalCreationDateTime  time.Time `exifTag:"DigitalCreationDateTime"`
@@ -70,24 +102,69 @@ type Image struct {
 	Software                 string    `exifTag:"Software"`
 	XResolution              float64   `exifTag:"XResolution"`
 	YResolution              float64   `exifTag:"YResolution"`
+
+	// When the image was captured, set by PopulateImageCaptureTime
+	DateTimeOriginal time.Time // The UTC instant, which images are ordered by
+	DateTimeLocal    time.Time // The wall-clock time where it was taken, stored as UTC
+	UtcOffset        string    // The offset of the local time, e.g. +02:00
+	UtcOffsetSource  string    // Where the offset came from
+	DateUnknown      bool      // No capture time could be read
+
+	// Corrects the capture time read from the original, until it's written
+	// back into the original
+	CaptureTimeShift time.Duration
+
+	// Numeric EXIF values, for sorting and filtering
+	ExposureSeconds float64  `exifNumeric:"ExposureTime,ShutterSpeed"`
+	FocalLengthMm   float64  `exifNumeric:"FocalLength"`
+	FocalLength35mm float64  `exifNumeric:"FocalLengthIn35mmFormat"`
+	Latitude        *float64 `exifNumeric:"GPSLatitude"`  // Decimal degrees, negative in the south
+	Longitude       *float64 `exifNumeric:"GPSLongitude"` // Decimal degrees, negative in the west
+	AltitudeMeters  *float64 `exifNumeric:"GPSAltitude"`  // Negative below sea level
+
+	// Descriptive metadata, e.g. from Lightroom, set by PopulateImageFromXmp
+	Title    string
+	Caption  string
+	Keywords string // Joined with LIST_TAG_SEPARATOR
+	Rating   int    // Stars from 1 to 5, 0 when unrated or -1 when rejected
+	Label    string // A color label such as Red
+
+	// Where the image was taken, reverse geocoded from its coordinates
+	CountryCode string `gorm:"index"` // ISO 3166-1 alpha-2
+	Country     string
+	Region      string
+	City        string
 }
 
-func parseExifTimestamp(s string) (time.Time, error) {
-	// Exif date with timezone: 2021:12:11 09:17:18-08:00
-	layout := "2006:01:02 15:04:05-07:00"
-	value, err := time.Parse(layout, s)
-	if err == nil {
-		return value, nil
-	}
+// The tags the numeric fields are read from
+func NumericExifTags() []string {
+	tagNames := []string{}
 
-	// Exif date format: 2021:12:10 20:29:21
-	layout = "2006:01:02 15:04:05"
-	value, err = time.Parse(layout, s)
-	if err == nil {
-		return value, nil
+	t := reflect.TypeOf(Image{})
+	for i := 0; i < t.NumField(); i++ {
+		if tags := t.Field(i).Tag.Get(exifNumericTag); tags != "" {
+			tagNames = append(tagNames, strings.Split(tags, ",")...)
+		}
 	}
 
-	return time.Now(), err
+	return tagNames
+}
+
+// Sets a numeric field from the first of its tags with a value
+func populateNumericField(value reflect.Value, tagNames string, exifMap map[string]string) {
+	for _, tagName := range strings.Split(tagNames, ",") {
+		number, err := strconv.ParseFloat(exifMap[tagName+NUMERIC_TAG_SUFFIX], 64)
+		if err != nil {
+			continue
+		}
+
+		if value.Kind() == reflect.Ptr {
+			value.Set(reflect.ValueOf(&number))
+		} else {
+			value.SetFloat(number)
+		}
+		return
+	}
 }
 
 func PopulateImageFromExif(img *Image, exifMap map[string]string) {
@@ -97,6 +174,11 @@ func PopulateImageFromExif(img *Image, exifMap map[string]string) {
 	for i := 0; i < s.NumField(); i++ {
 		field := t.Field(i)
 
+		if numericTags := field.Tag.Get(exifNumericTag); numericTags != "" {
+			populateNumericField(s.Field(i), numericTags, exifMap)
+			continue
+		}
+
 		exifTagName := t.Field(i).Tag.Get(exifTag)
 		exifTagValue := exifMap[exifTagName]
 
@@ -125,7 +207,7 @@ func PopulateImageFromExif(img *Image, exifMap map[string]string) {
 				}
 				// Assume structs are time.Time
 				if field.Type.Kind() == reflect.Struct {
-					timeValue, err := parseExifTimestamp(exifTagValue)
+					timeValue, _, err := parseExifTimestamp(exifTagValue)
 
 					if err != nil {
 						log.Printf("Unable to parse date %s\n", exifTagValue)
@@ -138,3 +220,48 @@ func PopulateImageFromExif(img *Image, exifMap map[string]string) {
 		}
 	}
 }
+
+// Times are compared as instants, as they're read back from the database in
+// a different location than they were parsed in, and optional numbers by value
+func exifValuesEqual(a reflect.Value, b reflect.Value) bool {
+	if aTime, ok := a.Interface().(time.Time); ok {
+		return aTime.Equal(b.Interface().(time.Time))
+	}
+	if a.Kind() == reflect.Ptr {
+		return !b.IsNil() && a.Elem().Interface() == b.Elem().Interface()
+	}
+	return a.Interface() == b.Interface()
+}
+
+// Copies the EXIF fields which differ into the image, returning the names of
+// those changed. Fields the source has no value for are kept, as the stored
+// original may have had them removed by a privacy policy.
+func MergeExifFields(img *Image, source *Image) []string {
+	dst := reflect.ValueOf(img).Elem()
+	src := reflect.ValueOf(source).Elem()
+	t := dst.Type()
+
+	changed := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get(exifTag) == "" && field.Tag.Get(exifNumericTag) == "" {
+			continue
+		}
+
+		value := src.Field(i)
+		if value.IsZero() || exifValuesEqual(value, dst.Field(i)) {
+			continue
+		}
+
+		dst.Field(i).Set(value)
+		changed = append(changed, field.Name)
+	}
+
+	// The capture time is derived from several tags, so it's replaced whole
+	if !source.DateUnknown && !source.DateTimeOriginal.IsZero() {
+		changed = append(changed, img.CopyCaptureTime(source)...)
+	}
+
+	return changed
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A refresh merges the tags of the stored original, which has no location
+// once scrubbed, so the location has to be removed from the image itself
+func TestRefreshRemovesLocation(t *testing.T) {
+	latitude, longitude := 45.52, -122.68
+
+	image := Image{
+		Make:         "Canon",
+		GPSLatitude:  "45 deg 31' 12.00\" N",
+		GPSLongitude: "122 deg 40' 48.00\" W",
+		GPSPosition:  "45 deg 31' 12.00\" N, 122 deg 40' 48.00\" W",
+		Latitude:     &latitude,
+		Longitude:    &longitude,
+		CountryCode:  "US",
+		Country:      "United States",
+		Region:       "Oregon",
+		City:         "Portland",
+	}
+	refreshed := Image{Make: "Canon", LensModel: "RF24-105mm", DateUnknown: true}
+
+	changed := MergeExifFields(&image, &refreshed)
+	if image.Latitude == nil || image.GPSPosition == "" {
+		t.Fatal("merging a source without a location removed it")
+	}
+
+	changed = append(changed, image.ClearLocation()...)
+
+	if image.Latitude != nil || image.Longitude != nil || image.GPSPosition != "" || image.Place() != (Place{}) {
+		t.Errorf("location wasn't removed: %+v", image)
+	}
+	if image.LensModel != "RF24-105mm" {
+		t.Errorf("LensModel = %q, want the refreshed value", image.LensModel)
+	}
+
+	sort.Strings(changed)
+	want := "City,Country,CountryCode,GPSLatitude,GPSLongitude,GPSPosition,Latitude,LensModel,Longitude,Region"
+	if got := strings.Join(changed, ","); got != want {
+		t.Errorf("changed = %s, want %s", got, want)
+	}
+
+	if again := image.ClearLocation(); len(again) != 0 {
+		t.Errorf("clearing the location twice changed %v", again)
+	}
+}
+
+func TestMergeExifFields(t *testing.T) {
+	altitude, sameAltitude, newAltitude := 12.5, 12.5, 40.0
+	taken := time.Date(2021, 12, 11, 17, 17, 18, 0, time.UTC)
+
+	image := Image{
+		Make:             "Canon",
+		LensModel:        "RF24-105mm",
+		ISO:              100,
+		AltitudeMeters:   &altitude,
+		DateTimeOriginal: taken,
+		DateTimeLocal:    taken.Add(-7 * time.Hour),
+		UtcOffset:        "-07:00",
+		Title:            "Mount Hood",
+	}
+
+	// Equal values aren't changes, even when stored in different ways
+	unchanged := Image{
+		Make:             "Canon",
+		AltitudeMeters:   &sameAltitude,
+		DateTimeOriginal: taken.In(time.FixedZone("", -7*60*60)),
+		DateTimeLocal:    taken.Add(-7 * time.Hour),
+		UtcOffset:        "-07:00",
+	}
+	if changed := MergeExifFields(&image, &unchanged); len(changed) != 0 {
+		t.Errorf("merging equal values changed %v", changed)
+	}
+	if image.LensModel != "RF24-105mm" || image.ISO != 100 {
+		t.Errorf("fields without a value in the source weren't kept: %+v", image)
+	}
+
+	updated := Image{
+		Make:           "Canon",
+		ISO:            400,
+		AltitudeMeters: &newAltitude,
+		Title:          "Ignored, as it isn't read from EXIF",
+		DateUnknown:    true,
+	}
+	changed := MergeExifFields(&image, &updated)
+
+	if want := []string{"ISO", "AltitudeMeters"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %v, want %v", changed, want)
+	}
+	if image.ISO != 400 || *image.AltitudeMeters != 40 || image.Title != "Mount Hood" {
+		t.Errorf("merged image = %+v", image)
+	}
+	// An unknown date never replaces a known one
+	if image.DateUnknown || !image.DateTimeOriginal.Equal(taken) {
+		t.Errorf("capture time = %s, unknown %v, want it kept", image.DateTimeOriginal, image.DateUnknown)
+	}
+
+	// The capture time is replaced as a whole
+	retaken := Image{DateTimeOriginal: taken.Add(time.Hour), DateTimeLocal: taken.Add(-6 * time.Hour), UtcOffset: "-07:00"}
+	changed = MergeExifFields(&image, &retaken)
+
+	if want := []string{"DateTimeOriginal", "DateTimeLocal", "UtcOffset", "UtcOffsetSource", "DateUnknown"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %v, want %v", changed, want)
+	}
+	if !image.DateTimeOriginal.Equal(taken.Add(time.Hour)) {
+		t.Errorf("DateTimeOriginal = %s, want an hour later", image.DateTimeOriginal)
+	}
+}
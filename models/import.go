@@ -1,26 +1,85 @@
 package models
 
+import "time"
+
+// States of an ImageImportTask
+const (
+	TASK_QUEUED     = "queued"     // Waiting for a worker, including between retries
+	TASK_PROCESSING = "processing" // Being processed by a worker
+	TASK_SUCCEEDED  = "succeeded"
+	TASK_FAILED     = "failed" // Out of attempts, until retried manually
+)
+
+// Kinds of queued task
+const (
+	TASK_TYPE_IMPORT       = ""             // Renders an original into its derivatives
+	TASK_TYPE_METADATA     = "metadata"     // Re-reads the metadata of an imported original
+	TASK_TYPE_CAPTURE_TIME = "capture-time" // Writes the corrected capture time into the original
+	TASK_TYPE_GEOCODE      = "geocode"      // Looks up the place names of the image's location
+)
+
 type ImageImportTask struct {
 	ImageId       string `gorm:"primarykey"`
 	ImportBatchId string `gorm:"primarykey"`
 	Filename      string
 	IsProcessed   bool
+	State         string `gorm:"default:queued"`
+	Error         string // The error of the latest failed attempt
+	Attempts      int
+	Payload       string // The queued ImageImport as JSON, used to retry it
+	Changes       string // The fields a metadata refresh changed, comma separated
+	UpdatedAt     time.Time
+}
+
+// Whether the task won't be processed again without being retried
+func (t *ImageImportTask) IsFinished() bool {
+	return t.State == TASK_SUCCEEDED || t.State == TASK_FAILED
 }
 
 type OutputImageSize struct {
-	LongEdge    int
-	Quality     int
-	Suffix      string
-	Extension   string
-	Format      string
-	ContentType string
+	Name        string `json:"name"`
+	LongEdge    int    `json:"longEdge"`
+	Quality     int    `json:"quality"`
+	Suffix      string `json:"suffix"`
+	Extension   string `json:"extension"`
+	Format      string `json:"format"`
+	ContentType string `json:"contentType"`
+	Sharpen     bool   `json:"sharpen"`
+	Crop        string `json:"crop"`
+	Watermark   bool   `json:"watermark"`
 }
 
 type ImageImport struct {
+	Type            string
 	InitialImport   bool
 	ImageId         string
 	ImportBatchId   string
 	OriginalFileKey string
 	AlbumId         string
 	Sizes           []OutputImageSize
+
+	// Regenerates the placeholder of an already imported image
+	GeneratePlaceholder bool
+
+	// The motion clip uploaded alongside a Live Photo
+	PairedVideoKey string
+
+	// The XMP sidecar uploaded alongside the original, whose metadata takes
+	// precedence over that embedded in it
+	SidecarKey string
+
+	// The metadata published in the stored files, which a geofence can make
+	// stricter while processing
+	PrivacyPolicy string
+
+	// Applied to the original before rendering derivatives, if it has been edited
+	Edit *ImageEdit
+
+	// The number of attempts which have already failed
+	Attempt int
+
+	// The derivative filenames of every size in the image's profile set,
+	// including those not regenerated. Once processed, derivatives of sizes
+	// which were removed from the set are deleted. Left empty, none are.
+	KeepFiles []string
 }
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// An area of the map in decimal degrees. West is greater than east when it
+// crosses the antimeridian.
+type MapBounds struct {
+	West  float64
+	South float64
+	East  float64
+	North float64
+}
+
+func WorldMapBounds() MapBounds {
+	return MapBounds{West: -180, South: -90, East: 180, North: 90}
+}
+
+// Wraps a longitude into -180 to 180
+func normalizeLongitude(longitude float64) float64 {
+	return math.Mod(math.Mod(longitude+180, 360)+360, 360) - 180
+}
+
+// Parses a bounding box of the form west,south,east,north, as sent by
+// Leaflet's toBBoxString. Longitudes of maps panned around the world are
+// wrapped, and an empty box is the whole world.
+func ParseMapBounds(value string) (MapBounds, error) {
+	if value == "" {
+		return WorldMapBounds(), nil
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return MapBounds{}, fmt.Errorf("bbox %s must be west,south,east,north", value)
+	}
+
+	values := []float64{}
+	for _, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return MapBounds{}, fmt.Errorf("bbox %s must be west,south,east,north", value)
+		}
+		values = append(values, number)
+	}
+
+	bounds := MapBounds{
+		West:  values[0],
+		South: math.Max(values[1], -90),
+		East:  values[2],
+		North: math.Min(values[3], 90),
+	}
+	if bounds.South > bounds.North {
+		return MapBounds{}, fmt.Errorf("bbox %s has its south above its north", value)
+	}
+
+	if bounds.East-bounds.West >= 360 {
+		bounds.West, bounds.East = -180, 180
+	} else {
+		bounds.West = normalizeLongitude(bounds.West)
+		bounds.East = normalizeLongitude(bounds.East)
+	}
+
+	return bounds, nil
+}
+
+func (b *MapBounds) CrossesAntimeridian() bool {
+	return b.West > b.East
+}
+
+// Selects the images plotted on a map
+type MapQuery struct {
+	Bounds        MapBounds
+	AlbumSlug     string // Only images in the album, otherwise those on the stream
+	IncludeHidden bool   // Hidden images in the album are included, for admins
+	Limit         int
+
+	// The policy of albums without one of their own
+	DefaultPrivacyPolicy string
+}
+
+// An image plotted on a map
+type MapImage struct {
+	ImageId      string  `json:"imageId"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	ThumbnailUrl string  `json:"thumbnailUrl"`
+	Url          string  `json:"url"`
+	Title        string  `json:"title"`
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestParseMapBounds(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		want       MapBounds
+		crosses    bool
+		shouldFail bool
+	}{
+		{
+			name:  "empty is the whole world",
+			value: "",
+			want:  MapBounds{West: -180, South: -90, East: 180, North: 90},
+		},
+		{
+			name:  "within the world",
+			value: "-123.5,45,-122,46.25",
+			want:  MapBounds{West: -123.5, South: 45, East: -122, North: 46.25},
+		},
+		{
+			name:    "crossing the antimeridian",
+			value:   "170,-20,190,-10",
+			want:    MapBounds{West: 170, South: -20, East: -170, North: -10},
+			crosses: true,
+		},
+		{
+			name:    "panned a full turn west",
+			value:   "-550,10,-530,20",
+			want:    MapBounds{West: 170, South: 10, East: -170, North: 20},
+			crosses: true,
+		},
+		{
+			name:  "panned a full turn east",
+			value: "370,10,380,20",
+			want:  MapBounds{West: 10, South: 10, East: 20, North: 20},
+		},
+		{
+			name:  "zoomed out past the whole world",
+			value: "-250,-100,250,100",
+			want:  MapBounds{West: -180, South: -90, East: 180, North: 90},
+		},
+		{
+			name:       "too few values",
+			value:      "1,2,3",
+			shouldFail: true,
+		},
+		{
+			name:       "not a number",
+			value:      "a,2,3,4",
+			shouldFail: true,
+		},
+		{
+			name:       "south above north",
+			value:      "0,50,10,40",
+			shouldFail: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bounds, err := ParseMapBounds(test.value)
+
+			if test.shouldFail {
+				if err == nil {
+					t.Fatalf("ParseMapBounds(%q) = %+v, want an error", test.value, bounds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMapBounds(%q) failed: %s", test.value, err)
+			}
+
+			if bounds != test.want {
+				t.Errorf("ParseMapBounds(%q) = %+v, want %+v", test.value, bounds, test.want)
+			}
+			if bounds.CrossesAntimeridian() != test.crosses {
+				t.Errorf("CrossesAntimeridian() = %v, want %v", bounds.CrossesAntimeridian(), test.crosses)
+			}
+		})
+	}
+}
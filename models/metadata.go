@@ -0,0 +1,99 @@
+package models
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Every tag exiftool read from an image's original, including those without a
+// column on Image
+type ImageMetadata struct {
+	ImageId   string `gorm:"primarykey"`
+	Tags      string // The formatted tag values as a JSON object
+	UpdatedAt time.Time
+}
+
+type MetadataTag struct {
+	Name  string
+	Value string
+}
+
+// Tags of exiftool's File, System and ExifTool groups, which describe the
+// temporary copy exiftool read rather than the image, such as its path,
+// permissions and timestamps
+var fileSystemTags = map[string]bool{
+	"SourceFile":          true,
+	"ExifToolVersion":     true,
+	"Warning":             true,
+	"Error":               true,
+	"FileName":            true,
+	"Directory":           true,
+	"FileSize":            true,
+	"FileModifyDate":      true,
+	"FileAccessDate":      true,
+	"FileInodeChangeDate": true,
+	"FileCreateDate":      true,
+	"FilePermissions":     true,
+	"FileAttributes":      true,
+	"FileDeviceNumber":    true,
+	"FileInodeNumber":     true,
+	"FileHardLinks":       true,
+	"FileUserID":          true,
+	"FileGroupID":         true,
+	"FileDeviceID":        true,
+	"FileBlockSize":       true,
+	"FileBlockCount":      true,
+	"FileType":            true,
+	"FileTypeExtension":   true,
+	"MIMEType":            true,
+	"ExifByteOrder":       true,
+	"CurrentIPTCDigest":   true,
+}
+
+// Stores the formatted tags, leaving out the numeric values read alongside
+// and the tags describing the file rather than the image
+func NewImageMetadata(imageId string, tags map[string]string) (*ImageMetadata, error) {
+	formatted := map[string]string{}
+	for name, value := range tags {
+		if !strings.HasSuffix(name, NUMERIC_TAG_SUFFIX) && !fileSystemTags[name] {
+			formatted[name] = value
+		}
+	}
+
+	data, err := json.Marshal(formatted)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageMetadata{ImageId: imageId, Tags: string(data)}, nil
+}
+
+func (m *ImageMetadata) TagMap() map[string]string {
+	tags := map[string]string{}
+	json.Unmarshal([]byte(m.Tags), &tags)
+
+	return tags
+}
+
+// The tags sorted by name
+func (m *ImageMetadata) List() []MetadataTag {
+	list := []MetadataTag{}
+	for name, value := range m.TagMap() {
+		list = append(list, MetadataTag{Name: name, Value: value})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// Removes the tags describing where the image was taken
+func RemoveLocationTags(tags map[string]string) {
+	for name := range tags {
+		if strings.HasPrefix(name, "GPS") {
+			delete(tags, name)
+		}
+	}
+}
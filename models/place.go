@@ -0,0 +1,125 @@
+package models
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A named place, found by reverse geocoding a location
+type Place struct {
+	CountryCode string `json:"countryCode"`
+	Country     string `json:"country"`
+	Region      string `json:"region"`
+	City        string `json:"city"`
+}
+
+// The names of the fields SetPlace sets
+var placeFields = []string{"CountryCode", "Country", "Region", "City"}
+
+func (img *Image) Place() Place {
+	return Place{
+		CountryCode: img.CountryCode,
+		Country:     img.Country,
+		Region:      img.Region,
+		City:        img.City,
+	}
+}
+
+// Replaces the place of the image, returning the fields set if it differed
+func (img *Image) SetPlace(place Place) []string {
+	if img.Place() == place {
+		return []string{}
+	}
+
+	img.CountryCode = place.CountryCode
+	img.Country = place.Country
+	img.Region = place.Region
+	img.City = place.City
+
+	return append([]string{}, placeFields...)
+}
+
+func (img *Image) ClearPlace() []string {
+	return img.SetPlace(Place{})
+}
+
+// The place for display, from the most to the least specific name, e.g.
+// "Portland, Oregon, United States"
+func (p Place) String() string {
+	names := []string{}
+	for _, name := range []string{p.City, p.Region, p.Country} {
+		if name != "" && (len(names) == 0 || names[len(names)-1] != name) {
+			names = append(names, name)
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// A coordinate in exiftool's default format, e.g. 37 deg 46' 29.64" N
+var gpsCoordinatePattern = regexp.MustCompile(`(\d+(?:\.\d+)?) deg (\d+(?:\.\d+)?)' (\d+(?:\.\d+)?)" ([NSEW])`)
+
+// Parses a GPSPosition string such as 37 deg 46' 29.64" N, 122 deg 25' 9.84" W
+// into decimal degrees
+func ParseGPSPosition(position string) (float64, float64, bool) {
+	matches := gpsCoordinatePattern.FindAllStringSubmatch(position, -1)
+	if len(matches) != 2 {
+		return 0, 0, false
+	}
+
+	coordinates := []float64{}
+	for _, match := range matches {
+		degrees, _ := strconv.ParseFloat(match[1], 64)
+		minutes, _ := strconv.ParseFloat(match[2], 64)
+		seconds, _ := strconv.ParseFloat(match[3], 64)
+
+		value := degrees + minutes/60 + seconds/3600
+		if match[4] == "S" || match[4] == "W" {
+			value = -value
+		}
+		coordinates = append(coordinates, value)
+	}
+
+	return coordinates[0], coordinates[1], true
+}
+
+// The location of the image in decimal degrees. Images imported before the
+// numeric columns were added only have the GPSPosition string.
+func (img *Image) Coordinates() (float64, float64, bool) {
+	if img.Latitude != nil && img.Longitude != nil {
+		return *img.Latitude, *img.Longitude, true
+	}
+
+	return ParseGPSPosition(img.GPSPosition)
+}
+
+// Narrows a list of images to a place, by exact names as linked from an
+// image, or by a search of any of them
+type PlaceFilter struct {
+	Country string `form:"country"` // A country code or name
+	Region  string `form:"region"`
+	City    string `form:"city"`
+	Search  string `form:"q"`
+
+	// Images whose location isn't published are never matched
+	DefaultPrivacyPolicy string     `form:"-"`
+	Geofences            []Geofence `form:"-"`
+}
+
+func (f *PlaceFilter) IsEmpty() bool {
+	return f.Country == "" && f.Region == "" && f.City == "" && strings.TrimSpace(f.Search) == ""
+}
+
+// Filters to the place of the image, as narrowly as it's known
+func (p Place) Filter() PlaceFilter {
+	return PlaceFilter{Country: p.CountryCode, Region: p.Region, City: p.City}
+}
+
+// The filter for display, e.g. in a page title
+func (f *PlaceFilter) String() string {
+	if search := strings.TrimSpace(f.Search); search != "" {
+		return search
+	}
+	return Place{Country: f.Country, Region: f.Region, City: f.City}.String()
+}
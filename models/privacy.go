@@ -0,0 +1,148 @@
+package models
+
+import "math"
+
+// How much metadata is kept in the files published for an album
+const (
+	PRIVACY_KEEP      = "keep"      // Publish metadata as imported
+	PRIVACY_STRIP_GPS = "strip_gps" // Remove location and serial numbers
+	PRIVACY_STRIP_ALL = "strip_all" // Remove all metadata
+)
+
+var privacyPolicies = []string{PRIVACY_KEEP, PRIVACY_STRIP_GPS, PRIVACY_STRIP_ALL}
+
+func PrivacyPolicies() []string {
+	return append([]string{}, privacyPolicies...)
+}
+
+func IsValidPrivacyPolicy(policy string) bool {
+	for _, p := range privacyPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whichever policy removes more metadata
+func StricterPrivacyPolicy(a string, b string) string {
+	rank := func(policy string) int {
+		for i, p := range privacyPolicies {
+			if p == policy {
+				return i
+			}
+		}
+		return 0
+	}
+
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
+
+const EARTH_RADIUS_METERS = 6371000
+
+// A circular area, e.g. around a home address, where locations are never
+// published
+type Geofence struct {
+	Latitude     float64
+	Longitude    float64
+	RadiusMeters float64
+}
+
+// The haversine distance between two points, in meters
+func DistanceMeters(latitude1 float64, longitude1 float64, latitude2 float64, longitude2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+
+	dLat := toRadians(latitude2 - latitude1)
+	dLon := toRadians(longitude2 - longitude1)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(latitude1))*math.Cos(toRadians(latitude2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * EARTH_RADIUS_METERS * math.Asin(math.Sqrt(a))
+}
+
+func (g *Geofence) Contains(latitude float64, longitude float64) bool {
+	return DistanceMeters(g.Latitude, g.Longitude, latitude, longitude) <= g.RadiusMeters
+}
+
+// A box which contains the geofence, for filtering in queries. Boxes reaching
+// a pole span every longitude.
+func (g *Geofence) Bounds() MapBounds {
+	degrees := g.RadiusMeters / EARTH_RADIUS_METERS * 180 / math.Pi
+
+	south := math.Max(g.Latitude-degrees, -90)
+	north := math.Min(g.Latitude+degrees, 90)
+	if south == -90 || north == 90 {
+		return MapBounds{West: -180, South: south, East: 180, North: north}
+	}
+
+	// Degrees of longitude are shortest at the latitude closest to the pole
+	widest := math.Max(math.Abs(south), math.Abs(north)) * math.Pi / 180
+	longitudeDegrees := degrees / math.Cos(widest)
+	if longitudeDegrees >= 180 {
+		return MapBounds{West: -180, South: south, East: 180, North: north}
+	}
+
+	return MapBounds{
+		West:  normalizeLongitude(g.Longitude - longitudeDegrees),
+		South: south,
+		East:  normalizeLongitude(g.Longitude + longitudeDegrees),
+		North: north,
+	}
+}
+
+// Whether a location is within one of the geofences, which may have been
+// added after the image was imported
+func IsInAnyGeofence(geofences []Geofence, latitude float64, longitude float64) bool {
+	for _, geofence := range geofences {
+		if geofence.Contains(latitude, longitude) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the location read from the EXIF data, returning the names of the
+// fields which had a value
+func (image *Image) ClearLocation() []string {
+	changed := []string{}
+
+	textFields := []struct {
+		name  string
+		value *string
+	}{
+		{"GPSAltitude", &image.GPSAltitude},
+		{"GPSDestBearing", &image.GPSDestBearing},
+		{"GPSImgDirection", &image.GPSImgDirection},
+		{"GPSLatitude", &image.GPSLatitude},
+		{"GPSLongitude", &image.GPSLongitude},
+		{"GPSPosition", &image.GPSPosition},
+		{"GPSSpeed", &image.GPSSpeed},
+	}
+	for _, field := range textFields {
+		if *field.value != "" {
+			*field.value = ""
+			changed = append(changed, field.name)
+		}
+	}
+
+	numericFields := []struct {
+		name  string
+		value **float64
+	}{
+		{"Latitude", &image.Latitude},
+		{"Longitude", &image.Longitude},
+		{"AltitudeMeters", &image.AltitudeMeters},
+	}
+	for _, field := range numericFields {
+		if *field.value != nil {
+			*field.value = nil
+			changed = append(changed, field.name)
+		}
+	}
+
+	return append(changed, image.ClearPlace()...)
+}
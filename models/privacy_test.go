@@ -0,0 +1,112 @@
+package models
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStricterPrivacyPolicy(t *testing.T) {
+	// An unset policy keeps everything, and the first policy wins a tie
+	rank := map[string]int{"": 0, PRIVACY_KEEP: 0, PRIVACY_STRIP_GPS: 1, PRIVACY_STRIP_ALL: 2}
+
+	for a := range rank {
+		for b := range rank {
+			want := a
+			if rank[b] > rank[a] {
+				want = b
+			}
+
+			if got := StricterPrivacyPolicy(a, b); got != want {
+				t.Errorf("StricterPrivacyPolicy(%q, %q) = %q, want %q", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestGeofenceContains(t *testing.T) {
+	// A kilometre around Pioneer Courthouse Square in Portland
+	home := Geofence{Latitude: 45.5189, Longitude: -122.6793, RadiusMeters: 1000}
+
+	if !home.Contains(45.5189, -122.6793) {
+		t.Error("the centre isn't in the geofence")
+	}
+	// About 890 meters north
+	if !home.Contains(45.5269, -122.6793) {
+		t.Error("a point within the radius isn't in the geofence")
+	}
+	// About 1.1 kilometres north
+	if home.Contains(45.5289, -122.6793) {
+		t.Error("a point past the radius is in the geofence")
+	}
+
+	// Distances are measured along the sphere, so they shrink towards the
+	// poles and wrap around the antimeridian
+	if d := DistanceMeters(0, 179.999, 0, -179.999); d > 250 {
+		t.Errorf("distance across the antimeridian = %.0fm, want about 222m", d)
+	}
+	if d := DistanceMeters(89.999, 0, 89.999, 180); d > 250 {
+		t.Errorf("distance across the pole = %.0fm, want about 222m", d)
+	}
+}
+
+func TestGeofenceBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		geofence Geofence
+		crosses  bool
+		wholeLon bool
+	}{
+		{"in the middle of the map", Geofence{Latitude: 45.5, Longitude: -122.7, RadiusMeters: 5000}, false, false},
+		{"across the antimeridian", Geofence{Latitude: -16.8, Longitude: 179.99, RadiusMeters: 5000}, true, false},
+		{"reaching the pole", Geofence{Latitude: 89.99, Longitude: 10, RadiusMeters: 5000}, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bounds := test.geofence.Bounds()
+
+			if bounds.CrossesAntimeridian() != test.crosses {
+				t.Errorf("%+v crosses the antimeridian = %v, want %v", bounds, bounds.CrossesAntimeridian(), test.crosses)
+			}
+			if isWhole := bounds.West == -180 && bounds.East == 180; isWhole != test.wholeLon {
+				t.Errorf("%+v spans every longitude = %v, want %v", bounds, isWhole, test.wholeLon)
+			}
+
+			// The points on the edge of the geofence are within the box
+			g := test.geofence
+			for _, bearing := range []float64{0, 45, 90, 135, 180, 225, 270, 315} {
+				latitude, longitude := destination(g.Latitude, g.Longitude, bearing, g.RadiusMeters*0.999)
+				if !g.Contains(latitude, longitude) {
+					t.Fatalf("point at %v degrees isn't in the geofence", bearing)
+				}
+				if !boundsContain(bounds, latitude, longitude) {
+					t.Errorf("point %.5f,%.5f at %v degrees is outside %+v", latitude, longitude, bearing, bounds)
+				}
+			}
+		})
+	}
+}
+
+// The point at a distance and bearing from another, on a sphere
+func destination(latitude float64, longitude float64, bearing float64, meters float64) (float64, float64) {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	toDegrees := func(radians float64) float64 { return radians * 180 / math.Pi }
+
+	lat1, lon1, theta := toRadians(latitude), toRadians(longitude), toRadians(bearing)
+	delta := meters / EARTH_RADIUS_METERS
+
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(delta) + math.Cos(lat1)*math.Sin(delta)*math.Cos(theta))
+	lon2 := lon1 + math.Atan2(math.Sin(theta)*math.Sin(delta)*math.Cos(lat1), math.Cos(delta)-math.Sin(lat1)*math.Sin(lat2))
+
+	return toDegrees(lat2), normalizeLongitude(toDegrees(lon2))
+}
+
+func boundsContain(bounds MapBounds, latitude float64, longitude float64) bool {
+	if latitude < bounds.South || latitude > bounds.North {
+		return false
+	}
+	if bounds.CrossesAntimeridian() {
+		return longitude >= bounds.West || longitude <= bounds.East
+	}
+	return longitude >= bounds.West && longitude <= bounds.East
+}
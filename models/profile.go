@@ -0,0 +1,198 @@
+package models
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sort"
+)
+
+// Crop modes for an OutputImageSize
+const (
+	CROP_FIT    = "fit"    // Scale to fit the long edge, keeping the aspect ratio
+	CROP_SQUARE = "square" // Center crop to a square with sides of the long edge
+	CROP_SMART  = "smart"  // Crop to a square around the most interesting region
+)
+
+const DEFAULT_SIZE_PROFILE_SET = "default"
+
+// A named collection of output sizes, selectable per album or import
+type SizeProfileSets struct {
+	DefaultSet string                       `json:"defaultSet"`
+	Sets       map[string][]OutputImageSize `json:"sets"`
+
+	// Additional formats generated alongside each size, e.g. avif or jpeg
+	ExtraFormats []string `json:"extraFormats"`
+}
+
+var formatExtensions = map[string]string{
+	"webp": ".webp",
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"avif": ".avif",
+	"tiff": ".tiff",
+}
+
+var formatContentTypes = map[string]string{
+	"webp": "image/webp",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"avif": "image/avif",
+	"tiff": "image/tiff",
+}
+
+func FormatContentType(format string) string {
+	return formatContentTypes[format]
+}
+
+// Fills in the defaults for any fields left out of a configured size
+func (s *OutputImageSize) applyDefaults() error {
+	if s.Name == "" {
+		return fmt.Errorf("size profile is missing a name")
+	}
+	if s.LongEdge <= 0 {
+		return fmt.Errorf("size profile %s must have a positive long edge", s.Name)
+	}
+	if s.Format == "" {
+		s.Format = "webp"
+	}
+	if _, ok := formatExtensions[s.Format]; !ok {
+		return fmt.Errorf("size profile %s has unknown format %s", s.Name, s.Format)
+	}
+	if s.Quality == 0 {
+		s.Quality = 80
+	}
+	if s.Suffix == "" {
+		s.Suffix = "_" + s.Name
+	}
+	if s.Extension == "" {
+		s.Extension = formatExtensions[s.Format]
+	}
+	if s.ContentType == "" {
+		s.ContentType = formatContentTypes[s.Format]
+	}
+	if s.Crop == "" {
+		s.Crop = CROP_FIT
+	}
+	if s.Crop != CROP_FIT && s.Crop != CROP_SQUARE && s.Crop != CROP_SMART {
+		return fmt.Errorf("size profile %s has unknown crop mode %s", s.Name, s.Crop)
+	}
+
+	return nil
+}
+
+// The filename of the derivative generated from an image with this size
+func (s *OutputImageSize) Filename(imageId string) string {
+	return imageId + s.Suffix + s.Extension
+}
+
+// Fingerprint identifies the settings used to produce a derivative, so that
+// only sizes which were added or changed need to be regenerated
+func (s *OutputImageSize) Fingerprint() string {
+	settings := fmt.Sprintf("%d|%d|%s|%s|%s|%t|%s",
+		s.LongEdge, s.Quality, s.Suffix, s.Extension, s.Format, s.Sharpen, s.Crop)
+
+	// Only added when set, so derivatives generated before watermarks existed
+	// keep their fingerprint
+	if s.Watermark {
+		settings += "|watermark"
+	}
+
+	return fmt.Sprintf("%x", sha1.Sum([]byte(settings)))
+}
+
+// Validates each set and fills in defaults for each of its sizes
+func (p *SizeProfileSets) Normalize() error {
+	if len(p.Sets) == 0 {
+		return fmt.Errorf("no size profile sets defined")
+	}
+
+	if p.DefaultSet == "" {
+		p.DefaultSet = DEFAULT_SIZE_PROFILE_SET
+	}
+	if _, ok := p.Sets[p.DefaultSet]; !ok {
+		return fmt.Errorf("default size profile set %s is not defined", p.DefaultSet)
+	}
+
+	for _, format := range p.ExtraFormats {
+		if _, ok := formatExtensions[format]; !ok {
+			return fmt.Errorf("unknown extra format %s", format)
+		}
+	}
+
+	for name, sizes := range p.Sets {
+		seen := map[string]bool{}
+
+		for i := range sizes {
+			if err := sizes[i].applyDefaults(); err != nil {
+				return fmt.Errorf("set %s: %s", name, err)
+			}
+			if seen[sizes[i].Name] {
+				return fmt.Errorf("set %s: duplicate size profile %s", name, sizes[i].Name)
+			}
+			seen[sizes[i].Name] = true
+		}
+	}
+
+	return nil
+}
+
+// Returns a copy of the sizes in the named set, or the default set if the
+// name is empty, with a variant of each size for every extra format
+func (p *SizeProfileSets) Get(name string) ([]OutputImageSize, error) {
+	if name == "" {
+		name = p.DefaultSet
+	}
+
+	sizes, ok := p.Sets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown size profile set %s", name)
+	}
+
+	expanded := append([]OutputImageSize{}, sizes...)
+
+	for _, size := range sizes {
+		for _, format := range p.ExtraFormats {
+			if format == size.Format {
+				continue
+			}
+
+			variant := size
+			variant.Format = format
+			variant.Extension = formatExtensions[format]
+			variant.ContentType = formatContentTypes[format]
+			expanded = append(expanded, variant)
+		}
+	}
+
+	return expanded, nil
+}
+
+func (p *SizeProfileSets) Names() []string {
+	names := []string{}
+	for name := range p.Sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// The sizes fstop has always produced, used when no profiles are configured
+func DefaultSizeProfileSets() *SizeProfileSets {
+	profiles := &SizeProfileSets{
+		DefaultSet: DEFAULT_SIZE_PROFILE_SET,
+		Sets: map[string][]OutputImageSize{
+			DEFAULT_SIZE_PROFILE_SET: {
+				{Name: "thumb", LongEdge: 200, Quality: 80},
+				{Name: "small", LongEdge: 600, Quality: 80},
+				{Name: "medium", LongEdge: 1080, Quality: 80},
+				{Name: "large", LongEdge: 1920, Quality: 65},
+				{Name: "xlarge", LongEdge: 2560, Quality: 50},
+			},
+		},
+	}
+
+	profiles.Normalize()
+
+	return profiles
+}
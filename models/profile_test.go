@@ -0,0 +1,152 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSizeProfileSetsNormalize(t *testing.T) {
+	profiles := SizeProfileSets{
+		Sets: map[string][]OutputImageSize{
+			"default":   {{Name: "small", LongEdge: 600}},
+			"portfolio": {{Name: "square", LongEdge: 400, Format: "jpeg", Crop: CROP_SQUARE, Quality: 90}},
+		},
+	}
+
+	if err := profiles.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if profiles.DefaultSet != DEFAULT_SIZE_PROFILE_SET {
+		t.Errorf("DefaultSet = %q, want %q", profiles.DefaultSet, DEFAULT_SIZE_PROFILE_SET)
+	}
+
+	small := profiles.Sets["default"][0]
+	want := OutputImageSize{
+		Name: "small", LongEdge: 600, Quality: 80, Suffix: "_small", Extension: ".webp",
+		Format: "webp", ContentType: "image/webp", Crop: CROP_FIT,
+	}
+	if small != want {
+		t.Errorf("defaults applied to %+v, want %+v", small, want)
+	}
+
+	square := profiles.Sets["portfolio"][0]
+	if square.Quality != 90 || square.Extension != ".jpg" || square.Crop != CROP_SQUARE {
+		t.Errorf("configured settings were replaced: %+v", square)
+	}
+}
+
+func TestSizeProfileSetsNormalizeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		profiles SizeProfileSets
+		want     string // Part of the error
+	}{
+		{"no sets", SizeProfileSets{}, "no size profile sets"},
+		{
+			"missing default set",
+			SizeProfileSets{DefaultSet: "web", Sets: map[string][]OutputImageSize{"print": {{Name: "a", LongEdge: 1}}}},
+			"default size profile set web",
+		},
+		{
+			"unknown extra format",
+			SizeProfileSets{Sets: map[string][]OutputImageSize{"default": {{Name: "a", LongEdge: 1}}}, ExtraFormats: []string{"gif"}},
+			"unknown extra format gif",
+		},
+		{
+			"size without a long edge",
+			SizeProfileSets{Sets: map[string][]OutputImageSize{"default": {{Name: "a"}}}},
+			"positive long edge",
+		},
+		{
+			"unknown crop mode",
+			SizeProfileSets{Sets: map[string][]OutputImageSize{"default": {{Name: "a", LongEdge: 1, Crop: "circle"}}}},
+			"unknown crop mode circle",
+		},
+		{
+			"duplicate size names",
+			SizeProfileSets{Sets: map[string][]OutputImageSize{"default": {{Name: "a", LongEdge: 1}, {Name: "a", LongEdge: 2}}}},
+			"duplicate size profile a",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.profiles.Normalize()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Normalize() error = %v, want one containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSizeProfileSetsGet(t *testing.T) {
+	profiles := SizeProfileSets{
+		Sets: map[string][]OutputImageSize{
+			"default": {{Name: "small", LongEdge: 600}, {Name: "large", LongEdge: 1920, Format: "jpeg"}},
+		},
+		ExtraFormats: []string{"avif", "jpeg"},
+	}
+	if err := profiles.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes, err := profiles.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The configured sizes come first, then a variant in each extra format
+	// they aren't already in
+	got := []string{}
+	for _, size := range sizes {
+		got = append(got, size.Filename("img"))
+	}
+	want := "img_small.webp img_large.jpg img_small.avif img_small.jpg img_large.avif"
+	if strings.Join(got, " ") != want {
+		t.Errorf("Get(\"\") = %s, want %s", strings.Join(got, " "), want)
+	}
+	if sizes[2].ContentType != "image/avif" {
+		t.Errorf("variant content type = %s, want image/avif", sizes[2].ContentType)
+	}
+
+	// The copy can be changed without changing the set
+	sizes[0].LongEdge = 1
+	if profiles.Sets["default"][0].LongEdge != 600 {
+		t.Error("changing the sizes returned changed the set")
+	}
+
+	if _, err := profiles.Get("print"); err == nil {
+		t.Error("Get() of an unknown set didn't fail")
+	}
+}
+
+func TestOutputImageSizeFingerprint(t *testing.T) {
+	size := OutputImageSize{Name: "small", LongEdge: 600, Quality: 80, Suffix: "_small", Extension: ".webp", Format: "webp", Crop: CROP_FIT}
+	fingerprint := size.Fingerprint()
+
+	// The name and content type don't change the derivative
+	renamed := size
+	renamed.Name = "medium"
+	renamed.ContentType = "image/webp"
+	if renamed.Fingerprint() != fingerprint {
+		t.Error("renaming a size changed its fingerprint")
+	}
+
+	changes := map[string]func(s *OutputImageSize){
+		"long edge": func(s *OutputImageSize) { s.LongEdge = 601 },
+		"quality":   func(s *OutputImageSize) { s.Quality = 81 },
+		"format":    func(s *OutputImageSize) { s.Format = "jpeg" },
+		"sharpen":   func(s *OutputImageSize) { s.Sharpen = true },
+		"crop":      func(s *OutputImageSize) { s.Crop = CROP_SMART },
+		"watermark": func(s *OutputImageSize) { s.Watermark = true },
+	}
+	for name, change := range changes {
+		changed := size
+		change(&changed)
+
+		if changed.Fingerprint() == fingerprint {
+			t.Errorf("changing the %s kept the fingerprint", name)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// Where a message is in the processing queue
+const (
+	QUEUE_STATE_PENDING   = "pending"   // Waiting to be received, possibly after a delay
+	QUEUE_STATE_IN_FLIGHT = "in-flight" // Received by a worker which hasn't finished it
+	QUEUE_STATE_DEAD      = "dead"      // Moved aside after it was received too many times
+)
+
+func IsValidQueueState(state string) bool {
+	return state == QUEUE_STATE_PENDING ||
+		state == QUEUE_STATE_IN_FLIGHT ||
+		state == QUEUE_STATE_DEAD
+}
+
+// A message in the processing queue, for administration
+type QueuedTask struct {
+	Id         string       `json:"id"`
+	State      string       `json:"state"`
+	Created    time.Time    `json:"created"`
+	Timeout    time.Time    `json:"timeout"` // When it can next be received
+	Received   int          `json:"received"`
+	Task       *ImageImport `json:"task,omitempty"`
+	ParseError string       `json:"parseError,omitempty"` // Set when the payload isn't a valid ImageImport
+}
@@ -1,11 +1,24 @@
 package models
 
+import "html/template"
+
+type PictureSource struct {
+	Type   string // The content type of the files in the srcset
+	SrcSet string
+}
+
 type ImageWithSrcSet struct {
-	ImageId       string
-	SrcSet        string
-	SmallImageUrl string // The public URL where the file is available
-	Width         uint64 // Width in pixels of the image file
-	Height        uint64 // Height in pixels of the image file
-	Title         string
-	Description   string
+	ImageId          string
+	SrcSet           string
+	Sources          []PictureSource
+	SmallImageUrl    string // The public URL where the file is available
+	FallbackImageUrl string // A JPEG, if generated, for clients without WebP support
+	Placeholder      template.URL
+	DominantColor    string
+	MediaType        string
+	VideoUrl         string // The web playable video, for videos and Live Photos
+	Width            uint64 // Width in pixels of the image file
+	Height           uint64 // Height in pixels of the image file
+	Title            string
+	Description      string
 }
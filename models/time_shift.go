@@ -0,0 +1,67 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// The format of local times, which have no offset
+const LOCAL_TIME_FORMAT = "2006-01-02T15:04:05"
+
+// Formats accepted for the known time of a reference image, which is the
+// wall-clock time where it was taken
+var referenceTimeLayouts = []string{
+	LOCAL_TIME_FORMAT,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+}
+
+// Selects the images a capture time correction applies to. Every criterion
+// which is set must match.
+type ImageSelection struct {
+	AlbumId       string `json:"albumId,omitempty" form:"albumId"`
+	ImportBatchId string `json:"importBatchId,omitempty" form:"importBatchId"`
+	SerialNumber  string `json:"serialNumber,omitempty" form:"serialNumber"`
+}
+
+func (s *ImageSelection) IsEmpty() bool {
+	return s.AlbumId == "" && s.ImportBatchId == "" && s.SerialNumber == ""
+}
+
+// Shifts the capture times of the selected images, either by an offset or by
+// the difference between a reference image and the time it was really taken
+type TimeShiftRequest struct {
+	ImageSelection
+
+	Offset           string `json:"offset,omitempty" form:"offset"` // A duration such as -1h30m
+	ReferenceImageId string `json:"referenceImageId,omitempty" form:"referenceImageId"`
+	ReferenceTime    string `json:"referenceTime,omitempty" form:"referenceTime"` // e.g. 2021-07-01T12:00:00
+
+	Apply          bool `json:"apply,omitempty" form:"apply"`                   // Otherwise only previewed
+	WriteOriginals bool `json:"writeOriginals,omitempty" form:"writeOriginals"` // Also write the times into the stored originals
+}
+
+// Parses the known local time of the reference image
+func ParseReferenceTime(value string) (time.Time, error) {
+	for _, layout := range referenceTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("reference time %s must be formatted as 2006-01-02T15:04:05", value)
+}
+
+// The capture time of an image before and after a shift
+type TimeShiftResult struct {
+	ImageId          string `json:"imageId"`
+	OriginalFilename string `json:"originalFilename"`
+	Before           string `json:"before"` // Local times
+	After            string `json:"after"`
+}
+
+// Moves the capture time by the delta, keeping its UTC offset
+func (img *Image) ShiftCaptureTime(delta time.Duration) {
+	img.DateTimeOriginal = img.DateTimeOriginal.Add(delta)
+	img.DateTimeLocal = img.DateTimeLocal.Add(delta)
+}
@@ -0,0 +1,52 @@
+package models
+
+import "fmt"
+
+// Corners, or the center, of a derivative where the watermark is placed
+const (
+	WATERMARK_TOP_LEFT     = "top-left"
+	WATERMARK_TOP_RIGHT    = "top-right"
+	WATERMARK_BOTTOM_LEFT  = "bottom-left"
+	WATERMARK_BOTTOM_RIGHT = "bottom-right"
+	WATERMARK_CENTER       = "center"
+)
+
+type WatermarkSettings struct {
+	Text     string // Rendered when no logo is configured
+	Logo     []byte // The contents of a PNG logo
+	Position string
+	Opacity  float32 // From 0 to 1
+	Scale    float64 // Width of the watermark, as a fraction of the long edge
+}
+
+// Fills in the defaults and checks the settings are usable
+func (w *WatermarkSettings) Normalize() error {
+	if w.Text == "" && len(w.Logo) == 0 {
+		return fmt.Errorf("watermark needs either text or a logo")
+	}
+
+	if w.Position == "" {
+		w.Position = WATERMARK_BOTTOM_RIGHT
+	}
+	switch w.Position {
+	case WATERMARK_TOP_LEFT, WATERMARK_TOP_RIGHT, WATERMARK_BOTTOM_LEFT, WATERMARK_BOTTOM_RIGHT, WATERMARK_CENTER:
+	default:
+		return fmt.Errorf("unknown watermark position %s", w.Position)
+	}
+
+	if w.Opacity == 0 {
+		w.Opacity = 0.5
+	}
+	if w.Opacity < 0 || w.Opacity > 1 {
+		return fmt.Errorf("watermark opacity must be between 0 and 1")
+	}
+
+	if w.Scale == 0 {
+		w.Scale = 0.2
+	}
+	if w.Scale < 0 || w.Scale > 1 {
+		return fmt.Errorf("watermark scale must be between 0 and 1")
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// The modes a process running workers can be started in
+const (
+	PROCESS_MODE_SERVE  = "serve"  // The web server, running workers alongside it
+	PROCESS_MODE_WORKER = "worker" // Only running workers
+)
+
+// Workers which haven't reported for this long are considered dead
+const WORKER_HEARTBEAT_TIMEOUT = time.Minute
+
+// Periodically reported by each process running workers, so the admin can see
+// which are alive
+type WorkerHeartbeat struct {
+	WorkerId string `gorm:"primarykey"`
+
+	Hostname    string
+	Pid         int
+	Mode        string
+	WorkerCount int
+	ActiveTasks int // Tasks being processed when it last reported
+	Processed   int // Tasks processed since it started
+
+	PeakMemoryBytes     int64 // Highest estimated memory used by decodes at once
+	VipsPeakMemoryBytes int64 // High-water mark of memory allocated by libvips
+
+	StartedAt time.Time
+	LastSeen  time.Time
+}
+
+func (h *WorkerHeartbeat) IsAlive() bool {
+	return time.Since(h.LastSeen) < WORKER_HEARTBEAT_TIMEOUT
+}
+
+func (h *WorkerHeartbeat) PeakMemoryMB() int64 {
+	return h.PeakMemoryBytes >> 20
+}
+
+func (h *WorkerHeartbeat) VipsPeakMemoryMB() int64 {
+	return h.VipsPeakMemoryBytes >> 20
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Tags with several values, such as keywords, are joined with this
+const LIST_TAG_SEPARATOR = ", "
+
+// The extension of XMP sidecars, which Lightroom writes next to RAW files
+const XMP_SIDECAR_EXTENSION = ".xmp"
+
+// Ratings range from rejected to five stars, with zero for unrated
+const (
+	RATING_REJECTED = -1
+	RATING_MAX      = 5
+)
+
+// The tags each descriptive field is read from, XMP before the IPTC tags
+// older software writes
+var (
+	titleTags   = []string{"Title", "ObjectName"}
+	captionTags = []string{"Description", "Caption-Abstract"}
+	keywordTags = []string{"Subject", "Keywords"}
+	ratingTags  = []string{"Rating"}
+	labelTags   = []string{"Label"}
+)
+
+func firstTagValue(tags map[string]string, tagNames []string) string {
+	for _, tagName := range tagNames {
+		if value := strings.TrimSpace(tags[tagName]); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Merges the keywords of every tag, without duplicates
+func parseKeywords(tags map[string]string, tagNames []string) string {
+	keywords := []string{}
+	seen := map[string]bool{}
+
+	for _, tagName := range tagNames {
+		for _, keyword := range strings.Split(tags[tagName], LIST_TAG_SEPARATOR) {
+			keyword = strings.TrimSpace(keyword)
+			if keyword == "" || seen[strings.ToLower(keyword)] {
+				continue
+			}
+
+			seen[strings.ToLower(keyword)] = true
+			keywords = append(keywords, keyword)
+		}
+	}
+
+	return strings.Join(keywords, LIST_TAG_SEPARATOR)
+}
+
+// Sets the title, caption, keywords, rating and label from the XMP or IPTC
+// tags which have a value, returning the fields changed. Fields without one
+// are kept, and each set of tags, such as a sidecar's, overrides the values
+// of those before it which it has.
+func PopulateImageFromXmp(img *Image, tagSets ...map[string]string) []string {
+	title, caption, keywords, label, rating := img.Title, img.Caption, img.Keywords, img.Label, img.Rating
+
+	for _, tags := range tagSets {
+		if value := firstTagValue(tags, titleTags); value != "" {
+			title = value
+		}
+		if value := firstTagValue(tags, captionTags); value != "" {
+			caption = value
+		}
+		if value := parseKeywords(tags, keywordTags); value != "" {
+			keywords = value
+		}
+		if value := firstTagValue(tags, labelTags); value != "" {
+			label = value
+		}
+
+		value, err := strconv.Atoi(firstTagValue(tags, ratingTags))
+		if err == nil && value >= RATING_REJECTED && value <= RATING_MAX {
+			rating = value
+		}
+	}
+
+	changed := []string{}
+	setString := func(field string, current *string, value string) {
+		if value != *current {
+			*current = value
+			changed = append(changed, field)
+		}
+	}
+
+	setString("Title", &img.Title, title)
+	setString("Caption", &img.Caption, caption)
+	setString("Keywords", &img.Keywords, keywords)
+	setString("Label", &img.Label, label)
+	if rating != img.Rating {
+		img.Rating = rating
+		changed = append(changed, "Rating")
+	}
+
+	return changed
+}
+
+// The descriptive tags of a sidecar are stored with the original's tags under
+// this prefix, as the sidecar itself isn't kept after the import
+const SIDECAR_TAG_PREFIX = "Sidecar:"
+
+// Adds the descriptive tags of a sidecar to the tags of its original
+func AddSidecarTags(tags map[string]string, sidecarTags map[string]string) {
+	for _, tagNames := range [][]string{titleTags, captionTags, keywordTags, ratingTags, labelTags} {
+		for _, tagName := range tagNames {
+			if value, ok := sidecarTags[tagName]; ok {
+				tags[SIDECAR_TAG_PREFIX+tagName] = value
+			}
+		}
+	}
+}
+
+// The sidecar tags stored by AddSidecarTags
+func SidecarTags(tags map[string]string) map[string]string {
+	sidecarTags := map[string]string{}
+	for name, value := range tags {
+		if strings.HasPrefix(name, SIDECAR_TAG_PREFIX) {
+			sidecarTags[strings.TrimPrefix(name, SIDECAR_TAG_PREFIX)] = value
+		}
+	}
+	return sidecarTags
+}
+
+// The keywords as a list
+func (img *Image) KeywordList() []string {
+	if img.Keywords == "" {
+		return []string{}
+	}
+	return strings.Split(img.Keywords, LIST_TAG_SEPARATOR)
+}
+
+func IsXmpSidecar(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), XMP_SIDECAR_EXTENSION)
+}
@@ -0,0 +1,212 @@
+package process
+
+import (
+	"context"
+	"log"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+
+	. "github.com/eburlingame/fstop/resources"
+
+	"github.com/h2non/bimg"
+)
+
+// libvips works on 8-bit RGBA buffers, with the output held alongside the
+// input while an operation runs
+const DECODE_BYTES_PER_PIXEL = 4 * 2
+
+// Estimates the memory needed to decode an image of the given dimensions
+func estimateDecodeMemory(width int, height int) int64 {
+	return int64(width) * int64(height) * DECODE_BYTES_PER_PIXEL
+}
+
+// Limits the memory used by decodes across all workers, and how many run at
+// once. Decodes larger than the whole budget wait until they can run alone.
+type processingBudget struct {
+	mu       sync.Mutex
+	released chan struct{} // Closed and replaced whenever a decode finishes
+
+	maxBytes   int64
+	maxDecodes int
+
+	usedBytes int64
+	decodes   int
+
+	peakBytes   int64
+	peakDecodes int
+	totalWaits  int64
+	totalWait   time.Duration
+}
+
+func newProcessingBudget(maxBytes int64, maxDecodes int) *processingBudget {
+	return &processingBudget{
+		released:   make(chan struct{}),
+		maxBytes:   maxBytes,
+		maxDecodes: maxDecodes,
+	}
+}
+
+var budget = newProcessingBudget(DEFAULT_PROCESSING_MEMORY_MB<<20, runtime.NumCPU())
+
+// Waits until the decode fits in the budget, returning the bytes reserved to
+// pass to release
+func (b *processingBudget) acquire(ctx context.Context, bytes int64) (int64, error) {
+	started := time.Now()
+	waited := false
+
+	for {
+		b.mu.Lock()
+		if bytes > b.maxBytes {
+			bytes = b.maxBytes
+		}
+
+		if b.usedBytes+bytes <= b.maxBytes && b.decodes < b.maxDecodes {
+			b.usedBytes += bytes
+			b.decodes++
+
+			if b.usedBytes > b.peakBytes {
+				b.peakBytes = b.usedBytes
+			}
+			if b.decodes > b.peakDecodes {
+				b.peakDecodes = b.decodes
+			}
+			if waited {
+				b.totalWaits++
+				b.totalWait += time.Since(started)
+			}
+
+			b.mu.Unlock()
+			return bytes, nil
+		}
+
+		released := b.released
+		b.mu.Unlock()
+
+		waited = true
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+func (b *processingBudget) release(bytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.usedBytes -= bytes
+	b.decodes--
+
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+func withReservedMemory(ctx context.Context, bytes int64, f func() error) error {
+	reserved, err := budget.acquire(ctx, bytes)
+	if err != nil {
+		return err
+	}
+	defer budget.release(reserved)
+
+	return f()
+}
+
+// Runs a decode of an image with the given dimensions within the budget
+func withDecodeBudget(ctx context.Context, width int, height int, f func() error) error {
+	return withReservedMemory(ctx, estimateDecodeMemory(width, height), f)
+}
+
+// Runs a decode which can't be estimated alone, waiting for every other
+// decode to finish and holding the whole budget while it runs
+func withWholeBudget(ctx context.Context, f func() error) error {
+	return withReservedMemory(ctx, math.MaxInt64, f)
+}
+
+// Runs a decode of an encoded image within the budget. The size of images
+// libvips can't read, such as HEIC files converted with heif-convert, is
+// unknown, so their decodes run alone rather than risk exceeding the budget.
+func withBufferDecodeBudget(ctx context.Context, file []byte, f func() error) error {
+	size, err := bimg.Size(file)
+	if err != nil {
+		log.Printf("Image size is unknown, decoding it alone: %s\n", err)
+		return withWholeBudget(ctx, f)
+	}
+
+	return withDecodeBudget(ctx, size.Width, size.Height, f)
+}
+
+// Applies the processing limits, libvips cache and exiftool pool settings
+// from the config
+func ConfigureProcessing(config *Configuration) {
+	budget.mu.Lock()
+	budget.maxBytes = int64(config.ProcessingMemoryMB) << 20
+	budget.maxDecodes = config.MaxConcurrentDecodes
+	budget.mu.Unlock()
+
+	// Every image is decoded once, so caching operations only holds memory
+	bimg.VipsCacheSetMaxMem(config.VipsCacheMB << 20)
+	if config.VipsCacheMB == 0 {
+		bimg.VipsCacheSetMax(0)
+	}
+
+	exiftools = newExiftoolPool(config.ExiftoolPoolSize)
+
+	log.Printf(
+		"Processing budget: %d MB, %d concurrent decodes, %d MB libvips cache, %d exiftool processes\n",
+		config.ProcessingMemoryMB, config.MaxConcurrentDecodes, config.VipsCacheMB, config.ExiftoolPoolSize,
+	)
+}
+
+// Stops the helper processes kept running for processing
+func ShutdownProcessing() {
+	exiftools.close()
+}
+
+// Memory used by image processing in this process
+type ProcessingMetrics struct {
+	BudgetBytes     int64  `json:"budgetBytes"`
+	UsedBytes       int64  `json:"usedBytes"` // Estimated memory of the decodes running
+	PeakBytes       int64  `json:"peakBytes"` // Highest estimate since the process started
+	MaxDecodes      int    `json:"maxDecodes"`
+	Decodes         int    `json:"decodes"`
+	PeakDecodes     int    `json:"peakDecodes"`
+	Waits           int64  `json:"waits"` // Decodes which had to wait for the budget
+	AverageWaitMs   int64  `json:"averageWaitMs"`
+	VipsMemory      int64  `json:"vipsMemory"`     // Allocated by libvips
+	VipsPeakMemory  int64  `json:"vipsPeakMemory"` // libvips high-water mark
+	VipsAllocations int64  `json:"vipsAllocations"`
+	HeapBytes       uint64 `json:"heapBytes"`   // Go heap in use
+	SystemBytes     uint64 `json:"systemBytes"` // Obtained from the OS by the Go runtime
+}
+
+func GetProcessingMetrics() ProcessingMetrics {
+	budget.mu.Lock()
+	metrics := ProcessingMetrics{
+		BudgetBytes: budget.maxBytes,
+		UsedBytes:   budget.usedBytes,
+		PeakBytes:   budget.peakBytes,
+		MaxDecodes:  budget.maxDecodes,
+		Decodes:     budget.decodes,
+		PeakDecodes: budget.peakDecodes,
+		Waits:       budget.totalWaits,
+	}
+	if budget.totalWaits > 0 {
+		metrics.AverageWaitMs = (budget.totalWait / time.Duration(budget.totalWaits)).Milliseconds()
+	}
+	budget.mu.Unlock()
+
+	vips := bimg.VipsMemory()
+	metrics.VipsMemory = vips.Memory
+	metrics.VipsPeakMemory = vips.MemoryHighwater
+	metrics.VipsAllocations = vips.Allocations
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	metrics.HeapBytes = mem.HeapAlloc
+	metrics.SystemBytes = mem.Sys
+
+	return metrics
+}
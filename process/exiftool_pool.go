@@ -0,0 +1,314 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/eburlingame/fstop/models"
+
+	"github.com/barasher/go-exiftool"
+)
+
+// Commands taking longer than this are assumed to have hung, and their
+// process is killed
+const EXIFTOOL_TIMEOUT = time.Minute
+
+// A long-lived exiftool process, which reads its commands from stdin
+type exiftoolProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.Reader
+
+	// Numbers the commands, so each ends with its own ready token
+	commands int
+}
+
+func startExiftool() (*exiftoolProcess, error) {
+	cmd := exec.Command("exiftool", "-stay_open", "True", "-@", "-")
+	cmd.Stderr = ioutil.Discard
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &exiftoolProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}, nil
+}
+
+// Output ends with a token numbered after the command once it has finished.
+// Binary output, such as an embedded preview, isn't split into lines and has
+// no newline before the token, so the output is read until it ends with it.
+func (e *exiftoolProcess) run(args []string) ([]byte, error) {
+	e.commands++
+	execute := fmt.Sprintf("-execute%d", e.commands)
+	readyToken := []byte(fmt.Sprintf("{ready%d}\n", e.commands))
+
+	for _, arg := range append(args, execute) {
+		if _, err := fmt.Fprintln(e.stdin, arg); err != nil {
+			return nil, fmt.Errorf("writing to exiftool: %s", err)
+		}
+	}
+
+	output := []byte{}
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := e.stdout.Read(buffer)
+		output = append(output, buffer[:n]...)
+
+		if bytes.HasSuffix(output, readyToken) {
+			return output[:len(output)-len(readyToken)], nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading from exiftool: %s", err)
+		}
+	}
+}
+
+// Runs a command and returns what it printed. The process is killed if the
+// command is cancelled or hangs, and can't be used again after any error.
+func (e *exiftoolProcess) execute(ctx context.Context, args ...string) ([]byte, error) {
+	type result struct {
+		output []byte
+		err    error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		output, err := e.run(args)
+		done <- result{output, err}
+	}()
+
+	timeout := time.NewTimer(EXIFTOOL_TIMEOUT)
+	defer timeout.Stop()
+
+	select {
+	case res := <-done:
+		return res.output, res.err
+	case <-ctx.Done():
+		e.kill()
+		return nil, ctx.Err()
+	case <-timeout.C:
+		e.kill()
+		return nil, fmt.Errorf("exiftool timed out after %s", EXIFTOOL_TIMEOUT)
+	}
+}
+
+// Killing the process closes its stdout, which ends a command waiting on it
+func (e *exiftoolProcess) kill() {
+	e.cmd.Process.Kill()
+	go e.cmd.Wait()
+}
+
+func (e *exiftoolProcess) close() {
+	fmt.Fprintln(e.stdin, "-stay_open")
+	fmt.Fprintln(e.stdin, "False")
+	e.stdin.Close()
+	go e.cmd.Wait()
+}
+
+// A pool of exiftool processes shared by the workers, so a Perl process isn't
+// started for every file. Processes are started when first needed and
+// replaced when they fail.
+type exiftoolPool struct {
+	// Idle processes, with nil standing in for one which hasn't been started
+	instances chan *exiftoolProcess
+}
+
+func newExiftoolPool(size int) *exiftoolPool {
+	pool := &exiftoolPool{
+		instances: make(chan *exiftoolProcess, size),
+	}
+
+	for i := 0; i < size; i++ {
+		pool.instances <- nil
+	}
+
+	return pool
+}
+
+var exiftools = newExiftoolPool(1)
+
+func (p *exiftoolPool) get(ctx context.Context) (*exiftoolProcess, error) {
+	var et *exiftoolProcess
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case et = <-p.instances:
+	}
+
+	if et != nil {
+		return et, nil
+	}
+
+	et, err := startExiftool()
+	if err != nil {
+		p.instances <- nil
+		return nil, fmt.Errorf("starting exiftool: %s", err)
+	}
+
+	return et, nil
+}
+
+// Runs a command on an idle process, retrying once on a new process if the
+// one used failed
+func (p *exiftoolPool) execute(ctx context.Context, args ...string) ([]byte, error) {
+	var lastErr error
+
+	for attempt := 0; attempt < 2 && ctx.Err() == nil; attempt++ {
+		et, err := p.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		output, err := et.execute(ctx, args...)
+		if err == nil {
+			p.instances <- et
+			return output, nil
+		}
+
+		log.Printf("exiftool failed, restarting it: %s\n", err)
+		et.kill()
+		p.instances <- nil
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return nil, lastErr
+}
+
+// Runs a command which changes files, failing if exiftool reports an error.
+// Errors are only printed to stderr, so the command's exit status is echoed.
+func (p *exiftoolPool) write(ctx context.Context, args ...string) error {
+	output, err := p.execute(ctx, append(args, "-echo3", "${status}")...)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	status, err := strconv.Atoi(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil {
+		return fmt.Errorf("unexpected exiftool output: %s", output)
+	}
+	if status != 0 {
+		return fmt.Errorf("exiftool exited with status %d", status)
+	}
+
+	return nil
+}
+
+// Extracts the binary value of a tag, such as an embedded preview, which is
+// empty if the file doesn't have it
+func (p *exiftoolPool) extractBinary(ctx context.Context, localPath string, tagName string) ([]byte, error) {
+	if _, err := os.Stat(localPath); err != nil {
+		return nil, err
+	}
+
+	return p.execute(ctx, "-b", "-"+tagName, localPath)
+}
+
+// Runs exiftool with JSON output on a single file
+func (p *exiftoolPool) extractMetadata(ctx context.Context, localPath string, args ...string) (*exiftool.FileMetadata, error) {
+	// exiftool only reports missing files on stderr
+	if _, err := os.Stat(localPath); err != nil {
+		return nil, err
+	}
+
+	output, err := p.execute(ctx, append(append([]string{"-j"}, args...), localPath)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []map[string]interface{}
+	if err := json.Unmarshal(output, &fields); err != nil {
+		return nil, fmt.Errorf("parsing exiftool output: %s", err)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("exiftool returned no metadata for %s", localPath)
+	}
+
+	return &exiftool.FileMetadata{File: localPath, Fields: fields[0]}, nil
+}
+
+// Extracts every tag of a file, formatted as strings with lists joined
+func (p *exiftoolPool) extract(ctx context.Context, localPath string) (map[string]string, error) {
+	metadata, err := p.extractMetadata(ctx, localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	valueMap := map[string]string{}
+	for tagName, value := range metadata.Fields {
+		if _, isList := value.([]interface{}); isList {
+			values, _ := metadata.GetStrings(tagName)
+			valueMap[tagName] = strings.Join(values, LIST_TAG_SEPARATOR)
+			continue
+		}
+		valueMap[tagName], _ = metadata.GetString(tagName)
+	}
+
+	return valueMap, nil
+}
+
+// Extracts the given tags of a file as numbers, leaving out those which are
+// missing or not numeric
+func (p *exiftoolPool) extractNumeric(ctx context.Context, localPath string, tagNames ...string) (map[string]float64, error) {
+	args := []string{"-n"}
+	for _, tagName := range tagNames {
+		args = append(args, "-"+tagName)
+	}
+
+	metadata, err := p.extractMetadata(ctx, localPath, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]float64{}
+	for _, tagName := range tagNames {
+		if value, err := metadata.GetFloat(tagName); err == nil {
+			values[tagName] = value
+		}
+	}
+
+	return values, nil
+}
+
+// Stops the idle processes. Any still in use exit along with this process,
+// when their stdin is closed.
+func (p *exiftoolPool) close() {
+	for {
+		select {
+		case et := <-p.instances:
+			if et != nil {
+				et.close()
+			}
+		default:
+			return
+		}
+	}
+}
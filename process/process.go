@@ -1,55 +1,240 @@
 package process
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"sync"
 
 	. "github.com/eburlingame/fstop/models"
 	. "github.com/eburlingame/fstop/resources"
+	. "github.com/eburlingame/fstop/utils"
 )
 
-func ProcessImageImport(r *Resources, image ImageImport) {
+// Returns the buffer used to produce every rendition of the original. RAW and
+// HEIC files libvips can't decode are kept as the original, with renditions
+// derived from a JPEG converted from them. Videos use a poster frame.
+func getRendition(ctx context.Context, image *ImageImport, file []byte) ([]byte, error) {
+	format := FormatFromExtension(GetExtension(image.OriginalFileKey))
+
+	if IsVideoFormat(format) {
+		log.Printf("Extracting video poster frame, imageId: %s\n", image.ImageId)
+		return ExtractVideoPoster(ctx, image, file)
+	}
+
+	if IsRawFormat(format) {
+		log.Printf("Extracting RAW preview, imageId: %s\n", image.ImageId)
+		return ExtractRawRendition(ctx, image, file)
+	}
+
+	if IsHeifFormat(format) {
+		return ConvertHeifRendition(ctx, image, file)
+	}
+
+	return file, nil
+}
+
+// Collects the errors of the steps of a task, which run concurrently
+type stepErrors struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+// Runs a step, recording its error or panic
+func (s *stepErrors) run(step string, f func() error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("Recovered from panic in ProcessImageImport", r)
+			s.add(step, fmt.Errorf("panic: %v", r))
+		}
+	}()
+
+	if err := f(); err != nil {
+		s.add(step, err)
+	}
+}
+
+func (s *stepErrors) add(step string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Printf("Error processing %s: %s\n", step, err)
+	s.messages = append(s.messages, fmt.Sprintf("%s: %s", step, err))
+}
+
+func (s *stepErrors) err() error {
+	if len(s.messages) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(s.messages, "; "))
+}
+
+// Processes a task, returning an error if any of its steps failed. Uploads
+// are only removed once everything succeeded, so the task can be retried.
+// Cancelling the context aborts uploads and transcodes in progress.
+func ProcessImageImport(ctx context.Context, r *Resources, image ImageImport) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Println("Recovered from panic in ProcessImageImport", recovered)
+			err = fmt.Errorf("panic: %v", recovered)
 		}
 	}()
 
 	log.Printf("Processing image %s\n", image.OriginalFileKey)
 
 	wg := new(sync.WaitGroup)
+	steps := &stepErrors{}
 
-	fileContents, err := r.Storage.GetFile(image.OriginalFileKey)
-	if err != nil || len(fileContents) == 0 {
-		log.Printf("Error getting image from storage: %s\n", err)
-		return
+	fileContents, err := r.Storage.GetFile(ctx, image.OriginalFileKey)
+	if err != nil {
+		return fmt.Errorf("getting original from storage: %s", err)
+	}
+	if len(fileContents) == 0 {
+		return fmt.Errorf("original %s is empty", image.OriginalFileKey)
+	}
+
+	// Renditions are derived from the scrubbed file so derivatives don't carry
+	// the removed metadata, while the database is populated from the original
+	scrubbed, policy, err := ScrubMetadata(ctx, r, &image, image.PrivacyPolicy, image.OriginalFileKey, fileContents)
+	if err != nil {
+		return fmt.Errorf("scrubbing metadata: %s", err)
+	}
+	image.PrivacyPolicy = policy
+
+	rendition, err := getRendition(ctx, &image, scrubbed)
+	if err != nil {
+		return fmt.Errorf("decoding original: %s", err)
+	}
+
+	if image.Edit != nil && !image.Edit.IsIdentity() {
+		log.Printf("Applying image edit, imageId: %s\n", image.ImageId)
+
+		width, height, err := getImageSize(rendition)
+		if err != nil {
+			return fmt.Errorf("reading rendition size: %s", err)
+		}
+
+		err = withDecodeBudget(ctx, width, height, func() error {
+			rendition, err = ApplyImageEdit(rendition, image.Edit)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("applying image edit: %s", err)
+		}
 	}
 
 	if image.InitialImport {
 		wg.Add(1)
 		log.Printf("Processing image metadata, imageId: %s\n", image.ImageId)
-		go ProcessImageMeta(r, wg, &image, fileContents)
+		go steps.run("metadata", func() error {
+			return ProcessImageMeta(ctx, r, wg, &image, fileContents, rendition)
+		})
 
 		wg.Add(1)
 		log.Printf("Processing image original, imageId: %s\n", image.ImageId)
-		go ProcessImageOriginal(r, wg, &image, fileContents)
+		go steps.run("original", func() error {
+			return ProcessImageOriginal(ctx, r, wg, &image, scrubbed, rendition)
+		})
+
+		if IsVideoFormat(FormatFromExtension(GetExtension(image.OriginalFileKey))) {
+			wg.Add(1)
+			log.Printf("Processing video transcode, imageId: %s\n", image.ImageId)
+			go steps.run("video transcode", func() error {
+				return ProcessVideoTranscode(ctx, r, wg, &image, scrubbed, rendition)
+			})
+		}
+
+		if image.PairedVideoKey != "" {
+			wg.Add(1)
+			log.Printf("Processing Live Photo motion, imageId: %s\n", image.ImageId)
+			go steps.run("Live Photo motion", func() error {
+				return ProcessLivePhotoMotion(ctx, r, wg, &image, rendition)
+			})
+		}
+	}
+
+	// Originals imported under a less strict policy are replaced
+	if !image.InitialImport && image.PrivacyPolicy != PRIVACY_KEEP {
+		wg.Add(1)
+		log.Printf("Processing original privacy, imageId: %s\n", image.ImageId)
+		go steps.run("original privacy", func() error {
+			return ProcessOriginalPrivacy(ctx, r, wg, &image, scrubbed)
+		})
+	}
+
+	// Edits change the dimensions, and resetting one restores them
+	if !image.InitialImport {
+		width, height, err := getImageSize(rendition)
+		if err == nil {
+			r.Db.UpdateImageDimensions(image.ImageId, width, height)
+		}
+	}
+
+	if image.GeneratePlaceholder && !image.InitialImport {
+		wg.Add(1)
+		log.Printf("Processing image placeholder, imageId: %s\n", image.ImageId)
+		go steps.run("placeholder", func() error {
+			return ProcessImagePlaceholder(ctx, r, wg, &image, rendition)
+		})
+	}
+
+	// Smaller sizes are derived from a shared downscaled copy instead of each
+	// decoding the full rendition
+	resizeSource, err := createResizeIntermediate(ctx, rendition, image.Sizes)
+	if err != nil {
+		log.Printf("Error creating resize intermediate, resizing from the rendition: %s\n", err)
+		resizeSource = rendition
 	}
 
+	// Limits the resizes of this task, so it doesn't take every decode slot from
+	// the other workers. Each resize also waits for the processing budget,
+	// which is shared by all workers, so at most the smaller of
+	// RESIZE_PARALLELISM and MAX_CONCURRENT_DECODES run at once.
+	resizeSlots := make(chan struct{}, r.Config.ResizeParallelism)
+
 	wg.Add(len(image.Sizes))
 	log.Printf("Processing image resizes, imageId: %s\n", image.ImageId)
 	for _, size := range image.Sizes {
-		go ProcessImageResize(r, wg, &image, size, fileContents)
+		size := size
+		go steps.run("resize "+size.Name, func() error {
+			resizeSlots <- struct{}{}
+			defer func() { <-resizeSlots }()
+
+			return ProcessImageResize(ctx, r, wg, &image, size, resizeSource)
+		})
 	}
 
 	wg.Wait()
 
-	log.Printf("Updating processed status, imageId: %s\n", image.ImageId)
-	r.Db.UpdateImageProcessedStatus(image.ImageId, true)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := steps.err(); err != nil {
+		return err
+	}
+
+	if err := removeStaleDerivatives(ctx, r, &image); err != nil {
+		log.Printf("Error removing stale derivatives: %s\n", err)
+		return err
+	}
 
 	if image.InitialImport {
 		log.Printf("Removing %s from upload directory.\n", image.OriginalFileKey)
-		r.Storage.DeleteFile(image.OriginalFileKey)
+		r.Storage.DeleteFile(ctx, image.OriginalFileKey)
+
+		if image.PairedVideoKey != "" {
+			log.Printf("Removing %s from upload directory.\n", image.PairedVideoKey)
+			r.Storage.DeleteFile(ctx, image.PairedVideoKey)
+		}
+
+		if image.SidecarKey != "" {
+			log.Printf("Removing %s from upload directory.\n", image.SidecarKey)
+			r.Storage.DeleteFile(ctx, image.SidecarKey)
+		}
 	}
 
 	log.Printf("Import of %s complete.\n", image.OriginalFileKey)
+
+	return nil
 }
@@ -0,0 +1,90 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/resources"
+	. "github.com/eburlingame/fstop/utils"
+)
+
+// The format exiftool writes dates in
+const EXIF_TIMESTAMP_FORMAT = "2006:01:02 15:04:05"
+
+// The exiftool arguments which set the capture time of a file. QuickTime
+// dates are in UTC, while EXIF dates are local with a separate offset.
+func getCaptureTimeArgs(image *Image, format string) []string {
+	local := image.DateTimeLocal.Format(EXIF_TIMESTAMP_FORMAT)
+
+	if IsVideoFormat(format) {
+		utc := image.DateTimeOriginal.UTC().Format(EXIF_TIMESTAMP_FORMAT)
+		return []string{
+			"-QuickTime:CreateDate=" + utc,
+			"-QuickTime:MediaCreateDate=" + utc,
+			"-Keys:CreationDate=" + local + image.UtcOffset,
+		}
+	}
+
+	args := []string{
+		"-DateTimeOriginal=" + local,
+		"-CreateDate=" + local,
+	}
+
+	// An offset assumed from the default timezone isn't recorded
+	if image.UtcOffsetSource != OFFSET_SOURCE_DEFAULT {
+		args = append(args, "-OffsetTimeOriginal="+image.UtcOffset)
+	}
+
+	return args
+}
+
+// Writes the corrected capture time of an image into its stored original, so
+// the correction is kept if the metadata is read from it again
+func WriteCaptureTime(ctx context.Context, r *Resources, task ImageImport) error {
+	var image Image
+	r.Db.GetImage(&image, task.ImageId)
+	if image.ImageId == "" {
+		return fmt.Errorf("image %s doesn't exist", task.ImageId)
+	}
+	if image.DateUnknown {
+		return fmt.Errorf("image %s has no capture time to write", task.ImageId)
+	}
+
+	file, err := r.Storage.GetFile(ctx, task.OriginalFileKey)
+	if err != nil {
+		return fmt.Errorf("getting original from storage: %s", err)
+	}
+
+	tempPath, err := writeExifTempFile(&task, task.OriginalFileKey, file)
+	if err != nil {
+		return fmt.Errorf("writing temporary file: %s", err)
+	}
+	defer os.Remove(tempPath)
+
+	format := FormatFromExtension(GetExtension(task.OriginalFileKey))
+
+	args := append([]string{"-overwrite_original"}, getCaptureTimeArgs(&image, format)...)
+	if err := exiftools.write(ctx, append(args, tempPath)...); err != nil {
+		return fmt.Errorf("writing capture time to %s: %s", task.OriginalFileKey, err)
+	}
+
+	updated, err := ioutil.ReadFile(tempPath)
+	if err != nil {
+		return err
+	}
+
+	err = r.Storage.PutFile(ctx, updated, task.OriginalFileKey, getOriginalContentType(format, updated))
+	if err != nil {
+		return fmt.Errorf("uploading original: %s", err)
+	}
+
+	log.Printf("Wrote capture time %s%s to %s\n", image.DateTimeLocal.Format(EXIF_TIMESTAMP_FORMAT), image.UtcOffset, task.OriginalFileKey)
+
+	// The original now holds the correction
+	image.CaptureTimeShift = 0
+	return r.Db.UpdateImageFields(&image, []string{"CaptureTimeShift"})
+}
@@ -0,0 +1,293 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"math"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/resources"
+
+	"github.com/h2non/bimg"
+)
+
+// Edited renditions are only an intermediate, so they're kept at a high quality
+const EDIT_QUALITY = 95
+
+// Previews on the edit page are rendered at this size
+const EDIT_PREVIEW_LONG_EDGE = 1080
+
+func getRotationAngle(rotation int) bimg.Angle {
+	switch rotation {
+	case 90:
+		return bimg.D90
+	case 180:
+		return bimg.D180
+	case 270:
+		return bimg.D270
+	default:
+		return bimg.D0
+	}
+}
+
+func decodeEditImage(file []byte) (*image.RGBA, error) {
+	decoded, err := jpeg.Decode(bytes.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+
+	rgba := image.NewRGBA(decoded.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+
+	return rgba, nil
+}
+
+func encodeEditImage(img image.Image) ([]byte, error) {
+	var output bytes.Buffer
+
+	err := jpeg.Encode(&output, img, &jpeg.Options{Quality: EDIT_QUALITY})
+	if err != nil {
+		return nil, err
+	}
+
+	return output.Bytes(), nil
+}
+
+// Samples a pixel between the four surrounding it, clamped to the image to
+// allow for rounding at the edges of the straightened crop
+func sampleBilinear(img *image.RGBA, x float64, y float64) [4]uint8 {
+	bounds := img.Bounds()
+	x = math.Max(0, math.Min(float64(bounds.Dx()-1), x))
+	y = math.Max(0, math.Min(float64(bounds.Dy()-1), y))
+
+	x0, y0 := int(x), int(y)
+	x1, y1 := x0+1, y0+1
+	if x1 >= bounds.Dx() {
+		x1 = x0
+	}
+	if y1 >= bounds.Dy() {
+		y1 = y0
+	}
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	var result [4]uint8
+	for c := 0; c < 4; c++ {
+		p00 := float64(img.Pix[img.PixOffset(x0, y0)+c])
+		p10 := float64(img.Pix[img.PixOffset(x1, y0)+c])
+		p01 := float64(img.Pix[img.PixOffset(x0, y1)+c])
+		p11 := float64(img.Pix[img.PixOffset(x1, y1)+c])
+
+		top := p00 + (p10-p00)*fx
+		bottom := p01 + (p11-p01)*fx
+		result[c] = uint8(math.Round(top + (bottom-top)*fy))
+	}
+
+	return result
+}
+
+// Rotates the image clockwise by a small angle, cropped to the largest
+// rectangle with the original aspect ratio that has no empty corners
+func straightenImage(file []byte, degrees float64) ([]byte, error) {
+	src, err := decodeEditImage(file)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := float64(src.Bounds().Dx()), float64(src.Bounds().Dy())
+	theta := degrees * math.Pi / 180
+	cos, sin := math.Cos(theta), math.Abs(math.Sin(theta))
+
+	// The rotated crop must fit within the original on both axes
+	scale := math.Min(
+		width/(width*cos+height*sin),
+		height/(width*sin+height*cos),
+	)
+
+	outWidth, outHeight := int(width*scale), int(height*scale)
+	dst := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+
+	sinSigned := math.Sin(theta)
+	centerX, centerY := (width-1)/2, (height-1)/2
+	outCenterX, outCenterY := float64(outWidth-1)/2, float64(outHeight-1)/2
+
+	for y := 0; y < outHeight; y++ {
+		dy := float64(y) - outCenterY
+
+		for x := 0; x < outWidth; x++ {
+			dx := float64(x) - outCenterX
+
+			// Map back into the original by rotating the other way
+			srcX := centerX + dx*cos + dy*sinSigned
+			srcY := centerY - dx*sinSigned + dy*cos
+
+			pixel := sampleBilinear(src, srcX, srcY)
+			offset := dst.PixOffset(x, y)
+			copy(dst.Pix[offset:offset+4], pixel[:])
+		}
+	}
+
+	return encodeEditImage(dst)
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func clampUnit(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// Builds a lookup table which scales the exposure in linear light, then
+// stretches the contrast around middle grey
+func getToneCurve(exposure float64, contrast float64) [256]uint8 {
+	var curve [256]uint8
+	gain := math.Pow(2, exposure)
+
+	for i := range curve {
+		v := linearToSrgb(clampUnit(srgbToLinear(float64(i)/255) * gain))
+		v = clampUnit((v-0.5)*(1+contrast) + 0.5)
+		curve[i] = uint8(math.Round(v * 255))
+	}
+
+	return curve
+}
+
+func adjustTone(file []byte, exposure float64, contrast float64) ([]byte, error) {
+	img, err := decodeEditImage(file)
+	if err != nil {
+		return nil, err
+	}
+
+	curve := getToneCurve(exposure, contrast)
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = curve[img.Pix[i]]
+		img.Pix[i+1] = curve[img.Pix[i+1]]
+		img.Pix[i+2] = curve[img.Pix[i+2]]
+	}
+
+	return encodeEditImage(img)
+}
+
+func cropImage(file []byte, edit *ImageEdit) ([]byte, error) {
+	size, err := bimg.Size(file)
+	if err != nil {
+		return nil, err
+	}
+
+	left, top, width, height := edit.CropArea(size.Width, size.Height)
+
+	return bimg.NewImage(file).Process(bimg.Options{
+		Type:         bimg.JPEG,
+		Quality:      EDIT_QUALITY,
+		NoAutoRotate: true,
+		Left:         left,
+		Top:          top,
+		AreaWidth:    width,
+		AreaHeight:   height,
+	})
+}
+
+// Applies an edit recipe to a rendition, returning an upright sRGB JPEG
+func ApplyImageEdit(file []byte, edit *ImageEdit) ([]byte, error) {
+	// Bake in the EXIF orientation, so the edit is relative to the image as
+	// it's displayed. bimg ignores the orientation when rotating explicitly.
+	output, err := bimg.NewImage(file).AutoRotate()
+	if err != nil {
+		return nil, err
+	}
+
+	// Converted to sRGB, as the profile is lost when decoding in Go
+	output, err = bimg.NewImage(output).Process(bimg.Options{
+		Type:         bimg.JPEG,
+		Quality:      EDIT_QUALITY,
+		NoAutoRotate: true,
+		Rotate:       getRotationAngle(edit.Rotation),
+		OutputICC:    SRGB_PROFILE,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if edit.Straighten != 0 {
+		output, err = straightenImage(output, edit.Straighten)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if edit.HasCrop() {
+		output, err = cropImage(output, edit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Done last, when the crop has reduced the pixels to adjust
+	if edit.HasToneAdjustment() {
+		output, err = adjustTone(output, edit.Exposure, edit.Contrast)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return output, nil
+}
+
+// Renders a small preview of an edit from the untouched original. The crop is
+// relative, so the rendition can be downscaled before it's edited.
+func RenderEditPreview(ctx context.Context, r *Resources, original *File, edit *ImageEdit) ([]byte, error) {
+	fileContents, err := r.Storage.GetFile(ctx, original.StoragePath)
+	if err != nil {
+		return nil, err
+	}
+
+	task := ImageImport{
+		ImageId:         original.ImageId,
+		OriginalFileKey: original.StoragePath,
+	}
+
+	rendition, err := getRendition(ctx, &task, fileContents)
+	if err != nil {
+		return nil, err
+	}
+
+	// The full resolution rendition is decoded twice, like a worker's
+	// resizes, so it waits for the same budget
+	var preview []byte
+	err = withBufferDecodeBudget(ctx, rendition, func() error {
+		rotated, err := bimg.NewImage(rendition).AutoRotate()
+		if err != nil {
+			return err
+		}
+
+		width, height, err := getImageSize(rotated)
+		if err != nil {
+			return err
+		}
+
+		previewSize := OutputImageSize{LongEdge: EDIT_PREVIEW_LONG_EDGE, Format: "jpeg", Quality: EDIT_QUALITY}
+		width, height = getOutputDimensions(width, height, previewSize)
+
+		preview, err = bimg.NewImage(rotated).Process(getResizeOptions(previewSize, width, height))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ApplyImageEdit(preview, edit)
+}
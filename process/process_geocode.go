@@ -0,0 +1,66 @@
+package process
+
+import (
+	"fmt"
+	"log"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/resources"
+)
+
+// Names where an imported image was taken from its location. Images imported
+// before the numeric coordinates were stored have them filled in from their
+// GPSPosition. Images whose policy removes the location have it cleared
+// instead, and those within a geofence aren't named.
+func GeocodeImage(r *Resources, task ImageImport) error {
+	if r.Geocoder == nil {
+		return fmt.Errorf("reverse geocoding isn't configured")
+	}
+
+	var image Image
+	r.Db.GetImage(&image, task.ImageId)
+	if image.ImageId == "" {
+		return fmt.Errorf("image %s doesn't exist", task.ImageId)
+	}
+
+	changed := []string{}
+
+	if task.PrivacyPolicy == PRIVACY_STRIP_GPS || task.PrivacyPolicy == PRIVACY_STRIP_ALL {
+		changed = append(changed, image.ClearLocation()...)
+		log.Printf("Removed the location of image %s, as its policy is %s\n", task.ImageId, task.PrivacyPolicy)
+
+		return updateGeocodedImage(r, &task, &image, changed)
+	}
+
+	if image.Latitude == nil || image.Longitude == nil {
+		if latitude, longitude, ok := ParseGPSPosition(image.GPSPosition); ok {
+			image.Latitude = &latitude
+			image.Longitude = &longitude
+			changed = append(changed, "Latitude", "Longitude")
+		}
+	}
+
+	latitude, longitude, ok := image.Coordinates()
+	if ok && IsInAnyGeofence(r.Config.Geofences, latitude, longitude) {
+		changed = append(changed, image.ClearPlace()...)
+		log.Printf("Image %s is within a geofence, so it isn't named\n", task.ImageId)
+
+		return updateGeocodedImage(r, &task, &image, changed)
+	}
+
+	changed = append(changed, image.SetPlace(r.Geocoder.LookupImage(&image))...)
+	log.Printf("Geocoded image %s as %q\n", task.ImageId, image.Place().String())
+
+	return updateGeocodedImage(r, &task, &image, changed)
+}
+
+func updateGeocodedImage(r *Resources, task *ImageImport, image *Image, changed []string) error {
+
+	if len(changed) > 0 {
+		if err := r.Db.UpdateImageFields(image, changed); err != nil {
+			return fmt.Errorf("updating image: %s", err)
+		}
+	}
+
+	return r.Db.UpdateImportTaskChanges(task.ImportBatchId, task.ImageId, changed)
+}
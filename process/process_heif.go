@@ -0,0 +1,61 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/utils"
+
+	"github.com/h2non/bimg"
+)
+
+const HEIF_RENDITION_QUALITY = 95
+
+// Returns the HEIC file itself when libvips was built with libheif, otherwise
+// converts it to a JPEG with heif-convert. Either way the transforms stored
+// in the container are applied while decoding.
+func ConvertHeifRendition(ctx context.Context, image *ImageImport, file []byte) ([]byte, error) {
+	if bimg.IsTypeSupported(bimg.HEIF) {
+		if _, err := bimg.Size(file); err == nil {
+			return file, nil
+		}
+	}
+
+	log.Printf("Converting HEIC with heif-convert, imageId: %s\n", image.ImageId)
+
+	ensureTempDirExists()
+
+	// Edit previews convert alongside the workers, so each conversion has a
+	// directory of its own
+	tempDir, err := os.MkdirTemp(os.TempDir(), image.ImageId+"_heif_*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	inputPath := filepath.Join(tempDir, "original"+GetExtension(image.OriginalFileKey))
+	outputPath := filepath.Join(tempDir, "rendition.jpg")
+
+	err = bimg.Write(inputPath, file)
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("heif-convert", "-q", fmt.Sprint(HEIF_RENDITION_QUALITY), inputPath, outputPath)
+	cmd.Stderr = &stderr
+
+	err = withBufferDecodeBudget(ctx, file, cmd.Run)
+	if err != nil {
+		return nil, fmt.Errorf("heif-convert: %s %s", err, stderr.String())
+	}
+
+	return ioutil.ReadFile(outputPath)
+}
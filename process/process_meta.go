@@ -1,19 +1,23 @@
 package process
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 
 	. "github.com/eburlingame/fstop/models"
 	. "github.com/eburlingame/fstop/resources"
 	. "github.com/eburlingame/fstop/utils"
 
-	"github.com/barasher/go-exiftool"
 	"github.com/h2non/bimg"
 )
 
+// Only the header is read, so no decode budget is needed
 func populateImageSize(image *Image, buffer []byte) error {
 	imgSize, err := bimg.Size(buffer)
 	if err != nil {
@@ -27,50 +31,126 @@ func populateImageSize(image *Image, buffer []byte) error {
 	return nil
 }
 
-func extractExif(localPath string) (map[string]string, error) {
-	et, err := exiftool.NewExiftool()
+func extractExif(ctx context.Context, localPath string) (map[string]string, error) {
+	return exiftools.extract(ctx, localPath)
+}
+
+// Writes a file for exiftool to read, named uniquely so retries and
+// concurrent tasks never share one. The extension of the key is kept, as
+// exiftool reads the format from it.
+func writeExifTempFile(image *ImageImport, key string, file []byte) (string, error) {
+	ensureTempDirExists()
+
+	tempFile, err := os.CreateTemp(os.TempDir(), image.ImageId+"_*"+GetExtension(key))
 	if err != nil {
-		log.Printf("Error when intializing: %v\n", err)
-		return nil, err
+		return "", err
 	}
-	defer et.Close()
-
-	fileInfos := et.ExtractMetadata(localPath)
+	defer tempFile.Close()
 
-	valueMap := map[string]string{}
-	for tagName := range fileInfos[0].Fields {
-		valueMap[tagName], _ = fileInfos[0].GetString(tagName)
+	if _, err := tempFile.Write(file); err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
 	}
 
-	return valueMap, nil
+	return tempFile.Name(), nil
+}
+
+func getMediaType(image *ImageImport) string {
+	if IsVideoFormat(FormatFromExtension(GetExtension(image.OriginalFileKey))) {
+		return MEDIA_TYPE_VIDEO
+	}
+	if image.PairedVideoKey != "" {
+		return MEDIA_TYPE_LIVE
+	}
+	return MEDIA_TYPE_PHOTO
 }
 
 func ensureTempDirExists() {
 	os.MkdirAll(os.TempDir(), os.ModePerm)
 }
 
-func ProcessImageMeta(r *Resources, wg *sync.WaitGroup, image *ImageImport, file []byte) error {
-	defer wg.Done()
-
-	ensureTempDirExists()
-
-	extension := GetExtension(image.OriginalFileKey)
-	tempPath := os.TempDir() + "/" + image.ImageId + extension
-
+// Extracts the tags of the original, used to populate its Image
+func readImageTags(ctx context.Context, image *ImageImport, file []byte) (map[string]string, error) {
 	// Write to temporary file
-	log.Printf("Writing temporary file %s\n", tempPath)
-	err := bimg.Write(tempPath, file)
+	tempPath, err := writeExifTempFile(image, image.OriginalFileKey, file)
 	if err != nil {
 		log.Printf("Error writing temporary file: %s\n", err)
-		return err
+		return nil, err
 	}
 	defer os.Remove(tempPath)
 
 	// Extract image EXIF data
 	log.Printf("Extracting EXIF data %s\n", tempPath)
-	tags, err := extractExif(tempPath)
+	tags, err := extractExif(ctx, tempPath)
 	if err != nil {
 		log.Printf("Error extracting EXIF data: %s\n", err)
+		return nil, err
+	}
+
+	numeric, err := exiftools.extractNumeric(ctx, tempPath, NumericExifTags()...)
+	if err != nil {
+		log.Printf("Error extracting numeric EXIF data: %s\n", err)
+		return nil, err
+	}
+	for tagName, value := range numeric {
+		tags[tagName+NUMERIC_TAG_SUFFIX] = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	return tags, nil
+}
+
+// Reads the XMP sidecar uploaded with the original, if any
+func readSidecarTags(ctx context.Context, r *Resources, image *ImageImport) (map[string]string, error) {
+	if image.SidecarKey == "" {
+		return map[string]string{}, nil
+	}
+
+	sidecar, err := r.Storage.GetFile(ctx, image.SidecarKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting sidecar from storage: %s", err)
+	}
+
+	tempPath, err := writeExifTempFile(image, image.SidecarKey, sidecar)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempPath)
+
+	log.Printf("Extracting XMP sidecar %s\n", image.SidecarKey)
+	return extractExif(ctx, tempPath)
+}
+
+// Stores every tag read, without the location when the policy removes it
+func saveImageMetadata(r *Resources, image *ImageImport, tags map[string]string) error {
+	stored := map[string]string{}
+	for name, value := range tags {
+		stored[name] = value
+	}
+	if image.PrivacyPolicy != PRIVACY_KEEP {
+		RemoveLocationTags(stored)
+	}
+
+	metadata, err := NewImageMetadata(image.ImageId, stored)
+	if err != nil {
+		return err
+	}
+
+	return r.Db.SaveImageMetadata(metadata)
+}
+
+// Extracts the metadata from the original file, and the dimensions and
+// placeholder from its rendition, which differ for RAW files
+func ProcessImageMeta(ctx context.Context, r *Resources, wg *sync.WaitGroup, image *ImageImport, file []byte, rendition []byte) error {
+	defer wg.Done()
+
+	tags, err := readImageTags(ctx, image, file)
+	if err != nil {
+		return err
+	}
+
+	sidecarTags, err := readSidecarTags(ctx, r, image)
+	if err != nil {
+		log.Printf("Error reading XMP sidecar: %s\n", err)
 		return err
 	}
 
@@ -79,15 +159,43 @@ func ProcessImageMeta(r *Resources, wg *sync.WaitGroup, image *ImageImport, file
 		ImageId:          image.ImageId,
 		ImportBatchId:    image.ImportBatchId,
 		OriginalFilename: filepath.Base(image.OriginalFileKey),
+		MediaType:        getMediaType(image),
 	}
 
 	// Populate database Image with exif tags
 	log.Printf("Populating image from exif, imageId: %s\n", imageRecord.ImageId)
 	PopulateImageFromExif(&imageRecord, tags)
+	PopulateImageCaptureTime(&imageRecord, tags, r.Config.DefaultTimezone)
+	if imageRecord.DateUnknown {
+		log.Printf("No capture time found for image %s\n", imageRecord.ImageId)
+	}
+
+	// Titles, captions and ratings, with those of the sidecar taking precedence
+	applied := PopulateImageFromXmp(&imageRecord, tags, sidecarTags)
+	if len(applied) > 0 {
+		log.Printf("Applied XMP metadata to image %s: %s\n", imageRecord.ImageId, strings.Join(applied, ", "))
+	}
+
+	// The location isn't kept when it was removed from the published files
+	if image.PrivacyPolicy != PRIVACY_KEEP {
+		imageRecord.ClearLocation()
+	}
+
+	// Name where the image was taken, from the location which is kept
+	if r.Geocoder != nil {
+		imageRecord.SetPlace(r.Geocoder.LookupImage(&imageRecord))
+	}
+
+	// Populate the placeholder shown while the image loads
+	log.Printf("Populating image placeholder, imageId: %s\n", imageRecord.ImageId)
+	err = populateImagePlaceholder(ctx, &imageRecord, rendition)
+	if err != nil {
+		log.Printf("Error populating image placeholder: %s\n", err)
+	}
 
 	// Populate image sizes
 	log.Printf("Populating image sizes, imageId: %s\n", imageRecord.ImageId)
-	err = populateImageSize(&imageRecord, file)
+	err = populateImageSize(&imageRecord, rendition)
 	if err != nil {
 		log.Printf("Error populating image sizes: %s\n", err)
 		return err
@@ -101,11 +209,90 @@ func ProcessImageMeta(r *Resources, wg *sync.WaitGroup, image *ImageImport, file
 		return err
 	}
 
+	AddSidecarTags(tags, sidecarTags)
+	err = saveImageMetadata(r, image, tags)
+	if err != nil {
+		log.Printf("Error saving image metadata: %s\n", err)
+		return err
+	}
+
 	// Add the image to the correct album, if set
 	if image.AlbumId != "" {
 		log.Printf("Adding image to album %s\n", image.AlbumId)
 		r.Db.AddImageToAlbum(image.AlbumId, image.ImageId)
 	}
 
-	return nil
+	// Report the descriptive metadata applied on the import's status
+	return r.Db.UpdateImportTaskChanges(image.ImportBatchId, image.ImageId, applied)
+}
+
+// Re-reads the metadata of an imported image from its stored original and
+// updates the Image, without regenerating its derivatives. The fields which
+// changed are recorded on the task.
+func RefreshImageMetadata(ctx context.Context, r *Resources, task ImageImport) error {
+	var image Image
+	r.Db.GetImage(&image, task.ImageId)
+	if image.ImageId == "" {
+		return fmt.Errorf("image %s doesn't exist", task.ImageId)
+	}
+
+	file, err := r.Storage.GetFile(ctx, task.OriginalFileKey)
+	if err != nil {
+		return fmt.Errorf("getting original from storage: %s", err)
+	}
+
+	tags, err := readImageTags(ctx, &task, file)
+	if err != nil {
+		return err
+	}
+
+	var refreshed Image
+	PopulateImageFromExif(&refreshed, tags)
+	PopulateImageCaptureTime(&refreshed, tags, r.Config.DefaultTimezone)
+	if !refreshed.DateUnknown {
+		refreshed.ShiftCaptureTime(image.CaptureTimeShift)
+	}
+
+	changed := MergeExifFields(&image, &refreshed)
+
+	// Merging keeps the fields the original has no value for, so the location
+	// is removed from the image itself
+	if task.PrivacyPolicy != PRIVACY_KEEP {
+		changed = append(changed, image.ClearLocation()...)
+	}
+
+	// Stripping all metadata removes the dates from the stored original too,
+	// so their absence only means the date is unknown otherwise
+	if refreshed.DateUnknown && task.PrivacyPolicy != PRIVACY_STRIP_ALL {
+		changed = append(changed, image.CopyCaptureTime(&refreshed)...)
+	}
+
+	// Geofences may have been added since the image was imported
+	if latitude, longitude, ok := image.Coordinates(); ok && IsInAnyGeofence(r.Config.Geofences, latitude, longitude) {
+		changed = append(changed, image.ClearPlace()...)
+	} else if r.Geocoder != nil {
+		changed = append(changed, image.SetPlace(r.Geocoder.LookupImage(&image))...)
+	}
+
+	// The sidecar imported with the original still takes precedence
+	var stored ImageMetadata
+	r.Db.GetImageMetadata(&stored, task.ImageId)
+	sidecarTags := SidecarTags(stored.TagMap())
+
+	changed = append(changed, PopulateImageFromXmp(&image, tags, sidecarTags)...)
+	AddSidecarTags(tags, sidecarTags)
+
+	log.Printf("Refreshed metadata of image %s, %d fields changed\n", task.ImageId, len(changed))
+
+	if len(changed) > 0 {
+		if err := r.Db.UpdateImageFields(&image, changed); err != nil {
+			return fmt.Errorf("updating image: %s", err)
+		}
+	}
+
+	if err := saveImageMetadata(r, &task, tags); err != nil {
+		return fmt.Errorf("saving image metadata: %s", err)
+	}
+
+	return r.Db.UpdateImportTaskChanges(task.ImportBatchId, task.ImageId, changed)
 }
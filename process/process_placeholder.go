@@ -0,0 +1,142 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image/jpeg"
+	"log"
+	"sync"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/resources"
+	. "github.com/eburlingame/fstop/utils"
+
+	"github.com/h2non/bimg"
+)
+
+// Long edge of the inline preview, small enough to keep the data URI under a
+// kilobyte while still hinting at the composition
+const PLACEHOLDER_LONG_EDGE = 16
+const PLACEHOLDER_QUALITY = 40
+
+func createPlaceholderPreview(file []byte) ([]byte, error) {
+	width, height, err := getImageSize(file)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height = ResizeLongEdgeDimensions(width, height, PLACEHOLDER_LONG_EDGE)
+
+	return bimg.NewImage(file).Process(bimg.Options{
+		Type:          bimg.JPEG,
+		Quality:       PLACEHOLDER_QUALITY,
+		Width:         width,
+		Height:        height,
+		StripMetadata: true,
+		OutputICC:     SRGB_PROFILE,
+	})
+}
+
+// Finds the most common color in the preview, bucketing each channel so that
+// near-identical shades are counted together
+func findDominantColor(preview []byte) (string, error) {
+	img, err := jpeg.Decode(bytes.NewReader(preview))
+	if err != nil {
+		return "", err
+	}
+
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+
+	buckets := map[int]*bucket{}
+	var dominant *bucket
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			r, g, b = r>>8, g>>8, b>>8
+
+			key := int(r>>5)<<6 | int(g>>5)<<3 | int(b>>5)
+			if buckets[key] == nil {
+				buckets[key] = &bucket{}
+			}
+
+			current := buckets[key]
+			current.count++
+			current.r += int(r)
+			current.g += int(g)
+			current.b += int(b)
+
+			if dominant == nil || current.count > dominant.count {
+				dominant = current
+			}
+		}
+	}
+
+	if dominant == nil {
+		return "", fmt.Errorf("preview has no pixels")
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x",
+		dominant.r/dominant.count,
+		dominant.g/dominant.count,
+		dominant.b/dominant.count,
+	), nil
+}
+
+// Computes an inline preview data URI and the dominant color of an image
+func computePlaceholder(ctx context.Context, file []byte) (string, string, error) {
+	var preview []byte
+	err := withBufferDecodeBudget(ctx, file, func() (err error) {
+		preview, err = createPlaceholderPreview(file)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	color, err := findDominantColor(preview)
+	if err != nil {
+		return "", "", err
+	}
+
+	placeholder := "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(preview)
+
+	return placeholder, color, nil
+}
+
+func populateImagePlaceholder(ctx context.Context, image *Image, file []byte) error {
+	placeholder, color, err := computePlaceholder(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	image.Placeholder = placeholder
+	image.DominantColor = color
+
+	return nil
+}
+
+// Generates the placeholder for an image that has already been imported
+func ProcessImagePlaceholder(ctx context.Context, r *Resources, wg *sync.WaitGroup, image *ImageImport, file []byte) error {
+	defer wg.Done()
+
+	placeholder, color, err := computePlaceholder(ctx, file)
+	if err != nil {
+		log.Printf("Error computing placeholder: %s\n", err)
+		return err
+	}
+
+	err = r.Db.UpdateImagePlaceholder(image.ImageId, placeholder, color)
+	if err != nil {
+		log.Printf("Error updating placeholder: %s\n", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package process
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/resources"
+	. "github.com/eburlingame/fstop/utils"
+)
+
+// Tags removed by PRIVACY_STRIP_GPS. GPSCoordinates holds the location of
+// QuickTime videos, and the wildcard covers XMP copies of the GPS tags.
+var locationAndSerialTags = []string{
+	"-gps:all=",
+	"-xmp:gps*=",
+	"-GPSCoordinates=",
+	"-LocationInformation=",
+	"-SerialNumber=",
+	"-BodySerialNumber=",
+	"-CameraSerialNumber=",
+	"-InternalSerialNumber=",
+	"-LensSerialNumber=",
+}
+
+// Removes everything, then copies back the tags needed to display the image
+// correctly
+var allMetadataTags = []string{
+	"-all=",
+	"-tagsfromfile", "@",
+	"-Orientation",
+	"-ICC_Profile",
+}
+
+// Removing all metadata from a RAW file can leave it unreadable, as the
+// previews and maker notes are stored alongside the tags, so RAW files are
+// only stripped of their location and serial numbers
+func getAppliedPrivacyPolicy(policy string, format string) string {
+	if policy == PRIVACY_STRIP_ALL && IsRawFormat(format) {
+		return PRIVACY_STRIP_GPS
+	}
+	return policy
+}
+
+func getScrubArgs(policy string, format string) []string {
+	if getAppliedPrivacyPolicy(policy, format) == PRIVACY_STRIP_ALL {
+		return allMetadataTags
+	}
+
+	return locationAndSerialTags
+}
+
+// Reads the signed decimal location of a file, if it has one
+func readGPSPosition(ctx context.Context, localPath string) (float64, float64, bool) {
+	output, err := exiftools.execute(ctx, "-n", "-s3", "-GPSLatitude", "-GPSLongitude", localPath)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	lines := strings.Fields(string(output))
+	if len(lines) != 2 {
+		return 0, 0, false
+	}
+
+	latitude, err := strconv.ParseFloat(lines[0], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	longitude, err := strconv.ParseFloat(lines[1], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return latitude, longitude, true
+}
+
+func isInGeofence(ctx context.Context, r *Resources, localPath string) bool {
+	if len(r.Config.Geofences) == 0 {
+		return false
+	}
+
+	latitude, longitude, ok := readGPSPosition(ctx, localPath)
+	if !ok {
+		return false
+	}
+
+	return IsInAnyGeofence(r.Config.Geofences, latitude, longitude)
+}
+
+// Removes the metadata the policy calls for from a file, returning the
+// scrubbed file and the policy applied. Files located within a geofence
+// always have their location removed.
+func ScrubMetadata(ctx context.Context, r *Resources, image *ImageImport, policy string, key string, file []byte) ([]byte, string, error) {
+	if policy == "" {
+		policy = PRIVACY_KEEP
+	}
+
+	tempPath, err := writeExifTempFile(image, key, file)
+	if err != nil {
+		return nil, policy, err
+	}
+	defer os.Remove(tempPath)
+
+	if policy == PRIVACY_KEEP && isInGeofence(ctx, r, tempPath) {
+		log.Printf("Location is within a geofence, imageId: %s\n", image.ImageId)
+		policy = PRIVACY_STRIP_GPS
+	}
+
+	if policy == PRIVACY_KEEP {
+		return file, policy, nil
+	}
+
+	format := FormatFromExtension(GetExtension(key))
+	if applied := getAppliedPrivacyPolicy(policy, format); applied != policy {
+		log.Printf("Keeping the metadata of a RAW file other than its location, imageId: %s\n", image.ImageId)
+		policy = applied
+	}
+
+	args := append([]string{"-overwrite_original", "-q"}, getScrubArgs(policy, format)...)
+
+	if err := exiftools.write(ctx, append(args, tempPath)...); err != nil {
+		return nil, policy, err
+	}
+
+	scrubbed, err := ioutil.ReadFile(tempPath)
+	if err != nil {
+		return nil, policy, err
+	}
+
+	return scrubbed, policy, nil
+}
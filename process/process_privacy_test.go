@@ -0,0 +1,35 @@
+package process
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/eburlingame/fstop/models"
+)
+
+func TestGetScrubArgs(t *testing.T) {
+	tests := []struct {
+		policy string
+		format string
+		want   []string
+	}{
+		{PRIVACY_STRIP_GPS, "jpeg", locationAndSerialTags},
+		{PRIVACY_STRIP_GPS, "cr2", locationAndSerialTags},
+		{PRIVACY_STRIP_ALL, "jpeg", allMetadataTags},
+		{PRIVACY_STRIP_ALL, "heic", allMetadataTags},
+		{PRIVACY_STRIP_ALL, "mov", allMetadataTags},
+		// RAW files would be unreadable without their other metadata
+		{PRIVACY_STRIP_ALL, "cr2", locationAndSerialTags},
+		{PRIVACY_STRIP_ALL, "dng", locationAndSerialTags},
+	}
+
+	for _, test := range tests {
+		if got := getScrubArgs(test.policy, test.format); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("getScrubArgs(%s, %s) = %v, want %v", test.policy, test.format, got, test.want)
+		}
+	}
+
+	if got := getAppliedPrivacyPolicy(PRIVACY_STRIP_ALL, "nef"); got != PRIVACY_STRIP_GPS {
+		t.Errorf("policy applied to a RAW file under strip_all = %s, want %s", got, PRIVACY_STRIP_GPS)
+	}
+}
@@ -0,0 +1,109 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	. "github.com/eburlingame/fstop/models"
+
+	"github.com/h2non/bimg"
+)
+
+// Embedded previews to try, largest first. Most cameras store a full size
+// JPEG as JpgFromRaw, some only provide a PreviewImage.
+var rawPreviewTags = []string{"JpgFromRaw", "PreviewImage", "OtherImage"}
+
+const RAW_RENDITION_QUALITY = 95
+
+func readRawOrientation(ctx context.Context, localPath string) int {
+	output, err := exiftools.execute(ctx, "-n", "-s3", "-Orientation", localPath)
+	if err != nil {
+		return 1
+	}
+
+	orientation, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return 1
+	}
+
+	return orientation
+}
+
+// Rotates and mirrors an image buffer so that it is upright for the given
+// EXIF orientation. Note that bimg's Flip mirrors horizontally.
+func applyOrientation(file []byte, orientation int) ([]byte, error) {
+	options := bimg.Options{
+		Type:         bimg.JPEG,
+		Quality:      RAW_RENDITION_QUALITY,
+		NoAutoRotate: true,
+	}
+
+	switch orientation {
+	case 2:
+		options.Flip = true
+	case 3:
+		options.Rotate = bimg.D180
+	case 4:
+		options.Rotate = bimg.D180
+		options.Flip = true
+	case 5:
+		options.Rotate = bimg.D90
+		options.Flip = true
+	case 6:
+		options.Rotate = bimg.D90
+	case 7:
+		options.Rotate = bimg.D270
+		options.Flip = true
+	case 8:
+		options.Rotate = bimg.D270
+	default:
+		return file, nil
+	}
+
+	return bimg.NewImage(file).Process(options)
+}
+
+// Extracts the embedded JPEG preview of a RAW file, used in place of the RAW
+// for every rendition since libvips can't decode most camera formats
+func ExtractRawRendition(ctx context.Context, image *ImageImport, file []byte) ([]byte, error) {
+	tempPath, err := writeExifTempFile(image, image.OriginalFileKey, file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempPath)
+
+	for _, tag := range rawPreviewTags {
+		preview, err := exiftools.extractBinary(ctx, tempPath, tag)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(preview) == 0 {
+			continue
+		}
+
+		log.Printf("Using %s preview for RAW file, imageId: %s\n", tag, image.ImageId)
+
+		// Previews with their own orientation are rotated along with every
+		// other rendition, but most only carry it on the RAW itself
+		if meta, err := bimg.Metadata(preview); err == nil && meta.Orientation > 1 {
+			return preview, nil
+		}
+
+		orientation := readRawOrientation(ctx, tempPath)
+
+		var rendition []byte
+		err = withBufferDecodeBudget(ctx, preview, func() error {
+			rendition, err = applyOrientation(preview, orientation)
+			return err
+		})
+
+		return rendition, err
+	}
+
+	return nil, fmt.Errorf("no embedded preview found in %s", image.OriginalFileKey)
+}
@@ -1,7 +1,9 @@
 package process
 
 import (
+	"context"
 	"log"
+	"math"
 	"net/http"
 	"sync"
 
@@ -14,6 +16,9 @@ import (
 
 const DEFAULT_QUALITY = 75
 
+// The name libvips uses for its built-in sRGB profile
+const SRGB_PROFILE = "srgb"
+
 func getImageSize(file []byte) (int, int, error) {
 	sizes, err := bimg.Size(file)
 	if err != nil {
@@ -25,7 +30,8 @@ func getImageSize(file []byte) (int, int, error) {
 		return 0, 0, err
 	}
 
-	if meta.Orientation == 6 || meta.Orientation == 8 {
+	// Orientations 5 through 8 are rotated by a quarter turn
+	if meta.Orientation >= 5 && meta.Orientation <= 8 {
 		return sizes.Height, sizes.Width, nil
 	} else {
 		return sizes.Width, sizes.Height, nil
@@ -46,6 +52,81 @@ func resizeImage(file []byte, newWidth int, newHeight int) ([]byte, error) {
 	return imgBuffer, nil
 }
 
+// Sizes are resized from a downscaled copy of the rendition when it's at least
+// this much smaller, so the full rendition is only decoded once
+const INTERMEDIATE_MIN_REDUCTION = 1.5
+const INTERMEDIATE_QUALITY = 95
+
+// Returns the long edge a source needs for every size to be resized from it
+// without losing resolution
+func getRequiredLongEdge(width int, height int, sizes []OutputImageSize) int {
+	longEdge := GetLongestEdge(width, height)
+	shortEdge := width + height - longEdge
+
+	required := 0
+	for _, size := range sizes {
+		needed := size.LongEdge
+
+		// Crops are limited by the short edge
+		if size.Crop == CROP_SQUARE || size.Crop == CROP_SMART {
+			needed = int(math.Ceil(float64(size.LongEdge) * float64(longEdge) / float64(shortEdge)))
+		}
+
+		if needed > required {
+			required = needed
+		}
+	}
+
+	return required
+}
+
+// Downscales the rendition to the largest dimensions the sizes need, or
+// returns it as is when that wouldn't save much. The copy is a JPEG, or a PNG
+// when the rendition has transparency. The orientation is left to the
+// resizes, which read it from the copied metadata.
+func createResizeIntermediate(ctx context.Context, rendition []byte, sizes []OutputImageSize) ([]byte, error) {
+	meta, err := bimg.Metadata(rendition)
+	if err != nil {
+		return nil, err
+	}
+	raw := meta.Size
+
+	required := getRequiredLongEdge(raw.Width, raw.Height, sizes)
+	if required == 0 || float64(GetLongestEdge(raw.Width, raw.Height)) < float64(required)*INTERMEDIATE_MIN_REDUCTION {
+		return rendition, nil
+	}
+
+	options := bimg.Options{
+		Type:         bimg.JPEG,
+		Quality:      INTERMEDIATE_QUALITY,
+		NoAutoRotate: true,
+	}
+	if meta.Alpha {
+		options.Type = bimg.PNG
+	}
+
+	// Only the long edge is given, so the aspect ratio is kept exactly
+	width, height := ResizeLongEdgeDimensions(raw.Width, raw.Height, required)
+	if raw.Width >= raw.Height {
+		options.Width = width
+	} else {
+		options.Height = height
+	}
+
+	var intermediate []byte
+	err = withDecodeBudget(ctx, raw.Width, raw.Height, func() error {
+		intermediate, err = bimg.NewImage(rendition).Process(options)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created %d x %d intermediate from %d x %d rendition\n", width, height, raw.Width, raw.Height)
+
+	return intermediate, nil
+}
+
 func imageTypeNameToEnum(format string) bimg.ImageType {
 	if format == "png" {
 		return bimg.PNG
@@ -59,11 +140,77 @@ func imageTypeNameToEnum(format string) bimg.ImageType {
 	if format == "webp" {
 		return bimg.WEBP
 	}
+	if format == "avif" {
+		return bimg.AVIF
+	}
 	return bimg.JPEG
 }
 
+// Determines the output dimensions for a size, given the oriented dimensions
+// of the source image
+func getOutputDimensions(width int, height int, size OutputImageSize) (int, int) {
+	if size.Crop == CROP_SQUARE || size.Crop == CROP_SMART {
+		side := size.LongEdge
+		if width < side {
+			side = width
+		}
+		if height < side {
+			side = height
+		}
+		return side, side
+	}
+
+	originalLongEdge := GetLongestEdge(width, height)
+	// Resize to longest edge, if needed
+	if size.LongEdge < originalLongEdge {
+		return ResizeLongEdgeDimensions(width, height, size.LongEdge)
+	}
+
+	return width, height
+}
+
+func getResizeOptions(size OutputImageSize, width int, height int) bimg.Options {
+	options := bimg.Options{
+		Type:    imageTypeNameToEnum(size.Format),
+		Quality: size.Quality,
+		Width:   width,
+		Height:  height,
+		// Convert wide gamut sources, e.g. Display P3 from iPhones, so that
+		// derivatives look the same in browsers without color management
+		OutputICC: SRGB_PROFILE,
+	}
+
+	// Progressive JPEGs render sooner on slow connections
+	if size.Format == "jpeg" {
+		options.Interlace = true
+	}
+
+	if size.Crop == CROP_SQUARE {
+		options.Crop = true
+		options.Gravity = bimg.GravityCentre
+	}
+	if size.Crop == CROP_SMART {
+		options.Crop = true
+		options.Gravity = bimg.GravitySmart
+	}
+
+	if size.Sharpen {
+		// A mild unsharp mask to restore detail lost when downscaling
+		options.Sharpen = bimg.Sharpen{
+			Radius: 1,
+			X1:     2,
+			Y2:     10,
+			Y3:     20,
+			M1:     0,
+			M2:     3,
+		}
+	}
+
+	return options
+}
+
 func getResizedStorageFilename(r *Resources, image *ImageImport, size OutputImageSize) string {
-	return image.ImageId + size.Suffix + size.Extension
+	return size.Filename(image.ImageId)
 }
 
 func getOriginalStorageFilename(r *Resources, image *ImageImport) string {
@@ -75,7 +222,7 @@ func getStoragePath(r *Resources, filename string) string {
 	return r.Config.S3MediaFolder + "/" + filename
 }
 
-func ProcessImageResize(r *Resources, wg *sync.WaitGroup, image *ImageImport, size OutputImageSize, file []byte) error {
+func ProcessImageResize(ctx context.Context, r *Resources, wg *sync.WaitGroup, image *ImageImport, size OutputImageSize, file []byte) error {
 	defer wg.Done()
 
 	outputImage := file
@@ -89,19 +236,30 @@ func ProcessImageResize(r *Resources, wg *sync.WaitGroup, image *ImageImport, si
 
 	log.Printf("Image size %s to %d x %d\n", image.ImageId, width, height)
 
-	originalLongEdge := GetLongestEdge(width, height)
-	// Resize to longest edge, if needed
-	if size.LongEdge < originalLongEdge {
-		width, height = ResizeLongEdgeDimensions(width, height, size.LongEdge)
-	}
+	sourceWidth, sourceHeight := width, height
+	width, height = getOutputDimensions(width, height, size)
 
 	log.Printf("Resizing %s to %d x %d\n", image.ImageId, width, height)
 
-	outputImage, err = bimg.NewImage(outputImage).Process(bimg.Options{
-		Type:    imageTypeNameToEnum(size.Format),
-		Quality: size.Quality,
-		Width:   width,
-		Height:  height,
+	options := getResizeOptions(size, width, height)
+	options.StripMetadata = image.PrivacyPolicy == PRIVACY_STRIP_ALL
+
+	// Drawn in the same pass as the resize, so the derivative is only encoded
+	// once. The mark is never larger than the derivative.
+	if size.Watermark && r.Config.Watermark != nil {
+		err = withDecodeBudget(ctx, width, height, func() (err error) {
+			options.WatermarkImage, err = getWatermarkImage(r.Config.Watermark, width, height)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error building watermark: %s\n", err)
+			return err
+		}
+	}
+
+	err = withDecodeBudget(ctx, sourceWidth, sourceHeight, func() error {
+		outputImage, err = bimg.NewImage(outputImage).Process(options)
+		return err
 	})
 
 	if err != nil {
@@ -113,10 +271,14 @@ func ProcessImageResize(r *Resources, wg *sync.WaitGroup, image *ImageImport, si
 	storageFilename := getResizedStorageFilename(r, image, size)
 	storagePath := getStoragePath(r, storageFilename)
 
-	r.Storage.PutFile(outputImage, storagePath, size.ContentType)
+	err = r.Storage.PutFile(ctx, outputImage, storagePath, size.ContentType)
+	if err != nil {
+		log.Printf("Error uploading to S3: %s\n", err)
+		return err
+	}
 
-	// Insert a FileRecord
-	r.Db.AddFile(&File{
+	// Replaces the record of an earlier run, which used the same storage path
+	err = r.Db.SaveFile(&File{
 		FileId:        Uuid(),
 		ImageId:       image.ImageId,
 		ImportBatchId: image.ImportBatchId,
@@ -126,18 +288,104 @@ func ProcessImageResize(r *Resources, wg *sync.WaitGroup, image *ImageImport, si
 		IsOriginal:    false,
 		Width:         uint64(width),
 		Height:        uint64(height),
+		SizeName:      size.Name,
+		SizeHash:      size.Fingerprint(),
+		IsCropped:     size.Crop == CROP_SQUARE || size.Crop == CROP_SMART,
+		Format:        size.Format,
 	})
+	if err != nil {
+		log.Printf("Error saving file into database: %s\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// Deletes the derivatives of sizes which are no longer in the image's profile
+// set, or whose filename changed with their settings
+func removeStaleDerivatives(ctx context.Context, r *Resources, image *ImageImport) error {
+	if len(image.KeepFiles) == 0 {
+		return nil
+	}
+
+	keep := map[string]bool{}
+	for _, filename := range image.KeepFiles {
+		keep[filename] = true
+	}
+
+	var files []File
+	r.Db.ListImageFiles(&files, image.ImageId)
+
+	for _, file := range files {
+		if !file.IsSizedDerivative() || keep[file.Filename] {
+			continue
+		}
+
+		// The record goes first, so a failed delete never leaves one pointing
+		// at a missing object
+		log.Printf("Removing stale derivative %s of size %s\n", file.StoragePath, file.SizeName)
+		if err := r.Db.DeleteFile(file.FileId); err != nil {
+			return err
+		}
+		if err := r.Storage.DeleteFile(ctx, file.StoragePath); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func ProcessImageOriginal(r *Resources, wg *sync.WaitGroup, image *ImageImport, file []byte) error {
+func getOriginalContentType(format string, file []byte) string {
+	if IsRawFormat(format) {
+		return RawContentType(format)
+	}
+	if IsHeifFormat(format) {
+		return "image/" + format
+	}
+	if IsVideoFormat(format) {
+		return VideoContentType(format)
+	}
+
+	return http.DetectContentType(file)
+}
+
+func getOriginalMediaType(format string) string {
+	if IsVideoFormat(format) {
+		return FILE_MEDIA_VIDEO
+	}
+	return FILE_MEDIA_IMAGE
+}
+
+// Replaces the stored original with its scrubbed copy and removes the
+// location from the database
+func ProcessOriginalPrivacy(ctx context.Context, r *Resources, wg *sync.WaitGroup, image *ImageImport, scrubbed []byte) error {
+	defer wg.Done()
+
+	format := FormatFromExtension(GetExtension(image.OriginalFileKey))
+
+	err := r.Storage.PutFile(ctx, scrubbed, image.OriginalFileKey, getOriginalContentType(format, scrubbed))
+	if err != nil {
+		log.Printf("Error uploading to S3: %s\n", err)
+		return err
+	}
+
+	err = r.Db.ClearImageLocation(image.ImageId)
+	if err != nil {
+		log.Printf("Error clearing image location: %s\n", err)
+		return err
+	}
+
+	return nil
+}
+
+func ProcessImageOriginal(ctx context.Context, r *Resources, wg *sync.WaitGroup, image *ImageImport, file []byte, rendition []byte) error {
 	defer wg.Done()
 
 	outputImage := file
+	format := FormatFromExtension(GetExtension(image.OriginalFileKey))
 
-	// Determine image dimensions
-	width, height, err := getImageSize(file)
+	// Determine image dimensions, from the header
+	width, height, err := getImageSize(rendition)
 	if err != nil {
 		return err
 	}
@@ -146,14 +394,14 @@ func ProcessImageOriginal(r *Resources, wg *sync.WaitGroup, image *ImageImport,
 	storageFilename := getOriginalStorageFilename(r, image)
 	storagePath := getStoragePath(r, storageFilename)
 
-	err = r.Storage.PutFile(outputImage, storagePath, http.DetectContentType(file))
+	err = r.Storage.PutFile(ctx, outputImage, storagePath, getOriginalContentType(format, file))
 	if err != nil {
 		log.Printf("Error uploading to S3: %s\n", err)
 		return err
 	}
 
 	// Insert a FileRecord
-	err = r.Db.AddFile(&File{
+	err = r.Db.SaveFile(&File{
 		FileId:        Uuid(),
 		ImageId:       image.ImageId,
 		ImportBatchId: image.ImportBatchId,
@@ -163,6 +411,8 @@ func ProcessImageOriginal(r *Resources, wg *sync.WaitGroup, image *ImageImport,
 		IsOriginal:    true,
 		Width:         uint64(width),
 		Height:        uint64(height),
+		Format:        format,
+		MediaType:     getOriginalMediaType(format),
 	})
 	if err != nil {
 		log.Printf("Error inserting file into database: %s\n", err)
@@ -0,0 +1,230 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/resources"
+	. "github.com/eburlingame/fstop/utils"
+)
+
+// Videos are transcoded to H.264 with the long edge limited to this size
+const VIDEO_LONG_EDGE = 1920
+const VIDEO_CRF = 23
+
+const VIDEO_SUFFIX = "_video"
+const MOTION_SUFFIX = "_motion"
+
+func runFfmpeg(ctx context.Context, args ...string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-y", "-v", "error"}, args...)...)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %s %s", err, stderr.String())
+	}
+
+	return nil
+}
+
+// Writes the video into a new temporary directory, where ffmpeg writes its
+// output too. The transcodes of a video and of its motion clip run at once,
+// so each call has a directory of its own, which the caller removes.
+func writeVideoTempFile(image *ImageImport, key string, file []byte) (string, string, error) {
+	ensureTempDirExists()
+
+	tempDir, err := os.MkdirTemp(os.TempDir(), image.ImageId+"_video_*")
+	if err != nil {
+		return "", "", err
+	}
+
+	inputPath := filepath.Join(tempDir, "source"+GetExtension(key))
+
+	err = ioutil.WriteFile(inputPath, file, 0644)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", "", err
+	}
+
+	return tempDir, inputPath, nil
+}
+
+// Extracts a poster frame from a video, used to produce its image renditions.
+// The frame is taken a second in, unless the clip is shorter than that.
+func ExtractVideoPoster(ctx context.Context, image *ImageImport, file []byte) ([]byte, error) {
+	tempDir, inputPath, err := writeVideoTempFile(image, image.OriginalFileKey, file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	outputPath := filepath.Join(tempDir, "poster.jpg")
+
+	// Seeking past the end fails with some containers rather than writing
+	// nothing, so the next offset is tried either way
+	var lastErr error
+	for _, offset := range []string{"1", "0"} {
+		err = runFfmpeg(ctx, "-ss", offset, "-i", inputPath, "-frames:v", "1", "-q:v", "2", outputPath)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Unable to extract a poster frame at %ss, imageId: %s: %s\n", offset, image.ImageId, err)
+			lastErr = err
+			continue
+		}
+
+		poster, err := ioutil.ReadFile(outputPath)
+		if err == nil && len(poster) > 0 {
+			return poster, nil
+		}
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("unable to extract a poster frame from %s: %s", image.OriginalFileKey, lastErr)
+	}
+	return nil, fmt.Errorf("unable to extract a poster frame from %s", image.OriginalFileKey)
+}
+
+// Transcodes a video to a web friendly H.264 MP4, rotated upright and with
+// the moov atom up front so playback starts before the download finishes
+func transcodeVideo(ctx context.Context, image *ImageImport, key string, file []byte) ([]byte, error) {
+	tempDir, inputPath, err := writeVideoTempFile(image, key, file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	outputPath := filepath.Join(tempDir, "transcoded.mp4")
+
+	scale := fmt.Sprintf(
+		"scale='if(gte(iw,ih),min(%d,iw),-2)':'if(gte(iw,ih),-2,min(%d,ih))'",
+		VIDEO_LONG_EDGE, VIDEO_LONG_EDGE,
+	)
+
+	args := []string{"-i", inputPath}
+
+	// ffmpeg copies the container metadata, including the location, by default
+	if image.PrivacyPolicy != PRIVACY_KEEP {
+		args = append(args, "-map_metadata", "-1")
+	}
+
+	err = runFfmpeg(ctx, append(args,
+		"-vf", scale,
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", fmt.Sprint(VIDEO_CRF),
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-b:a", "128k",
+		"-movflags", "+faststart",
+		outputPath,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(outputPath)
+}
+
+func storeVideoFile(ctx context.Context, r *Resources, image *ImageImport, contents []byte, filename string, format string, isOriginal bool, width int, height int) error {
+	storagePath := getStoragePath(r, filename)
+
+	err := r.Storage.PutFile(ctx, contents, storagePath, VideoContentType(format))
+	if err != nil {
+		log.Printf("Error uploading to S3: %s\n", err)
+		return err
+	}
+
+	return r.Db.SaveFile(&File{
+		FileId:        Uuid(),
+		ImageId:       image.ImageId,
+		ImportBatchId: image.ImportBatchId,
+		Filename:      filename,
+		StoragePath:   storagePath,
+		PublicURL:     PublicImageURL(r.Config.S3BaseUrl, storagePath),
+		IsOriginal:    isOriginal,
+		Width:         uint64(width),
+		Height:        uint64(height),
+		Format:        format,
+		MediaType:     FILE_MEDIA_VIDEO,
+	})
+}
+
+// Transcodes a video and stores the result, sized from its poster frame
+func processVideo(ctx context.Context, r *Resources, image *ImageImport, key string, file []byte, poster []byte, suffix string) error {
+	width, height, err := getImageSize(poster)
+	if err != nil {
+		return err
+	}
+	width, height = ResizeLongEdgeDimensions(width, height, VIDEO_LONG_EDGE)
+
+	log.Printf("Transcoding video, imageId: %s\n", image.ImageId)
+	transcoded, err := transcodeVideo(ctx, image, key, file)
+	if err != nil {
+		return err
+	}
+
+	return storeVideoFile(ctx, r, image, transcoded, image.ImageId+suffix+".mp4", "mp4", false, width, height)
+}
+
+func ProcessVideoTranscode(ctx context.Context, r *Resources, wg *sync.WaitGroup, image *ImageImport, file []byte, poster []byte) error {
+	defer wg.Done()
+
+	err := processVideo(ctx, r, image, image.OriginalFileKey, file, poster, VIDEO_SUFFIX)
+	if err != nil {
+		log.Printf("Error transcoding video: %s\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// Stores the motion clip of a Live Photo alongside the still, keeping the
+// uploaded clip and a transcoded copy for playback
+func ProcessLivePhotoMotion(ctx context.Context, r *Resources, wg *sync.WaitGroup, image *ImageImport, still []byte) error {
+	defer wg.Done()
+
+	motion, err := r.Storage.GetFile(ctx, image.PairedVideoKey)
+	if err != nil {
+		log.Printf("Error getting Live Photo motion from storage: %s\n", err)
+		return err
+	}
+
+	width, height, err := getImageSize(still)
+	if err != nil {
+		return err
+	}
+
+	motion, _, err = ScrubMetadata(ctx, r, image, image.PrivacyPolicy, image.PairedVideoKey, motion)
+	if err != nil {
+		log.Printf("Error scrubbing Live Photo motion metadata: %s\n", err)
+		return err
+	}
+
+	format := FormatFromExtension(GetExtension(image.PairedVideoKey))
+	filename := image.ImageId + MOTION_SUFFIX + GetExtension(image.PairedVideoKey)
+
+	err = storeVideoFile(ctx, r, image, motion, filename, format, true, width, height)
+	if err != nil {
+		log.Printf("Error storing Live Photo motion: %s\n", err)
+		return err
+	}
+
+	err = processVideo(ctx, r, image, image.PairedVideoKey, motion, still, MOTION_SUFFIX)
+	if err != nil {
+		log.Printf("Error transcoding Live Photo motion: %s\n", err)
+		return err
+	}
+
+	return nil
+}
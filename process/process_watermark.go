@@ -0,0 +1,107 @@
+package process
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"unicode/utf8"
+
+	. "github.com/eburlingame/fstop/models"
+	. "github.com/eburlingame/fstop/utils"
+
+	"github.com/h2non/bimg"
+)
+
+// Space between the watermark and the edges, as a fraction of the long edge
+const WATERMARK_MARGIN = 0.02
+
+// Rough width of a character relative to the font size, used to fit text
+// watermarks to the requested width
+const WATERMARK_CHAR_WIDTH = 0.6
+
+// Renders a text watermark as a PNG by rasterizing an SVG of the given width
+func renderWatermarkText(text string, width int) ([]byte, error) {
+	var escaped bytes.Buffer
+	if err := xml.EscapeText(&escaped, []byte(text)); err != nil {
+		return nil, err
+	}
+
+	fontSize := float64(width) / (WATERMARK_CHAR_WIDTH * float64(utf8.RuneCountInString(text)))
+	height := int(math.Ceil(fontSize * 1.3))
+
+	svg := fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+
+			`<text x="50%%" y="50%%" dominant-baseline="middle" text-anchor="middle" `+
+			`font-family="sans-serif" font-weight="bold" font-size="%.1f" `+
+			`fill="#ffffff" stroke="#000000" stroke-opacity="0.4" stroke-width="%.1f" paint-order="stroke">%s</text>`+
+			`</svg>`,
+		width, height, fontSize, fontSize/20, escaped.String())
+
+	return bimg.NewImage([]byte(svg)).Convert(bimg.PNG)
+}
+
+// Scales the logo to the given width, keeping its aspect ratio
+func scaleWatermarkLogo(logo []byte, width int) ([]byte, error) {
+	return bimg.NewImage(logo).Process(bimg.Options{
+		Type:  bimg.PNG,
+		Width: width,
+	})
+}
+
+// Determines the top left corner of the watermark within the derivative
+func getWatermarkOffset(position string, width int, height int, markWidth int, markHeight int, margin int) (int, int) {
+	switch position {
+	case WATERMARK_TOP_LEFT:
+		return margin, margin
+	case WATERMARK_TOP_RIGHT:
+		return width - markWidth - margin, margin
+	case WATERMARK_BOTTOM_LEFT:
+		return margin, height - markHeight - margin
+	case WATERMARK_CENTER:
+		return (width - markWidth) / 2, (height - markHeight) / 2
+	default:
+		return width - markWidth - margin, height - markHeight - margin
+	}
+}
+
+// Builds the watermark overlay for a derivative of the given dimensions
+func getWatermarkImage(settings *WatermarkSettings, width int, height int) (bimg.WatermarkImage, error) {
+	longEdge := GetLongestEdge(width, height)
+	markWidth := int(float64(longEdge) * settings.Scale)
+	margin := int(float64(longEdge) * WATERMARK_MARGIN)
+
+	// Keep the watermark within the derivative, e.g. for square crops
+	if markWidth > width-2*margin {
+		markWidth = width - 2*margin
+	}
+	if markWidth < 1 {
+		return bimg.WatermarkImage{}, fmt.Errorf("derivative is too small to watermark")
+	}
+
+	var mark []byte
+	var err error
+
+	if len(settings.Logo) > 0 {
+		mark, err = scaleWatermarkLogo(settings.Logo, markWidth)
+	} else {
+		mark, err = renderWatermarkText(settings.Text, markWidth)
+	}
+	if err != nil {
+		return bimg.WatermarkImage{}, err
+	}
+
+	markSize, err := bimg.Size(mark)
+	if err != nil {
+		return bimg.WatermarkImage{}, err
+	}
+
+	left, top := getWatermarkOffset(settings.Position, width, height, markSize.Width, markSize.Height, margin)
+
+	return bimg.WatermarkImage{
+		Left:    left,
+		Top:     top,
+		Buf:     mark,
+		Opacity: settings.Opacity,
+	}, nil
+}
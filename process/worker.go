@@ -1,40 +1,360 @@
 package process
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"runtime"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	. "github.com/eburlingame/fstop/models"
 	"github.com/eburlingame/fstop/resources"
+	. "github.com/eburlingame/fstop/utils"
+
+	"github.com/maragudk/goqite"
 )
 
-const NUM_WORKERS = 4
+// Failed tasks are retried until they've been attempted this many times
+const MAX_TASK_ATTEMPTS = 3
 
-func worker(worker_num int, resources *resources.Resources) {
-	queue := resources.Queue
+// How long a worker waits after failing to receive, e.g. while the database
+// is locked
+const RECEIVE_ERROR_DELAY = 5 * time.Second
+
+// Idle workers poll the queue at this interval, doubling up to the maximum
+// while it stays empty. Tasks added in this process wake them immediately.
+const IDLE_MIN_DELAY = 500 * time.Millisecond
+const IDLE_MAX_DELAY = 10 * time.Second
+
+// How often messages which were received too many times are dead-lettered
+const DEAD_LETTER_INTERVAL = 30 * time.Second
+
+// How long workers are given to release their tasks once processing is
+// aborted during shutdown
+const RELEASE_TIMEOUT = 10 * time.Second
+
+// How often the workers of a process report they're alive
+const HEARTBEAT_INTERVAL = 15 * time.Second
+
+// The delay before the first retry, doubled for each one after
+const RETRY_BASE_DELAY = 30 * time.Second
+
+func getRetryDelay(attempts int) time.Duration {
+	return RETRY_BASE_DELAY * time.Duration(1<<uint(attempts-1))
+}
+
+func processTask(ctx context.Context, r *resources.Resources, task ImageImport) error {
+	switch task.Type {
+	case TASK_TYPE_METADATA:
+		return RefreshImageMetadata(ctx, r, task)
+	case TASK_TYPE_CAPTURE_TIME:
+		return WriteCaptureTime(ctx, r, task)
+	case TASK_TYPE_GEOCODE:
+		return GeocodeImage(r, task)
+	default:
+		return ProcessImageImport(ctx, r, task)
+	}
+}
+
+// Processes a task and records the outcome, queueing a retry after a delay if
+// it failed and has attempts remaining. Returns false if the task was
+// interrupted by the context being cancelled, in which case it should be
+// released back to the queue.
+func runTask(ctx context.Context, r *resources.Resources, task ImageImport) bool {
+	attempts := task.Attempt + 1
+	r.Db.UpdateImportTaskState(task.ImportBatchId, task.ImageId, TASK_PROCESSING, "", attempts)
+
+	err := processTask(ctx, r, task)
+	if err == nil {
+		r.Db.UpdateImportTaskState(task.ImportBatchId, task.ImageId, TASK_SUCCEEDED, "", attempts)
+		return true
+	}
+
+	// Interrupted tasks don't count as an attempt
+	if ctx.Err() != nil {
+		log.Printf("Processing of image %s was interrupted\n", task.ImageId)
+		r.Db.UpdateImportTaskState(task.ImportBatchId, task.ImageId, TASK_QUEUED, "Interrupted by a shutdown", task.Attempt)
+		return false
+	}
+
+	log.Printf("Attempt %d of image %s failed: %s\n", attempts, task.ImageId, err)
+
+	if attempts >= MAX_TASK_ATTEMPTS {
+		r.Db.UpdateImportTaskState(task.ImportBatchId, task.ImageId, TASK_FAILED, err.Error(), attempts)
+		return true
+	}
+
+	delay := getRetryDelay(attempts)
+	log.Printf("Retrying image %s in %s\n", task.ImageId, delay)
+
+	task.Attempt = attempts
+	if err := r.Queue.AddDelayedTask(ctx, task, delay); err != nil {
+		log.Printf("Error queueing retry: %s\n", err)
+		r.Db.UpdateImportTaskState(task.ImportBatchId, task.ImageId, TASK_FAILED, err.Error(), attempts)
+		return true
+	}
+
+	r.Db.UpdateImportTaskState(task.ImportBatchId, task.ImageId, TASK_QUEUED, err.Error(), attempts)
+	return true
+}
+
+// Runs the workers which process queued tasks
+type WorkerPool struct {
+	resources *resources.Resources
+	wg        sync.WaitGroup
+
+	// Cancelled to stop receiving new tasks
+	stopping context.Context
+	stop     context.CancelFunc
+
+	// Cancelled to abort the tasks still being processed
+	processing context.Context
+	abort      context.CancelFunc
+
+	heartbeat        WorkerHeartbeat
+	heartbeatDone    chan struct{}
+	heartbeatRemoved chan struct{}
+	activeTasks      int32
+	processed        int32
+}
+
+// Waits for the duration, returning early if the pool is stopping
+func (p *WorkerPool) sleep(duration time.Duration) {
+	select {
+	case <-p.stopping.Done():
+	case <-time.After(duration):
+	}
+}
+
+// Waits for the duration or until a task is added
+func (p *WorkerPool) waitForTasks(duration time.Duration) {
+	select {
+	case <-p.stopping.Done():
+	case <-p.resources.Queue.Notify():
+	case <-time.After(duration):
+	}
+}
+
+// While a task is processing, keeps its message hidden from other workers
+func (p *WorkerPool) extendWhileProcessing(id goqite.ID, done chan struct{}) {
+	ticker := time.NewTicker(resources.QUEUE_TIMEOUT / 2)
+	defer ticker.Stop()
 
-	log.Printf("Worker %d started", worker_num)
 	for {
-		taskId, task, err := queue.Receive()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := p.resources.Queue.Extend(p.processing, id, resources.QUEUE_TIMEOUT); err != nil {
+				log.Printf("Error extending task %s: %s\n", id, err)
+			}
+		}
+	}
+}
+
+// Marks the tasks whose messages were dead-lettered as failed, so their
+// batches stop waiting for them
+func (p *WorkerPool) moveDeadTasks() {
+	r := p.resources
+
+	tasks, err := r.Queue.MoveDeadTasks(p.stopping)
+	if err != nil {
+		log.Printf("Error moving dead tasks: %s\n", err)
+		return
+	}
+
+	for _, task := range tasks {
+		log.Printf("Dead-lettered image %s after %d receives\n", task.ImageId, resources.QUEUE_MAX_RECEIVE)
+		r.Db.UpdateImportTaskState(
+			task.ImportBatchId, task.ImageId, TASK_FAILED,
+			fmt.Sprintf("Moved to the dead-letter queue after %d receives", resources.QUEUE_MAX_RECEIVE),
+			task.Attempt+resources.QUEUE_MAX_RECEIVE,
+		)
+	}
+}
+
+func (p *WorkerPool) deadLetterSweeper() {
+	defer p.wg.Done()
+
+	for p.stopping.Err() == nil {
+		p.moveDeadTasks()
+		p.sleep(DEAD_LETTER_INTERVAL)
+	}
+}
+
+func (p *WorkerPool) process(worker_num int, taskId goqite.ID, task ImageImport) {
+	queue := p.resources.Queue
+
+	done := make(chan struct{})
+	go p.extendWhileProcessing(taskId, done)
+
+	atomic.AddInt32(&p.activeTasks, 1)
+	finished := runTask(p.processing, p.resources, task)
+	atomic.AddInt32(&p.activeTasks, -1)
+	atomic.AddInt32(&p.processed, 1)
+	close(done)
+
+	// The processing context has been cancelled by now if the task wasn't
+	// finished, so the message is updated with a fresh one
+	ctx, cancel := context.WithTimeout(context.Background(), RELEASE_TIMEOUT)
+	defer cancel()
+
+	if !finished {
+		log.Printf("Worker %d releasing task %s\n", worker_num, taskId)
+		if err := queue.Release(ctx, taskId); err != nil {
+			log.Printf("Worker %d failed to release task %s: %s\n", worker_num, taskId, err)
+		}
+		return
+	}
+
+	if err := queue.Done(ctx, taskId); err != nil {
+		log.Printf("Worker %d failed to finish task %s: %s\n", worker_num, taskId, err)
+	}
+}
+
+func (p *WorkerPool) worker(worker_num int) {
+	defer p.wg.Done()
+
+	queue := p.resources.Queue
+
+	idleDelay := IDLE_MIN_DELAY
+
+	log.Printf("Worker %d started", worker_num)
+	for p.stopping.Err() == nil {
+		taskId, task, err := queue.Receive(p.stopping)
 		if err != nil {
-			log.Fatalln(err)
+			if p.stopping.Err() != nil {
+				break
+			}
+
+			log.Printf("Worker %d failed to receive a task: %s\n", worker_num, err)
+			p.sleep(RECEIVE_ERROR_DELAY)
+			continue
+		}
+
+		if task == nil {
+			p.waitForTasks(idleDelay)
+			idleDelay *= 2
+			if idleDelay > IDLE_MAX_DELAY {
+				idleDelay = IDLE_MAX_DELAY
+			}
+			continue
 		}
+		idleDelay = IDLE_MIN_DELAY
+
+		// More tasks may be waiting, so another idle worker is woken to check.
+		// Each worker that finds one wakes the next, until the queue is drained.
+		queue.Wake()
+
+		p.process(worker_num, *taskId, *task)
+	}
+
+	log.Printf("Worker %d stopped", worker_num)
+}
+
+func (p *WorkerPool) reportHeartbeat() {
+	p.heartbeat.ActiveTasks = int(atomic.LoadInt32(&p.activeTasks))
+	p.heartbeat.Processed = int(atomic.LoadInt32(&p.processed))
+
+	metrics := GetProcessingMetrics()
+	p.heartbeat.PeakMemoryBytes = metrics.PeakBytes
+	p.heartbeat.VipsPeakMemoryBytes = metrics.VipsPeakMemory
+	p.heartbeat.LastSeen = time.Now()
+
+	if err := p.resources.Db.SaveWorkerHeartbeat(&p.heartbeat); err != nil {
+		log.Printf("Error saving worker heartbeat: %s\n", err)
+	}
+}
+
+// Reports until the workers have stopped, including while they finish their
+// tasks during a shutdown, then removes the heartbeat
+func (p *WorkerPool) heartbeatReporter() {
+	defer close(p.heartbeatRemoved)
 
-		if task != nil {
-			ProcessImageImport(resources, *task)
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
 
-			if err := queue.Done(*taskId); err != nil {
-				log.Fatalln(err)
+	for {
+		p.reportHeartbeat()
+
+		select {
+		case <-p.heartbeatDone:
+			if err := p.resources.Db.DeleteWorkerHeartbeat(p.heartbeat.WorkerId); err != nil {
+				log.Printf("Error removing worker heartbeat: %s\n", err)
 			}
+			return
+		case <-ticker.C:
 		}
+	}
+}
+
+// Starts the workers, reporting heartbeats under the mode the process was
+// started in
+func InitWorkers(r *resources.Resources, mode string) *WorkerPool {
+	hostname, _ := os.Hostname()
 
-		runtime.Gosched()
-		time.Sleep(1 * time.Second)
+	p := &WorkerPool{
+		resources: r,
+		heartbeat: WorkerHeartbeat{
+			WorkerId:    Uuid(),
+			Hostname:    hostname,
+			Pid:         os.Getpid(),
+			Mode:        mode,
+			WorkerCount: r.Config.WorkerCount,
+			StartedAt:   time.Now(),
+		},
+		heartbeatDone:    make(chan struct{}),
+		heartbeatRemoved: make(chan struct{}),
 	}
+	p.stopping, p.stop = context.WithCancel(context.Background())
+	p.processing, p.abort = context.WithCancel(context.Background())
+
+	go p.heartbeatReporter()
+
+	p.wg.Add(r.Config.WorkerCount + 1)
+	for w := 0; w < r.Config.WorkerCount; w++ {
+		go p.worker(w)
+	}
+
+	go p.deadLetterSweeper()
+
+	return p
 }
 
-func InitWorkers(resources *resources.Resources) {
-	for w := 0; w < NUM_WORKERS; w++ {
-		go worker(w, resources)
+// Stops the workers receiving new tasks and waits for the tasks in progress
+// to finish. If the context is done first, those tasks are aborted and
+// released back to the queue.
+func (p *WorkerPool) Shutdown(ctx context.Context) error {
+	p.stop()
+	defer p.removeHeartbeat()
+
+	stopped := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
 	}
+
+	log.Println("Aborting tasks still being processed")
+	p.abort()
+
+	select {
+	case <-stopped:
+	case <-time.After(RELEASE_TIMEOUT):
+		log.Println("Timed out waiting for workers to release their tasks")
+	}
+
+	return ctx.Err()
+}
+
+func (p *WorkerPool) removeHeartbeat() {
+	close(p.heartbeatDone)
+	<-p.heartbeatRemoved
 }
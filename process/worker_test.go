@@ -0,0 +1,138 @@
+package process
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/eburlingame/fstop/models"
+	"github.com/eburlingame/fstop/resources"
+)
+
+func TestGetRetryDelay(t *testing.T) {
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+
+	for i, delay := range want {
+		if got := getRetryDelay(i + 1); got != delay {
+			t.Errorf("getRetryDelay(%d) = %s, want %s", i+1, got, delay)
+		}
+	}
+}
+
+// Resources backed by a temporary database, without storage. Geocoding tasks
+// fail straight away without a geocoder, and succeed for an image without a
+// location with one.
+func openTestResources(t *testing.T) *resources.Resources {
+	db, err := resources.InitSqliteDatabase(&resources.Configuration{
+		SQLiteFilepath: filepath.Join(t.TempDir(), "fstop.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := resources.InitQueue(db.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &resources.Resources{Config: &resources.Configuration{}, Db: db, Queue: &queue}
+}
+
+// Tracks a geocoding task of a new image, as queueing it would
+func addGeocodeTask(t *testing.T, r *resources.Resources, attempt int) ImageImport {
+	task := ImageImport{Type: TASK_TYPE_GEOCODE, ImageId: "image", ImportBatchId: "batch", Attempt: attempt}
+
+	if err := r.Db.AddImage(&Image{ImageId: task.ImageId}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Db.AddImageImport(&task, "IMG_1.JPG"); err != nil {
+		t.Fatal(err)
+	}
+
+	return task
+}
+
+func getTaskState(t *testing.T, r *resources.Resources) ImageImportTask {
+	var tasks []ImageImportTask
+	r.Db.GetImagesInImportBatch(&tasks, "batch")
+	if len(tasks) != 1 {
+		t.Fatalf("batch has %d tasks, want 1", len(tasks))
+	}
+	return tasks[0]
+}
+
+func TestRunTaskSucceeds(t *testing.T) {
+	r := openTestResources(t)
+	r.Geocoder = &resources.Geocoder{}
+	task := addGeocodeTask(t, r, 0)
+
+	if !runTask(context.Background(), r, task) {
+		t.Fatal("runTask() reported the task as interrupted")
+	}
+
+	state := getTaskState(t, r)
+	if state.State != TASK_SUCCEEDED || !state.IsProcessed || state.Attempts != 1 {
+		t.Errorf("task is %s after %d attempts, processed %v, want succeeded after 1", state.State, state.Attempts, state.IsProcessed)
+	}
+}
+
+func TestRunTaskRetries(t *testing.T) {
+	r := openTestResources(t)
+	task := addGeocodeTask(t, r, 0)
+	ctx := context.Background()
+
+	if !runTask(ctx, r, task) {
+		t.Fatal("runTask() reported the task as interrupted")
+	}
+
+	state := getTaskState(t, r)
+	if state.State != TASK_QUEUED || state.Attempts != 1 || state.Error == "" {
+		t.Errorf("task is %s after %d attempts with error %q, want queued with an error after 1", state.State, state.Attempts, state.Error)
+	}
+
+	// The retry waits out its delay before it can be received
+	retries, err := r.Queue.ListTasks(ctx, QUEUE_STATE_PENDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retries) != 1 || retries[0].Task.Attempt != 1 {
+		t.Fatalf("queued retries = %+v, want one of attempt 1", retries)
+	}
+	if wait := time.Until(retries[0].Timeout); wait < RETRY_BASE_DELAY-time.Second || wait > RETRY_BASE_DELAY+time.Second {
+		t.Errorf("retry is delayed by %s, want %s", wait, RETRY_BASE_DELAY)
+	}
+}
+
+func TestRunTaskFailsOnLastAttempt(t *testing.T) {
+	r := openTestResources(t)
+	task := addGeocodeTask(t, r, MAX_TASK_ATTEMPTS-1)
+
+	runTask(context.Background(), r, task)
+
+	if state := getTaskState(t, r); state.State != TASK_FAILED || state.Attempts != MAX_TASK_ATTEMPTS {
+		t.Errorf("task is %s after %d attempts, want failed after %d", state.State, state.Attempts, MAX_TASK_ATTEMPTS)
+	}
+
+	retries, _ := r.Queue.ListTasks(context.Background(), QUEUE_STATE_PENDING)
+	if len(retries) != 0 {
+		t.Errorf("a failed task was queued again: %+v", retries)
+	}
+}
+
+func TestRunTaskInterrupted(t *testing.T) {
+	r := openTestResources(t)
+	task := addGeocodeTask(t, r, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if runTask(ctx, r, task) {
+		t.Fatal("runTask() didn't report the task as interrupted")
+	}
+
+	// The attempt isn't counted, as the task is released to be received again
+	if state := getTaskState(t, r); state.State != TASK_QUEUED || state.Attempts != 1 {
+		t.Errorf("task is %s after %d attempts, want queued after 1", state.State, state.Attempts)
+	}
+}
@@ -1,9 +1,17 @@
 package resources
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
+
+	. "github.com/eburlingame/fstop/models"
 
 	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
@@ -24,6 +32,160 @@ type Configuration struct {
 	S3MediaFolder  string
 	S3UploadFolder string
 	S3BaseUrl      string
+
+	SizeProfiles *SizeProfileSets
+	Watermark    *WatermarkSettings // Nil when watermarking isn't configured
+
+	DefaultPrivacyPolicy string     // Used for albums without a policy
+	Geofences            []Geofence // Areas where locations are always removed
+
+	DefaultTimezone *time.Location // Assumed for capture times without a UTC offset
+
+	GeonamesCitiesFile string // GeoNames cities the locations of images are named from
+
+	MapTileUrl         string // Leaflet URL template of the map tiles
+	MapTileAttribution string // Credit for the tiles, which may contain HTML
+
+	ShutdownTimeout time.Duration // How long to wait for requests and tasks to finish when stopping
+
+	WorkerCount       int // Number of tasks processed at once
+	ResizeParallelism int // Number of sizes of a task resized at once, within MaxConcurrentDecodes
+
+	ProcessingMemoryMB   int // Estimated memory all decodes together may use
+	MaxConcurrentDecodes int // Decodes running at once across all workers
+	VipsCacheMB          int // Memory libvips may use to cache operations
+	ExiftoolPoolSize     int // Long-lived exiftool processes shared by the workers
+}
+
+const DEFAULT_WORKER_COUNT = 4
+const DEFAULT_PROCESSING_MEMORY_MB = 1024
+
+const DEFAULT_MAP_TILE_URL = "https://tile.openstreetmap.org/{z}/{x}/{y}.png"
+const DEFAULT_MAP_TILE_ATTRIBUTION = `&copy; <a href="https://www.openstreetmap.org/copyright">OpenStreetMap</a> contributors`
+
+// Parses an optional integer setting
+func loadInt(name string, value string, fallback int, minimum int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, err)
+	}
+	if parsed < minimum {
+		return 0, fmt.Errorf("%s must be at least %d", name, minimum)
+	}
+
+	return parsed, nil
+}
+
+// Loads the size profile sets from a JSON file, falling back to the built-in
+// sizes when no file is configured
+func loadSizeProfiles(path string, extraFormats string) (*SizeProfileSets, error) {
+	profiles := DefaultSizeProfileSets()
+
+	if path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		profiles = &SizeProfileSets{}
+		if err := json.Unmarshal(contents, profiles); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, format := range strings.Split(extraFormats, ",") {
+		format = strings.TrimSpace(format)
+		if format != "" {
+			profiles.ExtraFormats = append(profiles.ExtraFormats, format)
+		}
+	}
+
+	if err := profiles.Normalize(); err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+// Loads the watermark settings, returning nil when neither text nor a logo is
+// configured
+func loadWatermark(text string, logoPath string, position string, opacity string, scale string) (*WatermarkSettings, error) {
+	if text == "" && logoPath == "" {
+		return nil, nil
+	}
+
+	watermark := &WatermarkSettings{
+		Text:     text,
+		Position: position,
+	}
+
+	if logoPath != "" {
+		logo, err := ioutil.ReadFile(logoPath)
+		if err != nil {
+			return nil, err
+		}
+		watermark.Logo = logo
+	}
+
+	if opacity != "" {
+		value, err := strconv.ParseFloat(opacity, 32)
+		if err != nil {
+			return nil, err
+		}
+		watermark.Opacity = float32(value)
+	}
+
+	if scale != "" {
+		value, err := strconv.ParseFloat(scale, 64)
+		if err != nil {
+			return nil, err
+		}
+		watermark.Scale = value
+	}
+
+	if err := watermark.Normalize(); err != nil {
+		return nil, err
+	}
+
+	return watermark, nil
+}
+
+// Parses a list of geofences of the form "lat,lon,radiusMeters;lat,lon,radiusMeters"
+func loadGeofences(value string) ([]Geofence, error) {
+	geofences := []Geofence{}
+
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ",")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("geofence %s must be latitude,longitude,radius", entry)
+		}
+
+		values := []float64{}
+		for _, part := range parts {
+			value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("geofence %s: %s", entry, err)
+			}
+			values = append(values, value)
+		}
+
+		geofences = append(geofences, Geofence{
+			Latitude:     values[0],
+			Longitude:    values[1],
+			RadiusMeters: values[2],
+		})
+	}
+
+	return geofences, nil
 }
 
 func GetConfig() *Configuration {
@@ -51,6 +213,85 @@ func GetConfig() *Configuration {
 		viewPasswordBytes = append(viewPasswordBytes, viewerHashedPassword)
 	}
 
+	sizeProfiles, err := loadSizeProfiles(os.Getenv("SIZE_PROFILES_FILE"), os.Getenv("EXTRA_IMAGE_FORMATS"))
+	if err != nil {
+		panic(err)
+	}
+
+	watermark, err := loadWatermark(
+		os.Getenv("WATERMARK_TEXT"),
+		os.Getenv("WATERMARK_LOGO_FILE"),
+		os.Getenv("WATERMARK_POSITION"),
+		os.Getenv("WATERMARK_OPACITY"),
+		os.Getenv("WATERMARK_SCALE"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	privacyPolicy := os.Getenv("PRIVACY_POLICY")
+	if privacyPolicy == "" {
+		privacyPolicy = PRIVACY_KEEP
+	}
+	if !IsValidPrivacyPolicy(privacyPolicy) {
+		panic("unknown privacy policy " + privacyPolicy)
+	}
+
+	geofences, err := loadGeofences(os.Getenv("GEOFENCES"))
+	if err != nil {
+		panic(err)
+	}
+
+	defaultTimezone, err := time.LoadLocation(os.Getenv("DEFAULT_TIMEZONE"))
+	if err != nil {
+		panic(err)
+	}
+
+	mapTileUrl := os.Getenv("MAP_TILE_URL")
+	mapTileAttribution := os.Getenv("MAP_TILE_ATTRIBUTION")
+	if mapTileUrl == "" {
+		mapTileUrl = DEFAULT_MAP_TILE_URL
+		mapTileAttribution = DEFAULT_MAP_TILE_ATTRIBUTION
+	}
+
+	shutdownTimeout := 30 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		shutdownTimeout, err = time.ParseDuration(value)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	workerCount, err := loadInt("WORKER_COUNT", os.Getenv("WORKER_COUNT"), DEFAULT_WORKER_COUNT, 1)
+	if err != nil {
+		panic(err)
+	}
+
+	resizeParallelism, err := loadInt("RESIZE_PARALLELISM", os.Getenv("RESIZE_PARALLELISM"), runtime.NumCPU(), 1)
+	if err != nil {
+		panic(err)
+	}
+
+	processingMemory, err := loadInt("PROCESSING_MEMORY_MB", os.Getenv("PROCESSING_MEMORY_MB"), DEFAULT_PROCESSING_MEMORY_MB, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	maxDecodes, err := loadInt("MAX_CONCURRENT_DECODES", os.Getenv("MAX_CONCURRENT_DECODES"), runtime.NumCPU(), 1)
+	if err != nil {
+		panic(err)
+	}
+
+	vipsCache, err := loadInt("VIPS_CACHE_MB", os.Getenv("VIPS_CACHE_MB"), 0, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	exiftoolPoolSize, err := loadInt("EXIFTOOL_POOL_SIZE", os.Getenv("EXIFTOOL_POOL_SIZE"), workerCount, 1)
+	if err != nil {
+		panic(err)
+	}
+
 	return &Configuration{
 		Secret:         os.Getenv("SECRET"),
 		ApiKey:         os.Getenv("API_KEY"),
@@ -65,5 +306,28 @@ func GetConfig() *Configuration {
 		S3MediaFolder:  os.Getenv("S3_BUCKET_MEDIA_FOLDER"),
 		S3UploadFolder: os.Getenv("S3_BUCKET_UPLOAD_FOLDER"),
 		S3BaseUrl:      os.Getenv("S3_BUCKET_PUBLIC_BASE_URL"),
+
+		SizeProfiles: sizeProfiles,
+		Watermark:    watermark,
+
+		DefaultPrivacyPolicy: privacyPolicy,
+		Geofences:            geofences,
+
+		DefaultTimezone: defaultTimezone,
+
+		GeonamesCitiesFile: os.Getenv("GEONAMES_CITIES_FILE"),
+
+		MapTileUrl:         mapTileUrl,
+		MapTileAttribution: mapTileAttribution,
+
+		ShutdownTimeout: shutdownTimeout,
+
+		WorkerCount:       workerCount,
+		ResizeParallelism: resizeParallelism,
+
+		ProcessingMemoryMB:   processingMemory,
+		MaxConcurrentDecodes: maxDecodes,
+		VipsCacheMB:          vipsCache,
+		ExiftoolPoolSize:     exiftoolPoolSize,
 	}
 }
@@ -1,8 +1,10 @@
 package resources
 
 import (
+	"encoding/json"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	. "github.com/eburlingame/fstop/models"
@@ -10,6 +12,7 @@ import (
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
@@ -20,20 +23,41 @@ type Database interface {
 	GetImagesInImportBatch(images *[]ImageImportTask, batchId string)
 	AddImage(image *Image) error
 	DeleteImage(imageId string) error
-
-	AddImageImport(importBatchId string, imageId string, filename string) error
-	UpdateImageProcessedStatus(imageId string, isProcessed bool) error
+	UpdateImageVisibility(imageId string, visibility string) error
+	UpdateImagePlaceholder(imageId string, placeholder string, dominantColor string) error
+	ClearImageLocation(imageId string) error
+	UpdateImageDimensions(imageId string, width int, height int) error
+	UpdateImageFields(image *Image, fields []string) error
+	UpdateImagesFields(images []Image, fields []string) error
+	ListSelectedImages(selection ImageSelection) ([]Image, error)
+	ListLocatedImages() ([]Image, error)
+	SaveImageMetadata(metadata *ImageMetadata) error
+	GetImageMetadata(metadata *ImageMetadata, imageId string) error
+
+	GetImageEdit(edit *ImageEdit, imageId string) error
+	SaveImageEdit(edit *ImageEdit) error
+	DeleteImageEdit(imageId string) error
+	IsImageVisible(imageId string) (bool, error)
+
+	AddImageImport(task *ImageImport, filename string) error
+	UpdateImportTaskState(importBatchId string, imageId string, state string, message string, attempts int) error
+	UpdateImportTaskChanges(importBatchId string, imageId string, changes []string) error
+	ListFailedImportTasks(importBatchId string) ([]ImageImportTask, error)
 
 	ListLatestFiles(minWidth int, limit int, offset int) ([]File, error)
-	ListLatestImages(limit int, offset int) ([]Image, error)
+	ListLatestImages(publicOnly bool, placeFilter PlaceFilter, limit int, offset int) ([]Image, error)
+	ListMapImages(mapQuery MapQuery) ([]Image, error)
 
-	AddFile(file *File) error
+	SaveFile(file *File) error
+	DeleteFile(fileId string) error
 	GetFile(file *File, fileId string, minWidth int) error
 	ListImageFiles(file *[]File, imageId string) error
 	ListOriginalImageFiles(files *[]File) error
 	ListFiles(file *[]File) error
 
 	ListAlbums(album *[]Album) error
+	ListImageAlbums(imageId string) ([]Album, error)
+	ListAlbumImageIds(albumId string) ([]string, error)
 	ListAlbumsCovers(publishedOnly bool, minWidth int, limit int, offset int) ([]AlbumListing, error)
 
 	GetAlbum(album *Album, albumId string) error
@@ -44,7 +68,11 @@ type Database interface {
 	AddImageToAlbum(albumId string, imageId string) error
 	RemoveImageFromAlbum(albumId string, imageId string) error
 	ListAlbumImages(albumSlug string, minWidth int, limit int, offset int) ([]File, error)
-	ListAlbumFiles(albumSlug string) ([]AlbumWithImage, error)
+	ListAlbumFiles(albumSlug string, includeHidden bool) ([]AlbumWithImage, error)
+
+	SaveWorkerHeartbeat(heartbeat *WorkerHeartbeat) error
+	DeleteWorkerHeartbeat(workerId string) error
+	ListWorkerHeartbeats(heartbeats *[]WorkerHeartbeat) error
 }
 
 type SqliteDatabase struct {
@@ -71,14 +99,21 @@ const AlbumCovers string = `
 			a.description,
 			a.name,
 			a.is_published,
-			(CASE WHEN a.cover_image_id <> "" 
-				THEN a.cover_image_id 
-				ELSE (SELECT ai.image_id 
-						FROM album_with_images ai 
-						WHERE ai.album_id = a.album_id 
-						ORDER BY date_time_original DESC
-						LIMIT 1)
-			END) AS cover_image_id,
+			-- A chosen cover which was since hidden or removed from the album
+			-- falls back to the latest visible image
+			COALESCE(
+				(SELECT ai.image_id
+					FROM album_with_images ai
+					WHERE ai.album_id = a.album_id
+					AND ai.image_id = a.cover_image_id
+					AND ai.visibility <> 'hidden'),
+				(SELECT ai.image_id 
+					FROM album_with_images ai 
+					WHERE ai.album_id = a.album_id 
+					AND ai.visibility <> 'hidden'
+					ORDER BY date_time_original DESC
+					LIMIT 1)
+			) AS cover_image_id,
 			(SELECT 
 				MAX(date_time_original) 
 				FROM album_images ai2
@@ -88,6 +123,84 @@ const AlbumCovers string = `
 		FROM albums a;
 `
 
+// Files generated before the format was recorded were all WebP derivatives
+const BackfillFileFormats string = `
+	UPDATE files
+	SET format = 'webp'
+	WHERE (format IS NULL OR format = '')
+		AND is_original = false
+		AND storage_path LIKE '%.webp';
+`
+
+// Capture times were read as UTC before the local time was stored, so those
+// read without an offset hold the local time. Refreshing the metadata of an
+// image sets its offset.
+const BackfillImageLocalTimes string = `
+	UPDATE images
+	SET date_time_local = date_time_original
+	WHERE date_time_local IS NULL;
+`
+
+// Re-rendering used to add a record for every run, of which the latest is
+// kept. Files are unique by path afterwards, which SaveFile relies on.
+const DeduplicateFiles string = `
+	DELETE FROM files
+	WHERE rowid NOT IN (
+		SELECT MAX(rowid) FROM files GROUP BY image_id, storage_path
+	);
+`
+
+const FilesStoragePathIndex string = `
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_files_image_storage_path
+	ON files (image_id, storage_path);
+`
+
+// Tasks tracked before they had states were only marked once processed
+const BackfillImportTaskStates string = `
+	UPDATE image_import_tasks
+	SET state = 'succeeded'
+	WHERE is_processed = true
+		AND (state IS NULL OR state = 'queued');
+`
+
+// An image is shown on the public stream when it is public and is either in
+// no album at all, or in at least one published album
+const streamVisibleCondition string = `
+	images.visibility = 'public' AND (
+		NOT EXISTS (
+			SELECT 1 FROM album_images ai
+			WHERE ai.image_id = images.image_id)
+		OR EXISTS (
+			SELECT 1 FROM album_images ai
+			INNER JOIN albums a ON a.album_id = ai.album_id
+			WHERE ai.image_id = images.image_id AND a.is_published = 1)
+	)
+`
+
+// An image can be viewed directly when it is on the public stream, or when it
+// is not hidden and belongs to a published album
+const viewableCondition string = `
+	(` + streamVisibleCondition + `) OR (
+		images.visibility <> 'hidden' AND EXISTS (
+			SELECT 1 FROM album_images ai
+			INNER JOIN albums a ON a.album_id = ai.album_id
+			WHERE ai.image_id = images.image_id AND a.is_published = 1)
+	)
+`
+
+// The location of an image is only published when none of its albums has a
+// privacy policy which removes it. Albums without a policy of their own, and
+// images in no album, use the default policy, passed as both arguments.
+const locationPublishedCondition string = `
+	images.latitude IS NOT NULL AND images.longitude IS NOT NULL AND NOT EXISTS (
+		SELECT 1 FROM album_images ai
+		INNER JOIN albums a ON a.album_id = ai.album_id
+		WHERE ai.image_id = images.image_id
+			AND COALESCE(NULLIF(a.privacy_policy, ''), ?) IN ('` + PRIVACY_STRIP_GPS + `', '` + PRIVACY_STRIP_ALL + `'))
+	AND (? NOT IN ('` + PRIVACY_STRIP_GPS + `', '` + PRIVACY_STRIP_ALL + `')
+		OR EXISTS (SELECT 1 FROM album_images ai WHERE ai.image_id = images.image_id))
+`
+
 type AlbumCover struct {
 	AlbumId      string
 	Slug         string
@@ -124,9 +237,17 @@ func InitSqliteDatabase(config *Configuration) (*SqliteDatabase, error) {
 	db.AutoMigrate(&Album{})
 	db.AutoMigrate(&AlbumImage{})
 	db.AutoMigrate(&ImageImportTask{})
+	db.AutoMigrate(&ImageEdit{})
+	db.AutoMigrate(&WorkerHeartbeat{})
+	db.AutoMigrate(&ImageMetadata{})
 
 	db.Exec(AlbumWithImagesView)
 	db.Exec(AlbumCovers)
+	db.Exec(BackfillFileFormats)
+	db.Exec(BackfillImportTaskStates)
+	db.Exec(BackfillImageLocalTimes)
+	db.Exec(DeduplicateFiles)
+	db.Exec(FilesStoragePathIndex)
 
 	base := &SqliteDatabase{
 		Db: db,
@@ -140,10 +261,9 @@ func (d *SqliteDatabase) GetImage(image *Image, fileId string) error {
 	return nil
 }
 
+// Inserts an image, or replaces it when a retried import already added it
 func (d *SqliteDatabase) AddImage(image *Image) error {
-	d.Db.Create(image)
-
-	return nil
+	return d.Db.Clauses(clause.OnConflict{UpdateAll: true}).Create(image).Error
 }
 
 func (d *SqliteDatabase) DeleteImage(imageId string) error {
@@ -151,34 +271,222 @@ func (d *SqliteDatabase) DeleteImage(imageId string) error {
 	d.Db.Where("image_id = ?", imageId).Delete(&AlbumImage{})
 	d.Db.Where("image_id = ?", imageId).Delete(&File{})
 	d.Db.Where("image_id = ?", imageId).Delete(&ImageImportTask{})
+	d.Db.Where("image_id = ?", imageId).Delete(&ImageEdit{})
+	d.Db.Where("image_id = ?", imageId).Delete(&ImageMetadata{})
 
 	return nil
 }
 
-func (d *SqliteDatabase) AddImageImport(importBatchId string, imageId string, filename string) error {
-	d.Db.Create(&ImageImportTask{
-		ImageId:       imageId,
+func (d *SqliteDatabase) UpdateImageVisibility(imageId string, visibility string) error {
+	return d.Db.Model(&Image{}).
+		Where("image_id = ?", imageId).
+		Update("visibility", visibility).Error
+}
+
+func (d *SqliteDatabase) UpdateImagePlaceholder(imageId string, placeholder string, dominantColor string) error {
+	return d.Db.Model(&Image{}).
+		Where("image_id = ?", imageId).
+		Updates(map[string]interface{}{
+			"placeholder":    placeholder,
+			"dominant_color": dominantColor,
+		}).Error
+}
+
+func (d *SqliteDatabase) ClearImageLocation(imageId string) error {
+	err := d.Db.Model(&Image{}).
+		Where("image_id = ?", imageId).
+		Updates(map[string]interface{}{
+			"gps_altitude":      "",
+			"gps_dest_bearing":  "",
+			"gps_img_direction": "",
+			"gps_latitude":      "",
+			"gps_longitude":     "",
+			"gps_position":      "",
+			"gps_speed":         "",
+			"latitude":          nil,
+			"longitude":         nil,
+			"altitude_meters":   nil,
+			"country_code":      "",
+			"country":           "",
+			"region":            "",
+			"city":              "",
+		}).Error
+	if err != nil {
+		return err
+	}
+
+	var metadata ImageMetadata
+	if err := d.GetImageMetadata(&metadata, imageId); err != nil || metadata.ImageId == "" {
+		return err
+	}
+
+	tags := metadata.TagMap()
+	RemoveLocationTags(tags)
+
+	stripped, err := NewImageMetadata(imageId, tags)
+	if err != nil {
+		return err
+	}
+
+	return d.SaveImageMetadata(stripped)
+}
+
+func (d *SqliteDatabase) UpdateImageDimensions(imageId string, width int, height int) error {
+	return d.Db.Model(&Image{}).
+		Where("image_id = ?", imageId).
+		Updates(map[string]interface{}{
+			"width_pixels":  width,
+			"height_pixels": height,
+		}).Error
+}
+
+// Updates only the named fields of the image, so zero values are written too
+func (d *SqliteDatabase) UpdateImageFields(image *Image, fields []string) error {
+	return d.Db.Model(&Image{}).
+		Where("image_id = ?", image.ImageId).
+		Select(fields).
+		Updates(image).Error
+}
+
+// Updates the fields of several images in one transaction, so either every
+// image is updated or none are
+func (d *SqliteDatabase) UpdateImagesFields(images []Image, fields []string) error {
+	return d.Db.Transaction(func(tx *gorm.DB) error {
+		for i := range images {
+			err := tx.Model(&Image{}).
+				Where("image_id = ?", images[i].ImageId).
+				Select(fields).
+				Updates(&images[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Lists the images matching every criterion of the selection, oldest first
+func (d *SqliteDatabase) ListSelectedImages(selection ImageSelection) ([]Image, error) {
+	var images []Image
+
+	query := d.Db.Model(&Image{})
+	if selection.AlbumId != "" {
+		query = query.Where("image_id IN (SELECT image_id FROM album_images WHERE album_id = ?)", selection.AlbumId)
+	}
+	if selection.ImportBatchId != "" {
+		query = query.Where("import_batch_id = ?", selection.ImportBatchId)
+	}
+	if selection.SerialNumber != "" {
+		query = query.Where("serial_number = ?", selection.SerialNumber)
+	}
+
+	err := query.Order("date_time_original ASC").Find(&images).Error
+
+	return images, err
+}
+
+// Lists the images with a location, including those which only have the
+// GPSPosition string
+func (d *SqliteDatabase) ListLocatedImages() ([]Image, error) {
+	var images []Image
+
+	err := d.Db.
+		Where("latitude IS NOT NULL OR gps_position <> ''").
+		Find(&images).Error
+
+	return images, err
+}
+
+func (d *SqliteDatabase) SaveImageMetadata(metadata *ImageMetadata) error {
+	return d.Db.Save(metadata).Error
+}
+
+// Leaves the metadata empty if none was stored for the image
+func (d *SqliteDatabase) GetImageMetadata(metadata *ImageMetadata, imageId string) error {
+	return d.Db.Where("image_id = ?", imageId).Limit(1).Find(metadata).Error
+}
+
+// Leaves the edit empty if the image has never been edited
+func (d *SqliteDatabase) GetImageEdit(edit *ImageEdit, imageId string) error {
+	return d.Db.Where("image_id = ?", imageId).Limit(1).Find(edit).Error
+}
+
+func (d *SqliteDatabase) SaveImageEdit(edit *ImageEdit) error {
+	return d.Db.Save(edit).Error
+}
+
+func (d *SqliteDatabase) DeleteImageEdit(imageId string) error {
+	return d.Db.Delete(&ImageEdit{}, "image_id = ?", imageId).Error
+}
+
+func (d *SqliteDatabase) IsImageVisible(imageId string) (bool, error) {
+	var count int64
+
+	err := d.Db.Model(&Image{}).
+		Where("image_id = ?", imageId).
+		Where(viewableCondition).
+		Count(&count).Error
+
+	return count > 0, err
+}
+
+func (d *SqliteDatabase) AddImageImport(task *ImageImport, filename string) error {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	return d.Db.Create(&ImageImportTask{
+		ImageId:       task.ImageId,
 		Filename:      filename,
-		ImportBatchId: importBatchId,
+		ImportBatchId: task.ImportBatchId,
 		IsProcessed:   false,
-	})
+		State:         TASK_QUEUED,
+		Payload:       string(payload),
+	}).Error
+}
 
-	return nil
+func (d *SqliteDatabase) UpdateImportTaskState(importBatchId string, imageId string, state string, message string, attempts int) error {
+	return d.Db.Model(&ImageImportTask{}).
+		Where("import_batch_id = ? AND image_id = ?", importBatchId, imageId).
+		Updates(map[string]interface{}{
+			"state":        state,
+			"error":        message,
+			"attempts":     attempts,
+			"is_processed": state == TASK_SUCCEEDED,
+		}).Error
 }
 
-func (d *SqliteDatabase) UpdateImageProcessedStatus(imageId string, isProcessed bool) error {
-	var imageImport ImageImportTask
+func (d *SqliteDatabase) UpdateImportTaskChanges(importBatchId string, imageId string, changes []string) error {
+	return d.Db.Model(&ImageImportTask{}).
+		Where("import_batch_id = ? AND image_id = ?", importBatchId, imageId).
+		Update("changes", strings.Join(changes, ",")).Error
+}
 
-	d.Db.First(&imageImport, "image_id = ?", imageId)
-	d.Db.Model(&imageImport).Update("IsProcessed", isProcessed)
+func (d *SqliteDatabase) ListFailedImportTasks(importBatchId string) ([]ImageImportTask, error) {
+	var tasks []ImageImportTask
 
-	return nil
+	err := d.Db.
+		Where("import_batch_id = ? AND state = ?", importBatchId, TASK_FAILED).
+		Find(&tasks).Error
+
+	return tasks, err
 }
 
-func (d *SqliteDatabase) AddFile(file *File) error {
-	d.Db.Create(file)
+// Inserts a file, or updates the file already stored at the same path for the
+// image, so regenerating a derivative doesn't add a second record for it
+func (d *SqliteDatabase) SaveFile(file *File) error {
+	return d.Db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "image_id"}, {Name: "storage_path"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"import_batch_id", "filename", "public_url", "is_original", "width", "height",
+			"size_name", "size_hash", "is_cropped", "format", "media_type",
+		}),
+	}).Create(file).Error
+}
 
-	return nil
+func (d *SqliteDatabase) DeleteFile(fileId string) error {
+	return d.Db.Delete(&File{}, "file_id = ?", fileId).Error
 }
 
 func preloadFilesQuery(db *gorm.DB) *gorm.DB {
@@ -207,10 +515,70 @@ func (d *SqliteDatabase) ListLatestFiles(minWidth int, limit int, offset int) ([
 	return sizedFiles, nil
 }
 
-func (d *SqliteDatabase) ListLatestImages(limit int, offset int) ([]Image, error) {
+// Escapes the wildcards of a LIKE pattern, for use with ESCAPE '\'
+var likePatternEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLikePattern(value string) string {
+	return likePatternEscaper.Replace(value)
+}
+
+// The condition matching the images located within the bounds
+func boundsCondition(bounds MapBounds) (string, []interface{}) {
+	if bounds.CrossesAntimeridian() {
+		return "(images.latitude BETWEEN ? AND ? AND (images.longitude >= ? OR images.longitude <= ?))",
+			[]interface{}{bounds.South, bounds.North, bounds.West, bounds.East}
+	}
+
+	return "(images.latitude BETWEEN ? AND ? AND images.longitude BETWEEN ? AND ?)",
+		[]interface{}{bounds.South, bounds.North, bounds.West, bounds.East}
+}
+
+// Narrows the query to the images taken in the place. Names are matched
+// without regard to case, and searches match part of any of them. Images whose
+// location isn't published aren't matched, and neither are those around a
+// geofence, which is matched by the box containing it.
+func filterPlace(query *gorm.DB, placeFilter PlaceFilter) *gorm.DB {
+	if placeFilter.IsEmpty() {
+		return query
+	}
+
+	query = query.Where(locationPublishedCondition, placeFilter.DefaultPrivacyPolicy, placeFilter.DefaultPrivacyPolicy)
+	for _, geofence := range placeFilter.Geofences {
+		condition, args := boundsCondition(geofence.Bounds())
+		query = query.Where("NOT "+condition, args...)
+	}
+
+	if placeFilter.Country != "" {
+		query = query.Where("(country_code = ? COLLATE NOCASE OR country = ? COLLATE NOCASE)",
+			placeFilter.Country, placeFilter.Country)
+	}
+	if placeFilter.Region != "" {
+		query = query.Where("region = ? COLLATE NOCASE", placeFilter.Region)
+	}
+	if placeFilter.City != "" {
+		query = query.Where("city = ? COLLATE NOCASE", placeFilter.City)
+	}
+
+	for _, term := range strings.Fields(placeFilter.Search) {
+		pattern := "%" + escapeLikePattern(term) + "%"
+		query = query.Where(`(city LIKE ? ESCAPE '\' OR region LIKE ? ESCAPE '\' OR country LIKE ? ESCAPE '\'
+			OR country_code = ? COLLATE NOCASE)`,
+			pattern, pattern, pattern, term)
+	}
+
+	return query
+}
+
+func (d *SqliteDatabase) ListLatestImages(publicOnly bool, placeFilter PlaceFilter, limit int, offset int) ([]Image, error) {
 	var images []Image
 
-	d.Db.Preload("Files", preloadFilesQuery).
+	query := d.Db.Preload("Files", preloadFilesQuery)
+	if publicOnly {
+		query = query.Where(streamVisibleCondition)
+	}
+	query = filterPlace(query, placeFilter)
+
+	query.
 		Limit(limit).
 		Offset(offset).
 		Order("date_time_original desc").
@@ -219,6 +587,36 @@ func (d *SqliteDatabase) ListLatestImages(limit int, offset int) ([]Image, error
 	return images, nil
 }
 
+// Lists the images with a published location within the bounds, latest first
+func (d *SqliteDatabase) ListMapImages(mapQuery MapQuery) ([]Image, error) {
+	var images []Image
+
+	query := d.Db.Preload("Files", preloadFilesQuery).
+		Where(locationPublishedCondition, mapQuery.DefaultPrivacyPolicy, mapQuery.DefaultPrivacyPolicy)
+
+	if mapQuery.AlbumSlug != "" {
+		query = query.Where(`images.image_id IN (
+			SELECT ai.image_id FROM album_images ai
+			INNER JOIN albums a ON a.album_id = ai.album_id
+			WHERE a.slug = ?)`, mapQuery.AlbumSlug)
+		if !mapQuery.IncludeHidden {
+			query = query.Where("images.visibility <> ?", VISIBILITY_HIDDEN)
+		}
+	} else {
+		query = query.Where(streamVisibleCondition)
+	}
+
+	condition, args := boundsCondition(mapQuery.Bounds)
+	query = query.Where(condition, args...)
+
+	err := query.
+		Order("date_time_original DESC").
+		Limit(mapQuery.Limit).
+		Find(&images).Error
+
+	return images, err
+}
+
 type AlbumListing struct {
 	AlbumId      string
 	Slug         string
@@ -268,7 +666,7 @@ func (d *SqliteDatabase) ListAlbumsCovers(publishedOnly bool, minWidth int, limi
 func (d *SqliteDatabase) GetFile(file *File, fileId string, minWidth int) error {
 	d.Db.
 		Order("width asc").
-		Where("image_id = ? AND width > ?", fileId, minWidth).
+		Where("image_id = ? AND width > ? AND media_type = ?", fileId, minWidth, FILE_MEDIA_IMAGE).
 		First(file)
 
 	return nil
@@ -283,9 +681,13 @@ func (d *SqliteDatabase) ListImageFiles(files *[]File, imageId string) error {
 	return nil
 }
 
+// Lists the original each image was imported from. The motion clip of a Live
+// Photo is kept as an original too, but renditions are made from the still.
 func (d *SqliteDatabase) ListOriginalImageFiles(files *[]File) error {
 	d.Db.
 		Where("is_original = ?", true).
+		Where("media_type = ? OR image_id IN (SELECT image_id FROM images WHERE media_type = ?)",
+			FILE_MEDIA_IMAGE, MEDIA_TYPE_VIDEO).
 		Find(files)
 
 	return nil
@@ -318,11 +720,14 @@ func (d *SqliteDatabase) UpdateAlbum(albumId string, updatedAlbum *Album) error
 	d.Db.Model(&Album{}).
 		Where("album_id = ?", albumId).
 		Updates(map[string]interface{}{
-			"slug":           updatedAlbum.Slug,
-			"name":           updatedAlbum.Name,
-			"description":    updatedAlbum.Description,
-			"cover_image_id": updatedAlbum.CoverImageId,
-			"is_published":   updatedAlbum.IsPublished,
+			"slug":              updatedAlbum.Slug,
+			"name":              updatedAlbum.Name,
+			"description":       updatedAlbum.Description,
+			"cover_image_id":    updatedAlbum.CoverImageId,
+			"is_published":      updatedAlbum.IsPublished,
+			"size_profile_set":  updatedAlbum.SizeProfileSet,
+			"watermark_enabled": updatedAlbum.WatermarkEnabled,
+			"privacy_policy":    updatedAlbum.PrivacyPolicy,
 		})
 
 	return nil
@@ -343,6 +748,27 @@ func (d *SqliteDatabase) ListAlbums(album *[]Album) error {
 	return nil
 }
 
+func (d *SqliteDatabase) ListImageAlbums(imageId string) ([]Album, error) {
+	var albums []Album
+
+	err := d.Db.
+		Joins("INNER JOIN album_images ai ON ai.album_id = albums.album_id").
+		Where("ai.image_id = ?", imageId).
+		Find(&albums).Error
+
+	return albums, err
+}
+
+func (d *SqliteDatabase) ListAlbumImageIds(albumId string) ([]string, error) {
+	var imageIds []string
+
+	err := d.Db.Model(&AlbumImage{}).
+		Where("album_id = ?", albumId).
+		Pluck("image_id", &imageIds).Error
+
+	return imageIds, err
+}
+
 func (d *SqliteDatabase) AddImageToAlbum(albumId string, imageId string) error {
 	d.Db.Create(&AlbumImage{
 		AlbumId: albumId,
@@ -378,13 +804,37 @@ func (d *SqliteDatabase) ListAlbumImages(albumSlug string, minWidth int, limit i
 	return sizedFiles, nil
 }
 
-func (d *SqliteDatabase) ListAlbumFiles(albumSlug string) ([]AlbumWithImage, error) {
+func (d *SqliteDatabase) ListAlbumFiles(albumSlug string, includeHidden bool) ([]AlbumWithImage, error) {
 	var images []AlbumWithImage
 
-	d.Db.Preload("Files", preloadFilesQuery).
-		Where("slug = ?", albumSlug).
+	query := d.Db.Preload("Files", preloadFilesQuery).
+		Where("slug = ?", albumSlug)
+	if !includeHidden {
+		query = query.Where("visibility <> ?", VISIBILITY_HIDDEN)
+	}
+
+	query.
 		Order("date_time_original DESC").
 		Find(&images)
 
 	return images, nil
 }
+
+func (d *SqliteDatabase) SaveWorkerHeartbeat(heartbeat *WorkerHeartbeat) error {
+	return d.Db.Save(heartbeat).Error
+}
+
+func (d *SqliteDatabase) DeleteWorkerHeartbeat(workerId string) error {
+	return d.Db.Delete(&WorkerHeartbeat{}, "worker_id = ?", workerId).Error
+}
+
+// Lists the workers which reported recently first. Heartbeats of processes
+// that died without removing theirs are pruned after a day.
+func (d *SqliteDatabase) ListWorkerHeartbeats(heartbeats *[]WorkerHeartbeat) error {
+	err := d.Db.Where("last_seen < ?", time.Now().Add(-24*time.Hour)).Delete(&WorkerHeartbeat{}).Error
+	if err != nil {
+		return err
+	}
+
+	return d.Db.Order("last_seen DESC").Find(heartbeats).Error
+}
@@ -0,0 +1,104 @@
+package resources
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	. "github.com/eburlingame/fstop/models"
+)
+
+func TestEscapeLikePattern(t *testing.T) {
+	for value, want := range map[string]string{
+		"Portland": "Portland",
+		"100%":     `100\%`,
+		"a_b":      `a\_b`,
+		`C:\`:      `C:\\`,
+		`\%_`:      `\\\%\_`,
+	} {
+		if got := escapeLikePattern(value); got != want {
+			t.Errorf("escapeLikePattern(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestFilterPlace(t *testing.T) {
+	db, err := InitSqliteDatabase(&Configuration{SQLiteFilepath: filepath.Join(t.TempDir(), "fstop.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addImage := func(imageId string, city string, latitude float64, longitude float64) {
+		image := Image{
+			ImageId:     imageId,
+			Latitude:    &latitude,
+			Longitude:   &longitude,
+			CountryCode: "US",
+			Country:     "United States",
+			Region:      "Oregon",
+			City:        city,
+		}
+		if err := db.AddImage(&image); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addImage("downtown", "Portland", 45.5152, -122.6784)
+	addImage("home", "Portland", 45.5580, -122.6520)
+	addImage("stripped", "Portland", 45.5231, -122.6765)
+	addImage("percent", "100% Bend", 44.0582, -121.3153)
+	addImage("underscore", "Sisters_Camp", 44.2910, -121.5492)
+
+	db.AddAlbum(Album{AlbumId: "private", Slug: "private", PrivacyPolicy: PRIVACY_STRIP_GPS})
+	db.AddImageToAlbum("private", "stripped")
+
+	geofences := []Geofence{{Latitude: 45.5585, Longitude: -122.6525, RadiusMeters: 200}}
+
+	search := func(filter PlaceFilter) string {
+		filter.DefaultPrivacyPolicy = PRIVACY_KEEP
+		filter.Geofences = geofences
+
+		images, err := db.ListLatestImages(false, filter, 100, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		imageIds := []string{}
+		for _, image := range images {
+			imageIds = append(imageIds, image.ImageId)
+		}
+		sort.Strings(imageIds)
+		return strings.Join(imageIds, ",")
+	}
+
+	// Images in a geofence or in an album stripping the location aren't found
+	if got := search(PlaceFilter{City: "portland"}); got != "downtown" {
+		t.Errorf("city filter found %q, want downtown", got)
+	}
+	if got := search(PlaceFilter{Country: "us", Region: "OREGON"}); got != "downtown,percent,underscore" {
+		t.Errorf("region filter found %q", got)
+	}
+
+	// Wildcards in a search are matched literally
+	if got := search(PlaceFilter{Search: "%"}); got != "percent" {
+		t.Errorf("search for %% found %q, want percent", got)
+	}
+	if got := search(PlaceFilter{Search: "t_r"}); got != "" {
+		t.Errorf("search for t_r found %q, want nothing", got)
+	}
+	if got := search(PlaceFilter{Search: "s_c"}); got != "underscore" {
+		t.Errorf("search for s_c found %q, want underscore", got)
+	}
+	if got := search(PlaceFilter{Search: "sisters_ bend"}); got != "" {
+		t.Errorf("search for two places found %q, as every term must match", got)
+	}
+	if got := search(PlaceFilter{Search: "port"}); got != "downtown" {
+		t.Errorf("search for part of a name found %q, want downtown", got)
+	}
+
+	// Without a filter every image is listed, located or not
+	if got := search(PlaceFilter{}); got != "downtown,home,percent,stripped,underscore" {
+		t.Errorf("empty filter found %q", got)
+	}
+}
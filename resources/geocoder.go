@@ -0,0 +1,222 @@
+package resources
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	. "github.com/eburlingame/fstop/models"
+)
+
+// Locations further than this from every city aren't given a place
+const GEOCODE_MAX_DISTANCE_METERS = 50000
+
+// Files of the GeoNames dump read alongside the cities, for the names of the
+// countries and regions the cities reference by code
+const (
+	GEONAMES_COUNTRIES_FILE = "countryInfo.txt"
+	GEONAMES_REGIONS_FILE   = "admin1CodesASCII.txt"
+)
+
+type geoCity struct {
+	Name        string
+	Latitude    float64
+	Longitude   float64
+	CountryCode string
+	RegionCode  string
+}
+
+// Cities are indexed by the one degree cell they're in
+type geoCell struct {
+	Latitude  int
+	Longitude int
+}
+
+func cellOf(latitude float64, longitude float64) geoCell {
+	return geoCell{int(math.Floor(latitude)), int(math.Floor(longitude))}
+}
+
+// Finds the nearest city to a location, from a GeoNames cities file such as
+// cities15000.txt, without any network requests
+type Geocoder struct {
+	cells     map[geoCell][]geoCity
+	countries map[string]string // Country codes to names
+	regions   map[string]string // Codes such as US.OR to names
+}
+
+// Reads a tab separated GeoNames file, skipping comments
+func readGeonamesFile(path string, minColumns int, row func(columns []string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// The alternate names of large cities make for long lines
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		columns := strings.Split(line, "\t")
+		if len(columns) < minColumns {
+			continue
+		}
+		row(columns)
+	}
+
+	return scanner.Err()
+}
+
+// Reads a names file, keyed by its first column, if it exists
+func loadGeonamesNames(path string, nameColumn int) (map[string]string, error) {
+	names := map[string]string{}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Printf("No %s found, places will use codes instead\n", filepath.Base(path))
+		return names, nil
+	}
+
+	err := readGeonamesFile(path, nameColumn+1, func(columns []string) {
+		names[columns[0]] = columns[nameColumn]
+	})
+
+	return names, err
+}
+
+// Loads the cities, and the country and region names next to them. Returns
+// nil when no cities file is configured.
+func LoadGeocoder(citiesPath string) (*Geocoder, error) {
+	if citiesPath == "" {
+		return nil, nil
+	}
+
+	geocoder := &Geocoder{cells: map[geoCell][]geoCity{}}
+	count := 0
+
+	// Columns: geonameid, name, asciiname, alternatenames, latitude,
+	// longitude, feature class, feature code, country code, cc2, admin1 code
+	err := readGeonamesFile(citiesPath, 11, func(columns []string) {
+		latitude, err := strconv.ParseFloat(columns[4], 64)
+		if err != nil {
+			return
+		}
+		longitude, err := strconv.ParseFloat(columns[5], 64)
+		if err != nil {
+			return
+		}
+
+		cell := cellOf(latitude, longitude)
+		geocoder.cells[cell] = append(geocoder.cells[cell], geoCity{
+			Name:        columns[1],
+			Latitude:    latitude,
+			Longitude:   longitude,
+			CountryCode: columns[8],
+			RegionCode:  columns[10],
+		})
+		count++
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading cities: %s", err)
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("no cities found in %s", citiesPath)
+	}
+
+	directory := filepath.Dir(citiesPath)
+
+	geocoder.countries, err = loadGeonamesNames(filepath.Join(directory, GEONAMES_COUNTRIES_FILE), 4)
+	if err != nil {
+		return nil, fmt.Errorf("reading countries: %s", err)
+	}
+
+	geocoder.regions, err = loadGeonamesNames(filepath.Join(directory, GEONAMES_REGIONS_FILE), 1)
+	if err != nil {
+		return nil, fmt.Errorf("reading regions: %s", err)
+	}
+
+	log.Printf("Loaded %d cities for reverse geocoding\n", count)
+
+	return geocoder, nil
+}
+
+// The cells within the maximum distance of a location, wrapping around the
+// antimeridian
+func nearbyCells(latitude float64, longitude float64) []geoCell {
+	latitudeDelta := GEOCODE_MAX_DISTANCE_METERS / (EARTH_RADIUS_METERS * math.Pi / 180)
+
+	// Cells narrow towards the poles, where every longitude may be in range
+	longitudeDelta := 180.0
+	if cos := math.Cos(latitude * math.Pi / 180); cos > latitudeDelta/180 {
+		longitudeDelta = math.Min(latitudeDelta/cos, 180)
+	}
+
+	minLongitude := int(math.Floor(longitude - longitudeDelta))
+	maxLongitude := int(math.Floor(longitude + longitudeDelta))
+	if maxLongitude-minLongitude >= 360 {
+		minLongitude, maxLongitude = -180, 179
+	}
+
+	cells := []geoCell{}
+	for lat := int(math.Floor(latitude - latitudeDelta)); lat <= int(math.Floor(latitude+latitudeDelta)); lat++ {
+		for lon := minLongitude; lon <= maxLongitude; lon++ {
+			cells = append(cells, geoCell{lat, ((lon+180)%360+360)%360 - 180})
+		}
+	}
+
+	return cells
+}
+
+// Finds the place of the nearest city, if one is close enough
+func (g *Geocoder) Lookup(latitude float64, longitude float64) (Place, bool) {
+	var nearest *geoCity
+	nearestDistance := math.Inf(1)
+
+	for _, cell := range nearbyCells(latitude, longitude) {
+		cities := g.cells[cell]
+		for i := range cities {
+			distance := DistanceMeters(latitude, longitude, cities[i].Latitude, cities[i].Longitude)
+			if distance < nearestDistance {
+				nearest = &cities[i]
+				nearestDistance = distance
+			}
+		}
+	}
+
+	if nearest == nil || nearestDistance > GEOCODE_MAX_DISTANCE_METERS {
+		return Place{}, false
+	}
+
+	country := g.countries[nearest.CountryCode]
+	if country == "" {
+		country = nearest.CountryCode
+	}
+
+	return Place{
+		CountryCode: nearest.CountryCode,
+		Country:     country,
+		Region:      g.regions[nearest.CountryCode+"."+nearest.RegionCode],
+		City:        nearest.Name,
+	}, true
+}
+
+// The place of an image's location, empty when it has none or it's too far
+// from every city
+func (g *Geocoder) LookupImage(image *Image) Place {
+	latitude, longitude, ok := image.Coordinates()
+	if !ok {
+		return Place{}
+	}
+
+	place, _ := g.Lookup(latitude, longitude)
+	return place
+}
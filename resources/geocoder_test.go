@@ -0,0 +1,200 @@
+package resources
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/eburlingame/fstop/models"
+)
+
+func TestNearbyCells(t *testing.T) {
+	tests := []struct {
+		name      string
+		latitude  float64
+		longitude float64
+		want      []geoCell // Included among the cells
+		wantCount int       // Cells in total, if checked
+	}{
+		{
+			name:      "middle of a cell",
+			latitude:  45.5,
+			longitude: -122.5,
+			want:      []geoCell{{45, -124}, {45, -123}, {45, -122}},
+			wantCount: 3,
+		},
+		{
+			name:      "next to a cell boundary",
+			latitude:  45.99,
+			longitude: -122.01,
+			want:      []geoCell{{45, -123}, {46, -122}, {45, -122}, {46, -123}},
+		},
+		{
+			name:      "west of the antimeridian",
+			latitude:  -16.5,
+			longitude: 179.9,
+			want:      []geoCell{{-17, 179}, {-17, -180}},
+		},
+		{
+			name:      "east of the antimeridian",
+			latitude:  -16.5,
+			longitude: -179.9,
+			want:      []geoCell{{-17, -180}, {-17, 179}},
+		},
+		{
+			name:      "next to the pole every longitude is in range",
+			latitude:  89.9,
+			longitude: 10,
+			want:      []geoCell{{89, -180}, {89, 179}, {89, 0}},
+			wantCount: 2 * 360,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cells := nearbyCells(test.latitude, test.longitude)
+
+			found := map[geoCell]bool{}
+			for _, cell := range cells {
+				if cell.Longitude < -180 || cell.Longitude > 179 {
+					t.Errorf("cell %v is outside -180 to 179", cell)
+				}
+				if found[cell] {
+					t.Errorf("cell %v is included twice", cell)
+				}
+				found[cell] = true
+			}
+
+			for _, cell := range test.want {
+				if !found[cell] {
+					t.Errorf("cell %v isn't included", cell)
+				}
+			}
+			if test.wantCount != 0 && len(cells) != test.wantCount {
+				t.Errorf("got %d cells, want %d", len(cells), test.wantCount)
+			}
+		})
+	}
+}
+
+// Writes a GeoNames dump with the given rows of cities, countries and regions
+func writeGeonamesFiles(t *testing.T, cities [][]string, countries [][]string, regions [][]string) string {
+	directory := t.TempDir()
+
+	write := func(name string, rows [][]string) {
+		lines := []string{"# GeoNames test data"}
+		for _, row := range rows {
+			lines = append(lines, strings.Join(row, "\t"))
+		}
+
+		err := ioutil.WriteFile(filepath.Join(directory, name), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("cities15000.txt", cities)
+	write(GEONAMES_COUNTRIES_FILE, countries)
+	write(GEONAMES_REGIONS_FILE, regions)
+
+	return filepath.Join(directory, "cities15000.txt")
+}
+
+func geonamesCity(name string, latitude string, longitude string, countryCode string, regionCode string) []string {
+	return []string{"1", name, name, "", latitude, longitude, "P", "PPL", countryCode, "", regionCode}
+}
+
+func TestGeocoderLookup(t *testing.T) {
+	citiesPath := writeGeonamesFiles(t,
+		[][]string{
+			geonamesCity("Portland", "45.52345", "-122.67621", "US", "OR"),
+			geonamesCity("Vancouver", "45.63873", "-122.66149", "US", "WA"),
+			geonamesCity("Savusavu", "-16.77889", "179.33111", "FJ", "03"),
+			geonamesCity("Taveuni", "-16.85", "-179.95", "FJ", "03"),
+			geonamesCity("Longyearbyen", "78.22334", "15.64689", "SJ", ""),
+		},
+		[][]string{
+			{"US", "USA", "840", "US", "United States"},
+			{"FJ", "FJI", "242", "FJ", "Fiji"},
+		},
+		[][]string{
+			{"US.OR", "Oregon"},
+			{"US.WA", "Washington"},
+			{"FJ.03", "Northern"},
+		},
+	)
+
+	geocoder, err := LoadGeocoder(citiesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		latitude  float64
+		longitude float64
+		want      Place
+		wantFound bool
+	}{
+		{
+			name:      "nearest of two cities",
+			latitude:  45.52,
+			longitude: -122.68,
+			want:      Place{CountryCode: "US", Country: "United States", Region: "Oregon", City: "Portland"},
+			wantFound: true,
+		},
+		{
+			name:      "city in the next cell",
+			latitude:  46.01,
+			longitude: -122.66,
+			want:      Place{CountryCode: "US", Country: "United States", Region: "Washington", City: "Vancouver"},
+			wantFound: true,
+		},
+		{
+			name:      "city across the antimeridian",
+			latitude:  -16.85,
+			longitude: 179.9,
+			want:      Place{CountryCode: "FJ", Country: "Fiji", Region: "Northern", City: "Taveuni"},
+			wantFound: true,
+		},
+		{
+			name:      "country without a name uses its code",
+			latitude:  78.2,
+			longitude: 15.6,
+			want:      Place{CountryCode: "SJ", Country: "SJ", City: "Longyearbyen"},
+			wantFound: true,
+		},
+		{
+			name:      "too far from every city",
+			latitude:  44.0,
+			longitude: -121.0,
+			wantFound: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			place, found := geocoder.Lookup(test.latitude, test.longitude)
+
+			if found != test.wantFound {
+				t.Fatalf("Lookup() found = %v, want %v", found, test.wantFound)
+			}
+			if place != test.want {
+				t.Errorf("Lookup() = %+v, want %+v", place, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadGeocoderWithoutCities(t *testing.T) {
+	geocoder, err := LoadGeocoder("")
+	if geocoder != nil || err != nil {
+		t.Errorf("LoadGeocoder(\"\") = %v, %v, want nil", geocoder, err)
+	}
+
+	citiesPath := writeGeonamesFiles(t, [][]string{}, [][]string{}, [][]string{})
+	if _, err := LoadGeocoder(citiesPath); err == nil {
+		t.Error("LoadGeocoder() of an empty file didn't fail")
+	}
+}
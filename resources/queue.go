@@ -4,21 +4,72 @@ import (
 	. "github.com/eburlingame/fstop/models"
 
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 
 	"gorm.io/gorm"
 
 	"github.com/maragudk/goqite"
 )
 
+const QUEUE_NAME = "process"
+
+// Messages which can't be processed are moved to this queue, which is never
+// received from
+const DEAD_QUEUE_NAME = "process-dead"
+
+// Messages are dead-lettered once they've been received this many times
+// without being finished, e.g. when processing them crashes the server
+const QUEUE_MAX_RECEIVE = 3
+
+// How long a message is hidden from other workers once received. Workers
+// extend it while they're still processing.
+const QUEUE_TIMEOUT = time.Minute
+
+// The format goqite stores timestamps in
+const queueTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Returned when a message can't be changed because a worker is processing it
+var ErrTaskInFlight = errors.New("the task is being processed")
+
+// Matches the messages no worker is processing, which are those that are dead
+// or pending. Takes the dead queue's name and the current time as arguments.
+const notInFlightCondition = "(queue = ? OR received = 0 OR ? >= timeout)"
+
 type Queue interface {
-	AddTask(task ImageImport) error
-	Receive() (*goqite.ID, *ImageImport, error)
-	Done(id goqite.ID) error
+	AddTask(ctx context.Context, task ImageImport) error
+	AddDelayedTask(ctx context.Context, task ImageImport, delay time.Duration) error
+	Receive(ctx context.Context) (*goqite.ID, *ImageImport, error)
+	Extend(ctx context.Context, id goqite.ID, delay time.Duration) error
+	Done(ctx context.Context, id goqite.ID) error
+
+	// Makes a received message available again straight away, without
+	// counting the receive, e.g. when its worker is shutting down
+	Release(ctx context.Context, id goqite.ID) error
+
+	// Receives when tasks may have become available to an idle worker
+	Notify() <-chan struct{}
+	// Wakes an idle worker, if there is one
+	Wake()
+
+	// Moves messages which were received too many times to the dead-letter
+	// queue, returning the tasks which were moved
+	MoveDeadTasks(ctx context.Context) ([]ImageImport, error)
+
+	ListTasks(ctx context.Context, state string) ([]QueuedTask, error)
+	GetTask(ctx context.Context, id string) (*QueuedTask, error)
+	RequeueTask(ctx context.Context, id string) error
+	DeleteTask(ctx context.Context, id string) error
+	PurgeTasks(ctx context.Context, state string) ([]QueuedTask, error)
 }
 
 type SqliteQueue struct {
-	queue *goqite.Queue
+	queue  *goqite.Queue
+	db     *sql.DB
+	notify chan struct{}
 }
 
 func InitQueue(gorm_db *gorm.DB) (SqliteQueue, error) {
@@ -30,28 +81,50 @@ func InitQueue(gorm_db *gorm.DB) (SqliteQueue, error) {
 	goqite.Setup(context.Background(), db)
 
 	queue := goqite.New(goqite.NewOpts{
-		DB:   db,
-		Name: "process",
+		DB:         db,
+		Name:       QUEUE_NAME,
+		MaxReceive: QUEUE_MAX_RECEIVE,
+		Timeout:    QUEUE_TIMEOUT,
 	})
 
 	return SqliteQueue{
 		queue,
+		db,
+		make(chan struct{}, 1),
 	}, nil
 }
 
-func (q *SqliteQueue) AddTask(task ImageImport) error {
+func (q *SqliteQueue) AddTask(ctx context.Context, task ImageImport) error {
+	return q.AddDelayedTask(ctx, task, 0)
+}
+
+// Adds a task which won't be received until the delay has passed
+func (q *SqliteQueue) AddDelayedTask(ctx context.Context, task ImageImport, delay time.Duration) error {
 	data, err := json.Marshal(task)
 	if err != nil {
 		return err
 	}
 
-	return q.queue.Send(context.Background(), goqite.Message{
-		Body: data,
+	err = q.queue.Send(ctx, goqite.Message{
+		Body:  data,
+		Delay: delay,
 	})
+	if err != nil {
+		return err
+	}
+
+	// Delayed tasks are picked up once an idle worker next polls
+	if delay == 0 {
+		q.Wake()
+	}
+
+	return nil
 }
 
-func (q *SqliteQueue) Receive() (*goqite.ID, *ImageImport, error) {
-	msg, err := q.queue.Receive(context.Background())
+// Receives the next task. Messages which aren't a valid task are moved to
+// the dead-letter queue rather than being received again.
+func (q *SqliteQueue) Receive(ctx context.Context) (*goqite.ID, *ImageImport, error) {
+	msg, err := q.queue.Receive(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -62,17 +135,257 @@ func (q *SqliteQueue) Receive() (*goqite.ID, *ImageImport, error) {
 
 	var task ImageImport
 	if err := json.Unmarshal(msg.Body, &task); err != nil {
-		return nil, nil, err
+		if moveErr := q.moveToDeadQueue(ctx, string(msg.ID)); moveErr != nil {
+			return nil, nil, moveErr
+		}
+		return nil, nil, fmt.Errorf("dead-lettered invalid message %s: %s", msg.ID, err)
 	}
 
 	return &msg.ID, &task, nil
 }
 
-func (q *SqliteQueue) Done(id goqite.ID) error {
-	err := q.queue.Delete(context.Background(), id)
+func (q *SqliteQueue) Extend(ctx context.Context, id goqite.ID, delay time.Duration) error {
+	return q.queue.Extend(ctx, id, delay)
+}
+
+func (q *SqliteQueue) Done(ctx context.Context, id goqite.ID) error {
+	err := q.queue.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (q *SqliteQueue) Release(ctx context.Context, id goqite.ID) error {
+	_, err := q.db.ExecContext(ctx, `
+		UPDATE goqite
+		SET received = max(received - 1, 0), timeout = ?
+		WHERE queue = ? AND id = ?`,
+		time.Now().Format(queueTimeFormat), QUEUE_NAME, string(id),
+	)
 	if err != nil {
 		return err
 	}
 
+	q.Wake()
 	return nil
 }
+
+func (q *SqliteQueue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// A pending notification already wakes a worker, so this never blocks
+func (q *SqliteQueue) Wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *SqliteQueue) moveToDeadQueue(ctx context.Context, id string) error {
+	_, err := q.db.ExecContext(ctx,
+		`UPDATE goqite SET queue = ? WHERE queue = ? AND id = ?`,
+		DEAD_QUEUE_NAME, QUEUE_NAME, id,
+	)
+	return err
+}
+
+func (q *SqliteQueue) MoveDeadTasks(ctx context.Context) ([]ImageImport, error) {
+	now := time.Now().Format(queueTimeFormat)
+
+	// Returning the bodies and moving them in one statement means a message
+	// can't be received in between
+	rows, err := q.db.QueryContext(ctx, `
+		UPDATE goqite
+		SET queue = ?
+		WHERE queue = ?
+			AND received >= ?
+			AND ? >= timeout
+		RETURNING body`,
+		DEAD_QUEUE_NAME, QUEUE_NAME, QUEUE_MAX_RECEIVE, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []ImageImport{}
+	for rows.Next() {
+		var body []byte
+		if err := rows.Scan(&body); err != nil {
+			return nil, err
+		}
+
+		var task ImageImport
+		if err := json.Unmarshal(body, &task); err == nil {
+			tasks = append(tasks, task)
+		}
+	}
+
+	return tasks, rows.Err()
+}
+
+// Matches the messages in the given state, as arguments to a WHERE clause
+func queueStateCondition(state string) (string, []interface{}, error) {
+	now := time.Now().Format(queueTimeFormat)
+
+	switch state {
+	case QUEUE_STATE_PENDING:
+		return "queue = ? AND (received = 0 OR ? >= timeout)", []interface{}{QUEUE_NAME, now}, nil
+	case QUEUE_STATE_IN_FLIGHT:
+		return "queue = ? AND received > 0 AND timeout > ?", []interface{}{QUEUE_NAME, now}, nil
+	case QUEUE_STATE_DEAD:
+		return "queue = ?", []interface{}{DEAD_QUEUE_NAME}, nil
+	default:
+		return "", nil, fmt.Errorf("unknown queue state %s", state)
+	}
+}
+
+func getQueuedTaskState(queue string, received int, timeout time.Time) string {
+	if queue == DEAD_QUEUE_NAME {
+		return QUEUE_STATE_DEAD
+	}
+	if received > 0 && timeout.After(time.Now()) {
+		return QUEUE_STATE_IN_FLIGHT
+	}
+	return QUEUE_STATE_PENDING
+}
+
+// The columns scanTasks reads
+const queuedTaskColumns = "id, queue, created, timeout, received, body"
+
+func (q *SqliteQueue) queryTasks(ctx context.Context, condition string, args ...interface{}) ([]QueuedTask, error) {
+	rows, err := q.db.QueryContext(ctx,
+		`SELECT `+queuedTaskColumns+` FROM goqite WHERE `+condition+` ORDER BY created`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTasks(rows)
+}
+
+func scanTasks(rows *sql.Rows) ([]QueuedTask, error) {
+	defer rows.Close()
+
+	tasks := []QueuedTask{}
+	for rows.Next() {
+		var id, queue, created, timeout string
+		var received int
+		var body []byte
+
+		if err := rows.Scan(&id, &queue, &created, &timeout, &received, &body); err != nil {
+			return nil, err
+		}
+
+		task := QueuedTask{
+			Id:       id,
+			Received: received,
+		}
+		task.Created, _ = time.Parse(queueTimeFormat, created)
+		task.Timeout, _ = time.Parse(queueTimeFormat, timeout)
+		task.State = getQueuedTaskState(queue, received, task.Timeout)
+
+		var payload ImageImport
+		if err := json.Unmarshal(body, &payload); err != nil {
+			task.ParseError = err.Error()
+		} else {
+			task.Task = &payload
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+func (q *SqliteQueue) ListTasks(ctx context.Context, state string) ([]QueuedTask, error) {
+	condition, args, err := queueStateCondition(state)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.queryTasks(ctx, condition, args...)
+}
+
+func (q *SqliteQueue) GetTask(ctx context.Context, id string) (*QueuedTask, error) {
+	tasks, err := q.queryTasks(ctx, "queue IN (?, ?) AND id = ?", QUEUE_NAME, DEAD_QUEUE_NAME, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+
+	return &tasks[0], nil
+}
+
+// Fails with ErrTaskInFlight when a statement guarded by notInFlightCondition
+// matched no message, as it was checked to exist beforehand
+func requireAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrTaskInFlight
+	}
+
+	return nil
+}
+
+// Makes a pending or dead message available to be received straight away.
+// Messages being processed are left alone, checked in the same statement so
+// a worker can't receive one in between.
+func (q *SqliteQueue) RequeueTask(ctx context.Context, id string) error {
+	now := time.Now().Format(queueTimeFormat)
+
+	err := requireAffected(q.db.ExecContext(ctx, `
+		UPDATE goqite
+		SET queue = ?, received = 0, timeout = ?
+		WHERE queue IN (?, ?) AND id = ? AND `+notInFlightCondition,
+		QUEUE_NAME, now, QUEUE_NAME, DEAD_QUEUE_NAME, id, DEAD_QUEUE_NAME, now,
+	))
+	if err != nil {
+		return err
+	}
+
+	q.Wake()
+	return nil
+}
+
+// Deletes a pending or dead message, failing if it's being processed
+func (q *SqliteQueue) DeleteTask(ctx context.Context, id string) error {
+	return requireAffected(q.db.ExecContext(ctx,
+		`DELETE FROM goqite WHERE queue IN (?, ?) AND id = ? AND `+notInFlightCondition,
+		QUEUE_NAME, DEAD_QUEUE_NAME, id, DEAD_QUEUE_NAME, time.Now().Format(queueTimeFormat),
+	))
+}
+
+// Deletes every message in the state which isn't being processed, returning
+// the messages deleted
+func (q *SqliteQueue) PurgeTasks(ctx context.Context, state string) ([]QueuedTask, error) {
+	condition, args, err := queueStateCondition(state)
+	if err != nil {
+		return nil, err
+	}
+
+	args = append(args, DEAD_QUEUE_NAME, time.Now().Format(queueTimeFormat))
+
+	rows, err := q.db.QueryContext(ctx,
+		`DELETE FROM goqite WHERE `+condition+` AND `+notInFlightCondition+` RETURNING `+queuedTaskColumns,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTasks(rows)
+}
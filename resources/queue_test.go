@@ -0,0 +1,204 @@
+package resources
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	. "github.com/eburlingame/fstop/models"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// A message placed directly in the goqite table, named by its task's image
+type testMessage struct {
+	imageId  string
+	queue    string
+	received int
+	timeout  time.Duration // From now
+}
+
+// Opens a queue in a temporary database holding the messages, returning the
+// id of each by image
+func openTestQueue(t *testing.T, messages []testMessage) (*SqliteQueue, map[string]string) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "queue.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := InitQueue(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	ids := map[string]string{}
+
+	for _, message := range messages {
+		if err := queue.AddTask(ctx, ImageImport{ImageId: message.imageId}); err != nil {
+			t.Fatal(err)
+		}
+
+		var id string
+		err := queue.db.QueryRowContext(ctx, `SELECT id FROM goqite ORDER BY rowid DESC LIMIT 1`).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[message.imageId] = id
+
+		_, err = queue.db.ExecContext(ctx,
+			`UPDATE goqite SET queue = ?, received = ?, timeout = ? WHERE id = ?`,
+			message.queue, message.received, time.Now().Add(message.timeout).Format(queueTimeFormat), id,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &queue, ids
+}
+
+var testMessages = []testMessage{
+	{"new", QUEUE_NAME, 0, 0},
+	{"delayed", QUEUE_NAME, 0, time.Hour},
+	{"retry", QUEUE_NAME, 1, -time.Minute},
+	{"processing", QUEUE_NAME, 1, time.Minute},
+	{"crashed", QUEUE_NAME, QUEUE_MAX_RECEIVE, -time.Minute},
+	{"last-attempt", QUEUE_NAME, QUEUE_MAX_RECEIVE, time.Minute},
+	{"dead", DEAD_QUEUE_NAME, QUEUE_MAX_RECEIVE, -time.Minute},
+	{"invalid", DEAD_QUEUE_NAME, 1, time.Minute},
+}
+
+func taskImageIds(tasks []QueuedTask) []string {
+	imageIds := []string{}
+	for _, task := range tasks {
+		imageIds = append(imageIds, task.Task.ImageId)
+	}
+	sort.Strings(imageIds)
+	return imageIds
+}
+
+func TestQueueStateCondition(t *testing.T) {
+	tests := []struct {
+		state string
+		want  []string
+	}{
+		{QUEUE_STATE_PENDING, []string{"crashed", "delayed", "new", "retry"}},
+		{QUEUE_STATE_IN_FLIGHT, []string{"last-attempt", "processing"}},
+		{QUEUE_STATE_DEAD, []string{"dead", "invalid"}},
+	}
+
+	queue, _ := openTestQueue(t, testMessages)
+
+	for _, test := range tests {
+		t.Run(test.state, func(t *testing.T) {
+			tasks, err := queue.ListTasks(context.Background(), test.state)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := taskImageIds(tasks); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ListTasks(%s) = %v, want %v", test.state, got, test.want)
+			}
+			for _, task := range tasks {
+				if task.State != test.state {
+					t.Errorf("task %s has state %s, want %s", task.Task.ImageId, task.State, test.state)
+				}
+			}
+		})
+	}
+
+	if _, _, err := queueStateCondition("unknown"); err == nil {
+		t.Error("queueStateCondition(unknown) didn't fail")
+	}
+}
+
+func TestMoveDeadTasks(t *testing.T) {
+	queue, _ := openTestQueue(t, testMessages)
+	ctx := context.Background()
+
+	moved, err := queue.MoveDeadTasks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 1 || moved[0].ImageId != "crashed" {
+		t.Errorf("MoveDeadTasks() = %v, want only crashed", moved)
+	}
+
+	dead, err := queue.ListTasks(ctx, QUEUE_STATE_DEAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := taskImageIds(dead), []string{"crashed", "dead", "invalid"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dead tasks = %v, want %v", got, want)
+	}
+}
+
+func TestRequeueAndDeleteTask(t *testing.T) {
+	tests := []struct {
+		imageId   string
+		wantError bool
+	}{
+		{"new", false},
+		{"retry", false},
+		{"processing", true},
+		{"last-attempt", true},
+		{"dead", false},
+		{"invalid", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.imageId, func(t *testing.T) {
+			queue, ids := openTestQueue(t, testMessages)
+			ctx := context.Background()
+
+			err := queue.RequeueTask(ctx, ids[test.imageId])
+			if (err != nil) != test.wantError {
+				t.Fatalf("RequeueTask() error = %v, want error %v", err, test.wantError)
+			}
+
+			task, _ := queue.GetTask(ctx, ids[test.imageId])
+			if !test.wantError && (task.State != QUEUE_STATE_PENDING || task.Received != 0) {
+				t.Errorf("requeued task is %s after %d receives, want pending", task.State, task.Received)
+			}
+			if test.wantError && task.State != QUEUE_STATE_IN_FLIGHT {
+				t.Errorf("task being processed is %s after requeuing", task.State)
+			}
+
+			err = queue.DeleteTask(ctx, ids[test.imageId])
+			if (err != nil) != test.wantError {
+				t.Fatalf("DeleteTask() error = %v, want error %v", err, test.wantError)
+			}
+
+			task, _ = queue.GetTask(ctx, ids[test.imageId])
+			if (task != nil) != test.wantError {
+				t.Errorf("task exists = %v after deleting, want %v", task != nil, test.wantError)
+			}
+		})
+	}
+}
+
+func TestPurgeTasksSkipsInFlight(t *testing.T) {
+	queue, _ := openTestQueue(t, testMessages)
+	ctx := context.Background()
+
+	purged, err := queue.PurgeTasks(ctx, QUEUE_STATE_IN_FLIGHT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 0 {
+		t.Errorf("purged %v tasks being processed", taskImageIds(purged))
+	}
+
+	purged, err = queue.PurgeTasks(ctx, QUEUE_STATE_PENDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := taskImageIds(purged), []string{"crashed", "delayed", "new", "retry"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PurgeTasks(pending) = %v, want %v", got, want)
+	}
+}
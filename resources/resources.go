@@ -5,4 +5,6 @@ type Resources struct {
 	Storage Storage
 	Db      Database
 	Queue   Queue
+
+	Geocoder *Geocoder // Nil when reverse geocoding isn't configured
 }
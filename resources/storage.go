@@ -2,6 +2,7 @@ package resources
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"log"
 	"strings"
@@ -13,12 +14,12 @@ import (
 )
 
 type Storage interface {
-	PutFile(contents []byte, destPath string, contentType string) error
+	PutFile(ctx context.Context, contents []byte, destPath string, contentType string) error
 	GetSignedUploadUrl(destPath string, contentType string) (string, error)
-	ListFiles(prefix string) ([]string, error)
-	GetFile(key string) ([]byte, error)
-	DeleteFile(key string) error
-	MoveFile(key string, newKey string) error
+	ListFiles(ctx context.Context, prefix string) ([]string, error)
+	GetFile(ctx context.Context, key string) ([]byte, error)
+	DeleteFile(ctx context.Context, key string) error
+	MoveFile(ctx context.Context, key string, newKey string) error
 }
 
 type S3Storage struct {
@@ -43,10 +44,10 @@ func InitS3Storage(config *Configuration) (*S3Storage, error) {
 	return storage, nil
 }
 
-func (s *S3Storage) PutFile(contents []byte, destPath string, contentType string) error {
+func (s *S3Storage) PutFile(ctx context.Context, contents []byte, destPath string, contentType string) error {
 	size := int64(len(contents))
 
-	_, err := s3.New(s.session).PutObject(&s3.PutObjectInput{
+	_, err := s3.New(s.session).PutObjectWithContext(ctx, &s3.PutObjectInput{
 		Bucket:               aws.String(s.bucketName),
 		Key:                  aws.String(destPath),
 		ACL:                  aws.String("public-read"),
@@ -76,13 +77,13 @@ func (s *S3Storage) GetSignedUploadUrl(destPath string, contentType string) (str
 	return urlStr, err
 }
 
-func (s *S3Storage) ListFiles(prefix string) ([]string, error) {
+func (s *S3Storage) ListFiles(ctx context.Context, prefix string) ([]string, error) {
 	svc := s3.New(s.session)
 
 	objects := []*s3.Object{}
 
 	pageNum := 0
-	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+	err := svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucketName),
 		Prefix: aws.String(prefix),
 	},
@@ -107,24 +108,25 @@ func (s *S3Storage) ListFiles(prefix string) ([]string, error) {
 	return names, nil
 }
 
-func (s *S3Storage) GetFile(key string) ([]byte, error) {
+func (s *S3Storage) GetFile(ctx context.Context, key string) ([]byte, error) {
 	svc := s3.New(s.session)
 
-	obj, err := svc.GetObject(&s3.GetObjectInput{
+	obj, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
 	})
 	if err != nil {
 		return nil, err
 	}
+	defer obj.Body.Close()
 
 	return ioutil.ReadAll(obj.Body)
 }
 
-func (s *S3Storage) DeleteFile(key string) error {
+func (s *S3Storage) DeleteFile(ctx context.Context, key string) error {
 	svc := s3.New(s.session)
 
-	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+	_, err := svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
 	})
@@ -132,12 +134,12 @@ func (s *S3Storage) DeleteFile(key string) error {
 	return err
 }
 
-func (s *S3Storage) MoveFile(key string, newKey string) error {
+func (s *S3Storage) MoveFile(ctx context.Context, key string, newKey string) error {
 	svc := s3.New(s.session)
 
 	// Copy the object
 	log.Printf("Copying %s to %s\n", key, newKey)
-	_, err := svc.CopyObject(&s3.CopyObjectInput{
+	_, err := svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
 		CopySource: aws.String(s.bucketName + "/" + key),
 		Bucket:     aws.String(s.bucketName),
 		Key:        aws.String(newKey),
@@ -147,7 +149,7 @@ func (s *S3Storage) MoveFile(key string, newKey string) error {
 	}
 
 	log.Printf("Deleting %s\n", key)
-	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+	_, err = svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
 	})
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"strings"
+
+	. "github.com/eburlingame/fstop/models"
+)
+
+var livePhotoStillFormats = map[string]bool{
+	"heic": true,
+	"heif": true,
+	"jpeg": true,
+}
+
+// Pairs the stills and motion clips of Live Photos, which are uploaded as
+// files sharing a name, without regard to case as iOS exports IMG_1234.HEIC
+// with IMG_1234.mov. Returns the names to import, and the clip paired with
+// each still.
+func PairLivePhotos(names []string) ([]string, map[string]string) {
+	stills := map[string]string{}
+	for _, name := range names {
+		if livePhotoStillFormats[FormatFromExtension(GetExtension(name))] {
+			stills[strings.ToLower(strings.TrimSuffix(name, GetExtension(name)))] = name
+		}
+	}
+
+	paired := map[string]string{}
+	imported := []string{}
+
+	for _, name := range names {
+		if IsVideoFormat(FormatFromExtension(GetExtension(name))) {
+			still, ok := stills[strings.ToLower(strings.TrimSuffix(name, GetExtension(name)))]
+			if ok && paired[still] == "" {
+				paired[still] = name
+				continue
+			}
+		}
+
+		imported = append(imported, name)
+	}
+
+	return imported, paired
+}
+
+// Pairs the imported files with the XMP sidecars in the upload folder, named
+// either like IMG_1234.xmp or IMG_1234.CR2.xmp. A sidecar shared by a RAW
+// file and its JPEG goes to the RAW file, as Lightroom writes it for that.
+// Returns the names to import, without any sidecars among them, and the
+// sidecar of each.
+func PairSidecars(names []string, uploaded []string) ([]string, map[string]string) {
+	sidecars := map[string]string{}
+	for _, name := range uploaded {
+		if IsXmpSidecar(name) {
+			sidecars[strings.ToLower(strings.TrimSuffix(name, GetExtension(name)))] = name
+		}
+	}
+
+	imported := []string{}
+	for _, name := range names {
+		if !IsXmpSidecar(name) {
+			imported = append(imported, name)
+		}
+	}
+
+	paired := map[string]string{}
+	claimed := map[string]bool{}
+
+	claim := func(name string, key string) {
+		sidecar, ok := sidecars[strings.ToLower(key)]
+		if ok && !claimed[sidecar] && paired[name] == "" {
+			paired[name] = sidecar
+			claimed[sidecar] = true
+		}
+	}
+
+	for _, name := range imported {
+		claim(name, name)
+	}
+	for _, isRaw := range []bool{true, false} {
+		for _, name := range imported {
+			if IsRawFormat(FormatFromExtension(GetExtension(name))) == isRaw {
+				claim(name, strings.TrimSuffix(name, GetExtension(name)))
+			}
+		}
+	}
+
+	return imported, paired
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPairSidecars(t *testing.T) {
+	tests := []struct {
+		name         string
+		names        []string
+		uploaded     []string
+		wantImported []string
+		wantPaired   map[string]string
+	}{
+		{
+			name:         "shared sidecar goes to the RAW file",
+			names:        []string{"IMG_1.JPG", "IMG_1.CR2", "IMG_1.xmp"},
+			uploaded:     []string{"IMG_1.JPG", "IMG_1.CR2", "IMG_1.xmp"},
+			wantImported: []string{"IMG_1.JPG", "IMG_1.CR2"},
+			wantPaired:   map[string]string{"IMG_1.CR2": "IMG_1.xmp"},
+		},
+		{
+			name:         "sidecars named after the full file name",
+			names:        []string{"IMG_2.CR2", "IMG_2.JPG"},
+			uploaded:     []string{"IMG_2.CR2", "IMG_2.JPG", "IMG_2.JPG.xmp", "IMG_2.xmp"},
+			wantImported: []string{"IMG_2.CR2", "IMG_2.JPG"},
+			wantPaired:   map[string]string{"IMG_2.CR2": "IMG_2.xmp", "IMG_2.JPG": "IMG_2.JPG.xmp"},
+		},
+		{
+			name:         "full name sidecar of the RAW file leaves the shared one to the JPEG",
+			names:        []string{"IMG_3.CR2", "IMG_3.JPG"},
+			uploaded:     []string{"IMG_3.CR2", "IMG_3.JPG", "IMG_3.CR2.xmp", "IMG_3.xmp"},
+			wantImported: []string{"IMG_3.CR2", "IMG_3.JPG"},
+			wantPaired:   map[string]string{"IMG_3.CR2": "IMG_3.CR2.xmp", "IMG_3.JPG": "IMG_3.xmp"},
+		},
+		{
+			name:         "JPEG without a RAW file",
+			names:        []string{"IMG_4.jpg"},
+			uploaded:     []string{"IMG_4.jpg", "IMG_4.XMP"},
+			wantImported: []string{"IMG_4.jpg"},
+			wantPaired:   map[string]string{"IMG_4.jpg": "IMG_4.XMP"},
+		},
+		{
+			name:         "names differing in case",
+			names:        []string{"img_5.NEF"},
+			uploaded:     []string{"img_5.NEF", "IMG_5.xmp"},
+			wantImported: []string{"img_5.NEF"},
+			wantPaired:   map[string]string{"img_5.NEF": "IMG_5.xmp"},
+		},
+		{
+			name:         "sidecar of a file which isn't imported",
+			names:        []string{"IMG_6.JPG"},
+			uploaded:     []string{"IMG_6.JPG", "IMG_7.JPG", "IMG_7.xmp"},
+			wantImported: []string{"IMG_6.JPG"},
+			wantPaired:   map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			imported, paired := PairSidecars(test.names, test.uploaded)
+
+			if !reflect.DeepEqual(imported, test.wantImported) {
+				t.Errorf("imported = %v, want %v", imported, test.wantImported)
+			}
+			if !reflect.DeepEqual(paired, test.wantPaired) {
+				t.Errorf("paired = %v, want %v", paired, test.wantPaired)
+			}
+		})
+	}
+}
+
+func TestPairLivePhotos(t *testing.T) {
+	names := []string{
+		"IMG_1.HEIC", "IMG_1.MOV", // As exported by iOS
+		"IMG_2.heic", "img_2.mov", // Renamed on another system
+		"IMG_3.JPG", "IMG_3.mp4",
+		"IMG_4.CR2", "IMG_4.mov", // RAW files aren't Live Photos
+		"IMG_5.mov", // A video on its own
+		"IMG_6.HEIC", "IMG_6.mov", "IMG_6.MP4",
+	}
+
+	imported, paired := PairLivePhotos(names)
+
+	wantImported := []string{"IMG_1.HEIC", "IMG_2.heic", "IMG_3.JPG", "IMG_4.CR2", "IMG_4.mov", "IMG_5.mov", "IMG_6.HEIC", "IMG_6.MP4"}
+	if !reflect.DeepEqual(imported, wantImported) {
+		t.Errorf("imported = %v, want %v", imported, wantImported)
+	}
+
+	// A still only has one clip, and another with its name is imported alone
+	wantPaired := map[string]string{
+		"IMG_1.HEIC": "IMG_1.MOV",
+		"IMG_2.heic": "img_2.mov",
+		"IMG_3.JPG":  "IMG_3.mp4",
+		"IMG_6.HEIC": "IMG_6.mov",
+	}
+	if !reflect.DeepEqual(paired, wantPaired) {
+		t.Errorf("paired = %v, want %v", paired, wantPaired)
+	}
+}
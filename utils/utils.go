@@ -49,11 +49,105 @@ func PublicImageURL(s3Url string, storagePath string) string {
 	return fmt.Sprintf("%s/%s", s3Url, storagePath)
 }
 
+// Returns the format of a file, inferring it from the extension for files
+// generated before the format was recorded
+func GetFileFormat(file *File) string {
+	if file.Format != "" {
+		return file.Format
+	}
+	return FormatFromExtension(filepath.Ext(file.StoragePath))
+}
+
+func FormatFromExtension(extension string) string {
+	format := strings.TrimPrefix(strings.ToLower(extension), ".")
+
+	if format == "jpg" {
+		return "jpeg"
+	}
+	if format == "tif" {
+		return "tiff"
+	}
+	return format
+}
+
+// Content types of the camera RAW formats which can be imported
+var rawContentTypes = map[string]string{
+	"cr2": "image/x-canon-cr2",
+	"cr3": "image/x-canon-cr3",
+	"nef": "image/x-nikon-nef",
+	"arw": "image/x-sony-arw",
+	"raf": "image/x-fuji-raf",
+	"dng": "image/x-adobe-dng",
+}
+
+func IsRawFormat(format string) bool {
+	_, ok := rawContentTypes[format]
+	return ok
+}
+
+func RawContentType(format string) string {
+	return rawContentTypes[format]
+}
+
+var videoContentTypes = map[string]string{
+	"mp4": "video/mp4",
+	"mov": "video/quicktime",
+	"m4v": "video/x-m4v",
+}
+
+func IsVideoFormat(format string) bool {
+	_, ok := videoContentTypes[format]
+	return ok
+}
+
+func VideoContentType(format string) string {
+	return videoContentTypes[format]
+}
+
+// Finds the web playable video of an image, if it has one
+func FindVideoFile(files []File) *File {
+	for i := range files {
+		if files[i].MediaType == FILE_MEDIA_VIDEO && !files[i].IsOriginal {
+			return &files[i]
+		}
+	}
+
+	return nil
+}
+
+// Finds the original an image's renditions are produced from, which for a
+// Live Photo is the still rather than its motion clip
+func FindOriginalFile(files []File) *File {
+	var original *File
+
+	for i := range files {
+		if !files[i].IsOriginal {
+			continue
+		}
+		if files[i].MediaType != FILE_MEDIA_VIDEO {
+			return &files[i]
+		}
+		if original == nil {
+			original = &files[i]
+		}
+	}
+
+	return original
+}
+
+func IsHeifFormat(format string) bool {
+	return format == "heic" || format == "heif"
+}
+
 func ComputeImageSrcSet(s3URL string, files []File) string {
+	return ComputeFormatSrcSet(s3URL, files, "webp")
+}
+
+func ComputeFormatSrcSet(s3URL string, files []File, format string) string {
 	srcs := []string{}
 
 	for _, file := range files {
-		if strings.HasSuffix(file.StoragePath, ".webp") && !file.IsOriginal {
+		if GetFileFormat(&file) == format && !file.IsOriginal && !file.IsCropped {
 			srcs = append(srcs, fmt.Sprintf("%s %dw", PublicImageURL(s3URL, file.StoragePath), file.Width))
 		}
 	}
@@ -61,21 +155,111 @@ func ComputeImageSrcSet(s3URL string, files []File) string {
 	return strings.Join(srcs, ", ")
 }
 
+// Formats offered as <picture> sources, in order of preference
+var pictureSourceFormats = []string{"avif", "webp"}
+
+// Computes a srcset for each modern format the image has derivatives in
+func ComputePictureSources(s3URL string, files []File) []PictureSource {
+	sources := []PictureSource{}
+
+	for _, format := range pictureSourceFormats {
+		srcSet := ComputeFormatSrcSet(s3URL, files, format)
+
+		if srcSet != "" {
+			sources = append(sources, PictureSource{
+				Type:   FormatContentType(format),
+				SrcSet: srcSet,
+			})
+		}
+	}
+
+	return sources
+}
+
+func FindSizedImageFormat(files []File, minWidth int, format string) *File {
+	var largestFile *File
+
+	for i := range files {
+		file := files[i]
+
+		if GetFileFormat(&file) != format || file.IsCropped {
+			continue
+		}
+		if file.Width > uint64(minWidth) {
+			return &file
+		}
+
+		largestFile = &file
+	}
+
+	return largestFile
+}
+
 func FindSizedImage(files []File, minWidth int) *File {
 	if len(files) == 0 {
 		return nil
 	}
 
-	for _, file := range files {
-		if file.Width > uint64(minWidth) && strings.HasSuffix(file.StoragePath, ".webp") {
-			return &file
+	sizedFile := FindSizedImageFormat(files, minWidth, "webp")
+	if sizedFile != nil {
+		return sizedFile
+	}
+
+	largestFile := files[len(files)-1]
+	return &largestFile
+}
+
+// Finds a JPEG for clients without WebP or AVIF support, when one was generated
+func FindFallbackImage(files []File, minWidth int) *File {
+	fallbackFile := FindSizedImageFormat(files, minWidth, "jpeg")
+	if fallbackFile != nil {
+		return fallbackFile
+	}
+
+	return FindSizedImage(files, minWidth)
+}
+
+// Finds the largest JPEG derivative for the full size view of an image, or the
+// largest WebP one when no JPEGs were generated
+func FindLargestFallbackImage(files []File) *File {
+	for _, format := range []string{"jpeg", "webp"} {
+		var largestFile *File
+
+		for i := range files {
+			file := files[i]
+
+			if GetFileFormat(&file) != format || file.IsOriginal || file.IsCropped {
+				continue
+			}
+			if largestFile == nil || file.Width > largestFile.Width {
+				largestFile = &file
+			}
+		}
+
+		if largestFile != nil {
+			return largestFile
 		}
 	}
 
+	if len(files) == 0 {
+		return nil
+	}
+
 	largestFile := files[len(files)-1]
 	return &largestFile
 }
 
+// The srcset of the <img> within a <picture>, used by clients which support
+// none of its sources
+func ComputeFallbackSrcSet(s3URL string, files []File) string {
+	srcSet := ComputeFormatSrcSet(s3URL, files, "jpeg")
+	if srcSet != "" {
+		return srcSet
+	}
+
+	return ComputeImageSrcSet(s3URL, files)
+}
+
 func GetMetaDescription(shutterSpeed string, fNumber float64, iso float64) string {
 	return fmt.Sprintf("%s' f/%.1f ISO %.0f", shutterSpeed, fNumber, iso)
 }
@@ -95,6 +279,23 @@ func GetImageCameraDescription(img *Image) string {
 	return GetCameraDescription(img.CameraModel, img.Lens, img.FocalLength)
 }
 
+// Shows a rating as stars, and its label if it has one
+func GetRatingDescription(rating int, label string) string {
+	description := strings.Repeat("★", rating)
+	if rating == RATING_REJECTED {
+		description = "Rejected"
+	}
+
+	if label != "" {
+		if description != "" {
+			description += ", "
+		}
+		description += label
+	}
+
+	return description
+}
+
 func GetImageCameraAndMetaDescription(img *Image) string {
 	return fmt.Sprintf(
 		"%s, %s",